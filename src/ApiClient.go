@@ -145,8 +145,10 @@ func (g *ApiClient) performRequest(req *http.Request, v interface{}) (string, er
 	httpClient := &http.Client{
 		Timeout: time.Second * 10,
 	}
+	start := time.Now()
 	resp, err := httpClient.Do(req)
 	if err != nil {
+		observeApiRequest(req, "error", start)
 		return "", fmt.Errorf("HTTP response error: %w", err)
 	}
 	defer func(Body io.ReadCloser) {
@@ -155,6 +157,7 @@ func (g *ApiClient) performRequest(req *http.Request, v interface{}) (string, er
 	}(resp.Body) // close body when func returns
 
 	body, err := ioutil.ReadAll(resp.Body) // read body first to append it to the error (if any)
+	observeApiRequest(req, strconv.Itoa(resp.StatusCode), start)
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
 		// Hint: this will mostly be the case if the tenant ID cannot be found, the Application ID cannot be found or the clientSecret is incorrect.
 		// The cause will be described in the body, hence we have to return the body too for proper error-analysis
@@ -282,6 +285,8 @@ func (g *ApiClient) refreshToken() error {
 
 	var newToken Token
 	_, err = g.performRequest(req, &newToken) // perform the prepared request
+	tokenRefreshCounter.WithLabelValues(resultLabel(err)).Inc()
+	readiness.tokenRefreshed(err)
 	if err != nil {
 		return fmt.Errorf("error on getting msgraph Token: %v", err)
 	}
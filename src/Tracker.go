@@ -4,15 +4,75 @@ import (
 	"bufio"
 	"fmt"
 	"github.com/cornelk/hashmap"
-	"log"
 	"os"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Tracker struct {
 	hashSet         hashmap.HashMap
 	historyFilePath string
+	// inflight holds the content uris whose records have not all been delivered yet, they are left out of the history file
+	inflight sync.Map
+}
+
+// blobDelivery counts the outstanding work of one content blob: fetching it and delivering each of its records.
+// The blob only stays in the history once all of it succeeded, otherwise it is fetched again on the next run.
+type blobDelivery struct {
+	contentUri string
+	tracker    *Tracker
+	pending    int64
+	failed     int32
+
+	completeLock sync.Mutex
+	completed    []func()
+}
+
+// track starts the delivery accounting of a blob, holding it open until the fetch calls done
+func (t *Tracker) track(contentUri string) *blobDelivery {
+	t.inflight.Store(contentUri, struct{}{})
+	return &blobDelivery{contentUri: contentUri, tracker: t, pending: 1}
+}
+
+// add holds the blob open for one more record delivery
+func (b *blobDelivery) add() {
+	atomic.AddInt64(&b.pending, 1)
+}
+
+// onComplete registers f to run once every record of the blob was resolved
+func (b *blobDelivery) onComplete(f func()) {
+	b.completeLock.Lock()
+	b.completed = append(b.completed, f)
+	b.completeLock.Unlock()
+}
+
+// done resolves one fetch or record delivery, err marks the whole blob as failed
+func (b *blobDelivery) done(err error) {
+	if err != nil {
+		atomic.StoreInt32(&b.failed, 1)
+	}
+	if atomic.AddInt64(&b.pending, -1) != 0 {
+		return
+	}
+	if b.hasFailed() {
+		stageLog(stageHistory).Warnf("content %v was not fully delivered, it will be fetched again on the next run", logStringSani(b.contentUri))
+		b.tracker.hashSet.Del(b.contentUri)
+	}
+	b.completeLock.Lock()
+	completed := b.completed
+	b.completed = nil
+	b.completeLock.Unlock()
+	for _, f := range completed {
+		f()
+	}
+	b.tracker.inflight.Delete(b.contentUri)
+}
+
+// hasFailed reports whether a fetch or record delivery of the blob failed
+func (b *blobDelivery) hasFailed() bool {
+	return atomic.LoadInt32(&b.failed) != 0
 }
 
 func (t *Tracker) load() {
@@ -27,7 +87,7 @@ func loadIntoSet(set *hashmap.HashMap, filePath string) {
 	defer func(file *os.File) {
 		err := file.Close()
 		if err != nil {
-			log.Fatal(err)
+			stageLog(stageHistory).Fatal(err)
 		}
 	}(file)
 	fileScanner := bufio.NewScanner(file)
@@ -42,7 +102,7 @@ func loadIntoSet(set *hashmap.HashMap, filePath string) {
 	}
 }
 func (t *Tracker) String() {
-	log.Println(t.hashSet.String())
+	stageLog(stageHistory).Info(t.hashSet.String())
 }
 
 // dump re-reads the history file and finds the difference between the in-memory set and the old set
@@ -50,22 +110,25 @@ func (t *Tracker) String() {
 func (t *Tracker) dump() error {
 	file, err := os.OpenFile(t.historyFilePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil {
-		log.Fatal(err)
+		stageLog(stageHistory).Fatal(err)
 		return err
 	}
 	defer func(file *os.File) {
 		err := file.Close()
 		if err != nil {
-			log.Fatal(err)
+			stageLog(stageHistory).Fatal(err)
 		}
 	}(file)
 	pnt := int64(0)
 	for entry := range t.hashSet.Iter() {
+		if _, pending := t.inflight.Load(entry.Key); pending {
+			continue
+		}
 		s := ([]byte)(fmt.Sprintf("%v\t%v\n", entry.Key, entry.Value))
 		sz, err2 := file.WriteAt(s, pnt)
 		pnt += int64(sz)
 		if err2 != nil {
-			log.Println(err2)
+			stageLog(stageHistory).Error(err2)
 			return err2
 		}
 	}
@@ -82,7 +145,7 @@ func (t *Tracker) pruneHistory(threshold time.Duration) error {
 		entryTs := (entry.Value).(string)
 		unixTS, err := strconv.ParseInt(entryTs, 10, 64)
 		if err != nil {
-			log.Println(err)
+			stageLog(stageHistory).Error(err)
 			return err
 		}
 		if thresholdTime >= unixTS {
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"o365logexporter/promtail-client/promtail"
+	"regexp"
+	"time"
+)
+
+const (
+	databaseBatchSize = 1000
+	databaseBatchWait = 5 * time.Second
+	databaseTimeout   = time.Minute
+)
+
+// databaseColumns are the columns written for every record, in the order of databaseRow.values
+var databaseColumns = []string{
+	"id", "creation_time", "record_type", "operation", "organization_id", "user_type", "user_key", "user_id",
+	"workload", "result_status", "object_id", "client_ip", "tenant_id", "content_type", "content_id", "record",
+}
+
+var databaseTablePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+type databaseConfig struct {
+	// Driver is postgres or sqlite
+	Driver string
+	// DSN is a postgres connection string or URL, or the path of the SQLite database file
+	DSN string
+	// Table holds the records, it is created and migrated on start
+	Table      string
+	TenantId   string
+	MaxRetries int
+}
+
+// databaseDialect holds what differs between the supported databases
+type databaseDialect struct {
+	driver string
+	// migrations are applied in order, each one in a transaction together with its schema_migrations row
+	migrations func(table string) [][]string
+	// lock is run first in the migration transaction to keep concurrent instances from migrating at once
+	lock   string
+	insert func(ctx context.Context, db *sql.DB, table string, rows []databaseRow) error
+	// permanent reports an insert error caused by the data of a row, retrying the same rows cannot help
+	permanent func(err error) bool
+	// open tunes the pool after sql.Open
+	open func(db *sql.DB)
+	// uncancellable runs the statements without the timeout, for a driver that cannot be interrupted safely
+	uncancellable bool
+}
+
+var databaseDialects = map[string]databaseDialect{
+	"postgres": postgresDialect,
+	"sqlite":   sqliteDialect,
+}
+
+// databaseRow is a record split into the common schema columns. Rows travel through the batcher JSON encoded.
+type databaseRow struct {
+	Id             *string         `json:"id"`
+	CreationTime   *time.Time      `json:"creationTime"`
+	RecordType     *int64          `json:"recordType"`
+	Operation      *string         `json:"operation"`
+	OrganizationId *string         `json:"organizationId"`
+	UserType       *int64          `json:"userType"`
+	UserKey        *string         `json:"userKey"`
+	UserId         *string         `json:"userId"`
+	Workload       *string         `json:"workload"`
+	ResultStatus   *string         `json:"resultStatus"`
+	ObjectId       *string         `json:"objectId"`
+	ClientIP       *string         `json:"clientIP"`
+	TenantId       string          `json:"tenantId"`
+	ContentType    string          `json:"contentType"`
+	ContentId      string          `json:"contentId"`
+	Record         json.RawMessage `json:"record"`
+}
+
+// databaseOutput inserts records into a table with the common audit fields as columns and the full record as JSON.
+// The unique constraint on id makes inserts idempotent, records of a blob fetched again are skipped.
+type databaseOutput struct {
+	*outputBatcher
+	config  databaseConfig
+	dialect databaseDialect
+	db      *sql.DB
+}
+
+func newDatabaseOutput(config databaseConfig) (*databaseOutput, error) {
+	dialect, ok := databaseDialects[config.Driver]
+	if !ok {
+		return nil, fmt.Errorf("unknown database driver %q, expected postgres or sqlite", config.Driver)
+	}
+	if !databaseTablePattern.MatchString(config.Table) {
+		return nil, fmt.Errorf("invalid database table name %q", config.Table)
+	}
+	db, err := sql.Open(dialect.driver, config.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open database: %w", err)
+	}
+	dialect.open(db)
+	d := &databaseOutput{config: config, dialect: dialect, db: db}
+	ctx, cancel := d.context()
+	defer cancel()
+	if err := d.migrate(ctx); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("unable to migrate database: %w", err)
+	}
+	d.outputBatcher = newOutputBatcher(databaseBatchSize, databaseBatchWait, d.send)
+	return d, nil
+}
+
+// context bounds a database operation by databaseTimeout unless the dialect is uncancellable
+func (d *databaseOutput) context() (context.Context, context.CancelFunc) {
+	if d.dialect.uncancellable {
+		return context.Background(), func() {}
+	}
+	return context.WithTimeout(context.Background(), databaseTimeout)
+}
+
+// migrate applies the migrations newer than the version recorded in schema_migrations
+func (d *databaseOutput) migrate(ctx context.Context) error {
+	_, err := d.db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS schema_migrations (tbl TEXT NOT NULL, version INTEGER NOT NULL, PRIMARY KEY (tbl, version))")
+	if err != nil {
+		return err
+	}
+	for i, statements := range d.dialect.migrations(d.config.Table) {
+		version := i + 1
+		err := d.inTransaction(ctx, func(tx *sql.Tx) error {
+			if d.dialect.lock != "" {
+				if _, err := tx.ExecContext(ctx, d.dialect.lock); err != nil {
+					return err
+				}
+			}
+			var applied int
+			// the table name is validated and the version is ours, neither needs a placeholder
+			row := tx.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(*) FROM schema_migrations WHERE tbl = '%s' AND version = %d", d.config.Table, version))
+			if err := row.Scan(&applied); err != nil || applied > 0 {
+				return err
+			}
+			for _, statement := range statements {
+				if _, err := tx.ExecContext(ctx, statement); err != nil {
+					return fmt.Errorf("migration %d: %w", version, err)
+				}
+			}
+			_, err := tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO schema_migrations (tbl, version) VALUES ('%s', %d)", d.config.Table, version))
+			if err == nil {
+				sinkLog("database").Infof("applied migration %d to %v", version, d.config.Table)
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *databaseOutput) inTransaction(ctx context.Context, f func(tx *sql.Tx) error) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := f(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// write queues the row of a record
+func (d *databaseOutput) write(ctx context.Context, record auditRecord, line []byte, done func(error)) error {
+	row := newDatabaseRow(record, d.config.TenantId, line)
+	payload, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	return d.add(ctx, payload, done)
+}
+
+// close inserts the remaining records and closes the database
+func (d *databaseOutput) close(ctx context.Context) error {
+	err := d.outputBatcher.close(ctx)
+	if err == nil {
+		err = d.db.Close()
+	}
+	return err
+}
+
+func (d *databaseOutput) send(batch []batchItem) {
+	rows := make([]databaseRow, 0, len(batch))
+	for _, item := range batch {
+		var row databaseRow
+		if err := json.Unmarshal(item.payload, &row); err != nil {
+			// cannot happen, the payload was encoded by write
+			resolveBatch(batch, err)
+			return
+		}
+		rows = append(rows, row)
+	}
+	err := d.insert(rows)
+	if err != nil && len(rows) > 1 && d.dialect.permanent(err) {
+		// a bad row fails the whole batch, insert them one by one so only the bad rows fail
+		sinkLog("database").Warnf("batch of %d records rejected, inserting them one by one: %v", len(rows), err)
+		for i := range rows {
+			err := d.insert(rows[i : i+1])
+			if err != nil {
+				sinkLog("database").Errorf("failing record %v of %v: %v", nullable(rows[i].Id), rows[i].ContentId, err)
+			}
+			resolveBatch(batch[i:i+1], err)
+		}
+		return
+	}
+	if err != nil {
+		sinkLog("database").Errorf("failing %d records: %v", len(batch), err)
+	}
+	resolveBatch(batch, err)
+}
+
+// insert inserts the rows in one transaction, retrying unless the error is permanent
+func (d *databaseOutput) insert(rows []databaseRow) error {
+	return retryWithBackoff(d.quit, d.config.MaxRetries, "database", func() (bool, error) {
+		ctx, cancel := d.context()
+		defer cancel()
+		err := d.dialect.insert(ctx, d.db, d.config.Table, rows)
+		return err != nil && !d.dialect.permanent(err), err
+	})
+}
+
+func newDatabaseRow(record auditRecord, tenantId string, line []byte) databaseRow {
+	row := databaseRow{
+		Id:             databaseString(record.content, "Id"),
+		RecordType:     databaseInt(record.content, "RecordType"),
+		Operation:      databaseString(record.content, "Operation"),
+		OrganizationId: databaseString(record.content, "OrganizationId"),
+		UserType:       databaseInt(record.content, "UserType"),
+		UserKey:        databaseString(record.content, "UserKey"),
+		UserId:         databaseString(record.content, "UserId"),
+		Workload:       databaseString(record.content, "Workload"),
+		ResultStatus:   databaseString(record.content, "ResultStatus"),
+		ObjectId:       databaseString(record.content, "ObjectId"),
+		ClientIP:       databaseString(record.content, "ClientIP"),
+		TenantId:       tenantId,
+		ContentType:    record.contentType,
+		ContentId:      record.contentId,
+		Record:         line,
+	}
+	if value := recordField(record.content, "CreationTime"); value != "" {
+		if ts, err := promtail.ParseTimestamp(value); err == nil {
+			row.CreationTime = &ts
+		}
+	}
+	return row
+}
+
+// values returns the column values of the row in the order of databaseColumns, absent fields are NULL
+func (r databaseRow) values(formatTime func(time.Time) interface{}) []interface{} {
+	var creationTime interface{}
+	if r.CreationTime != nil {
+		creationTime = formatTime(*r.CreationTime)
+	}
+	return []interface{}{
+		nullable(r.Id), creationTime, nullable(r.RecordType), nullable(r.Operation), nullable(r.OrganizationId),
+		nullable(r.UserType), nullable(r.UserKey), nullable(r.UserId), nullable(r.Workload), nullable(r.ResultStatus),
+		nullable(r.ObjectId), nullable(r.ClientIP), r.TenantId, r.ContentType, r.ContentId, string(r.Record),
+	}
+}
+
+func nullable(value interface{}) interface{} {
+	switch v := value.(type) {
+	case *string:
+		if v != nil {
+			return *v
+		}
+	case *int64:
+		if v != nil {
+			return *v
+		}
+	}
+	return nil
+}
+
+func databaseString(content map[string]interface{}, name string) *string {
+	value := recordField(content, name)
+	if value == "" {
+		return nil
+	}
+	return &value
+}
+
+func databaseInt(content map[string]interface{}, name string) *int64 {
+	value, ok := content[name].(float64)
+	if !ok {
+		return nil
+	}
+	n := int64(value)
+	return &n
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgconn"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestDatabase(t *testing.T, path string) *databaseOutput {
+	t.Helper()
+	output, err := newDatabaseOutput(databaseConfig{Driver: "sqlite", DSN: path, Table: "audit", TenantId: "tenant1", MaxRetries: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return output
+}
+
+// insertRecords writes a record per operation and returns the delivery result of each
+func insertRecords(t *testing.T, output *databaseOutput, operations ...string) []error {
+	t.Helper()
+	results := make([]chan error, len(operations))
+	for i, operation := range operations {
+		results[i] = make(chan error, 1)
+		record := auditRecord{
+			content: map[string]interface{}{
+				"Id":           fmt.Sprintf("id-%d", i),
+				"CreationTime": "2022-07-01T10:00:00",
+				"RecordType":   float64(15),
+				"Operation":    operation,
+				"Workload":     "AzureActiveDirectory",
+			},
+			contentType: "Audit.AzureActiveDirectory",
+			contentId:   "blob1",
+		}
+		line := []byte(fmt.Sprintf(`{"Id":"id-%d","Operation":%q}`, i, operation))
+		result := results[i]
+		if err := output.write(context.Background(), record, line, func(err error) { result <- err }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := output.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	errs := make([]error, len(results))
+	for i, result := range results {
+		errs[i] = <-result
+	}
+	return errs
+}
+
+// openTestDatabase opens a connection of its own to the database of the output
+func openTestDatabase(t *testing.T, path string) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+func countRows(t *testing.T, path, query string) int {
+	t.Helper()
+	var count int
+	if err := openTestDatabase(t, path).QueryRow(query).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestDatabaseMigrations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.db")
+	for i := 0; i < 2; i++ {
+		// the second start finds the migrations applied and leaves the schema alone
+		output := newTestDatabase(t, path)
+		if err := output.close(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := countRows(t, path, "SELECT COUNT(*) FROM schema_migrations WHERE tbl = 'audit'"), len(sqliteMigrations("audit")); got != want {
+		t.Errorf("%d migrations recorded, want %d", got, want)
+	}
+	if got := countRows(t, path, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND tbl_name = 'audit' AND name LIKE 'audit_%_idx'"); got != 3 {
+		t.Errorf("%d indexes created, want 3", got)
+	}
+	for _, column := range append(databaseColumns, "inserted_at") {
+		if got := countRows(t, path, fmt.Sprintf("SELECT COUNT(*) FROM pragma_table_info('audit') WHERE name = '%s'", column)); got != 1 {
+			t.Errorf("column %v is missing", column)
+		}
+	}
+}
+
+func TestDatabaseReinsertIsIdempotent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.db")
+	for run := 0; run < 2; run++ {
+		// a blob fetched again in a later run inserts the same records
+		output := newTestDatabase(t, path)
+		for _, err := range insertRecords(t, output, "UserLoggedIn", "UserLoginFailed", "Add user.") {
+			if err != nil {
+				t.Errorf("run %d: record failed: %v", run, err)
+			}
+		}
+		if err := output.close(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := countRows(t, path, "SELECT COUNT(*) FROM audit"); got != 3 {
+		t.Errorf("%d rows, want 3", got)
+	}
+	if got := countRows(t, path, "SELECT COUNT(*) FROM audit WHERE creation_time = '2022-07-01T10:00:00.000Z' AND record_type = 15 AND tenant_id = 'tenant1' AND json_extract(record, '$.Id') = id"); got != 3 {
+		t.Errorf("%d rows with the expected columns, want 3", got)
+	}
+}
+
+func TestDatabaseFailsOnlyTheBadRow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.db")
+	output := newTestDatabase(t, path)
+	defer output.close(context.Background())
+	// a constraint OR IGNORE does not skip, standing in for a row the database rejects
+	_, err := openTestDatabase(t, path).Exec(`CREATE TRIGGER reject_bad BEFORE INSERT ON audit WHEN NEW.operation = 'Bad' BEGIN SELECT RAISE(ABORT, 'bad row'); END`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	errs := insertRecords(t, output, "UserLoggedIn", "Bad", "UserLoginFailed")
+	if errs[0] != nil || errs[2] != nil {
+		t.Errorf("the good rows failed: %v", errs)
+	}
+	if errs[1] == nil {
+		t.Error("the bad row was reported inserted")
+	}
+	if elapsed := time.Since(start); elapsed > outputMinBackoff {
+		t.Errorf("the permanent error was retried, took %v", elapsed)
+	}
+	if got := countRows(t, path, "SELECT COUNT(*) FROM audit"); got != 2 {
+		t.Errorf("%d rows, want the 2 good ones", got)
+	}
+}
+
+func TestPostgresPermanent(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: &pgconn.PgError{Code: "23505"}, want: true},
+		{err: &pgconn.PgError{Code: "22P02"}, want: true},
+		{err: fmt.Errorf("copy: %w", &pgconn.PgError{Code: "22001"}), want: true},
+		{err: &pgconn.PgError{Code: "40001"}, want: false},
+		{err: &pgconn.PgError{Code: "57P01"}, want: false},
+		{err: errors.New("connection reset by peer"), want: false},
+	}
+	for _, tt := range tests {
+		if got := postgresPermanent(tt.err); got != tt.want {
+			t.Errorf("postgresPermanent(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/stdlib"
+	"strings"
+	"time"
+)
+
+var postgresDialect = databaseDialect{
+	driver:     "pgx",
+	migrations: postgresMigrations,
+	// an arbitrary application wide key
+	lock:      "SELECT pg_advisory_xact_lock(3650365)",
+	insert:    postgresInsert,
+	permanent: postgresPermanent,
+	open: func(db *sql.DB) {
+		db.SetMaxOpenConns(4)
+		db.SetConnMaxIdleTime(5 * time.Minute)
+	},
+}
+
+func postgresMigrations(table string) [][]string {
+	return [][]string{
+		{
+			fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %[1]s (
+	id TEXT,
+	creation_time TIMESTAMPTZ,
+	record_type INTEGER,
+	operation TEXT,
+	organization_id TEXT,
+	user_type INTEGER,
+	user_key TEXT,
+	user_id TEXT,
+	workload TEXT,
+	result_status TEXT,
+	object_id TEXT,
+	client_ip TEXT,
+	tenant_id TEXT NOT NULL,
+	content_type TEXT NOT NULL,
+	content_id TEXT NOT NULL,
+	record JSONB NOT NULL,
+	inserted_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	CONSTRAINT %[1]s_id_key UNIQUE (id)
+)`, table),
+			fmt.Sprintf("CREATE INDEX IF NOT EXISTS %[1]s_creation_time_idx ON %[1]s (creation_time)", table),
+			fmt.Sprintf("CREATE INDEX IF NOT EXISTS %[1]s_workload_operation_idx ON %[1]s (workload, operation)", table),
+			fmt.Sprintf("CREATE INDEX IF NOT EXISTS %[1]s_user_id_idx ON %[1]s (user_id)", table),
+		},
+	}
+}
+
+// postgresPermanent reports the SQLSTATE classes 22, data exception, and 23, integrity constraint violation
+func postgresPermanent(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	return strings.HasPrefix(pgErr.Code, "22") || strings.HasPrefix(pgErr.Code, "23")
+}
+
+// postgresInsert copies the rows into a staging table and moves them over, skipping the ids already present.
+// COPY itself has no ON CONFLICT clause.
+func postgresInsert(ctx context.Context, db *sql.DB, table string, rows []databaseRow) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.Raw(func(driverConn interface{}) error {
+		pgConn := driverConn.(*stdlib.Conn).Conn()
+		tx, err := pgConn.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(ctx)
+		staging := table + "_staging"
+		_, err = tx.Exec(ctx, fmt.Sprintf("CREATE TEMPORARY TABLE %s (LIKE %s INCLUDING DEFAULTS) ON COMMIT DROP", staging, table))
+		if err != nil {
+			return err
+		}
+		values := make([][]interface{}, 0, len(rows))
+		for _, row := range rows {
+			values = append(values, row.values(func(ts time.Time) interface{} { return ts }))
+		}
+		_, err = tx.CopyFrom(ctx, pgx.Identifier{staging}, databaseColumns, pgx.CopyFromRows(values))
+		if err != nil {
+			return err
+		}
+		columns := strings.Join(databaseColumns, ", ")
+		_, err = tx.Exec(ctx, fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s ON CONFLICT (id) DO NOTHING", table, columns, columns, staging))
+		if err != nil {
+			return err
+		}
+		return tx.Commit(ctx)
+	})
+}
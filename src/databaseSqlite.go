@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+	"strings"
+	"time"
+)
+
+var sqliteDialect = databaseDialect{
+	driver:     "sqlite",
+	migrations: sqliteMigrations,
+	insert:     sqliteInsert,
+	permanent:  sqlitePermanent,
+	open: func(db *sql.DB) {
+		// SQLite has a single writer
+		db.SetMaxOpenConns(1)
+	},
+	// the driver interrupts the connection from a goroutine watching the context of a statement, which can fire
+	// once the statement is done and abort the commit or rollback of the next transaction, leaving it open
+	uncancellable: true,
+}
+
+func sqliteMigrations(table string) [][]string {
+	return [][]string{
+		{
+			fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %[1]s (
+	id TEXT UNIQUE,
+	creation_time TEXT,
+	record_type INTEGER,
+	operation TEXT,
+	organization_id TEXT,
+	user_type INTEGER,
+	user_key TEXT,
+	user_id TEXT,
+	workload TEXT,
+	result_status TEXT,
+	object_id TEXT,
+	client_ip TEXT,
+	tenant_id TEXT NOT NULL,
+	content_type TEXT NOT NULL,
+	content_id TEXT NOT NULL,
+	record TEXT NOT NULL CHECK (json_valid(record)),
+	inserted_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+)`, table),
+			fmt.Sprintf("CREATE INDEX IF NOT EXISTS %[1]s_creation_time_idx ON %[1]s (creation_time)", table),
+			fmt.Sprintf("CREATE INDEX IF NOT EXISTS %[1]s_workload_operation_idx ON %[1]s (workload, operation)", table),
+			fmt.Sprintf("CREATE INDEX IF NOT EXISTS %[1]s_user_id_idx ON %[1]s (user_id)", table),
+		},
+	}
+}
+
+// sqlitePermanent reports constraint violations and values SQLite cannot store, the primary code is the low byte of
+// the extended one
+func sqlitePermanent(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	switch sqliteErr.Code() & 0xff {
+	case sqlite3.SQLITE_CONSTRAINT, sqlite3.SQLITE_MISMATCH, sqlite3.SQLITE_TOOBIG:
+		return true
+	}
+	return false
+}
+
+// sqliteInsert inserts the rows in one transaction, ignoring the ids already present. Times are stored as
+// RFC 3339 text in UTC, which sorts and compares correctly.
+func sqliteInsert(ctx context.Context, db *sql.DB, table string, rows []databaseRow) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(databaseColumns)), ", ")
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf("INSERT OR IGNORE INTO %s (%s) VALUES (%s)", table, strings.Join(databaseColumns, ", "), placeholders))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, row := range rows {
+		values := row.values(func(ts time.Time) interface{} { return ts.UTC().Format("2006-01-02T15:04:05.000Z") })
+		if _, err := stmt.ExecContext(ctx, values...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
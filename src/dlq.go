@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/cornelk/hashmap"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/urfave/cli/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the stages a record can fail at
+const (
+	deadLetterStageMarshal  = "marshal"
+	deadLetterStageLabels   = "labels"
+	deadLetterStageMetadata = "metadata"
+	deadLetterStageRoute    = "route"
+	deadLetterStageDeliver  = "deliver"
+	deadLetterStageReplay   = "replay"
+)
+
+const deadLetterFilePattern = "deadletter-*.jsonl"
+
+// the dead letters a replay could not decode are kept in a file with this prefix, which is not replayed
+const rejectedFilePrefix = "rejected-"
+
+var deadLettersCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "o365_exporter",
+	Name:      "dead_letters_total",
+	Help:      "Records handed to the dead letter queue, by the stage they failed at.",
+}, []string{"stage"})
+
+// deadLetter is a record that could not be processed or delivered, with where and why it failed
+type deadLetter struct {
+	Time  time.Time `json:"time"`
+	Stage string    `json:"stage"`
+	// Sink is set when the record failed in a single sink, a replay only routes it there
+	Sink        string          `json:"sink,omitempty"`
+	Error       string          `json:"error"`
+	TenantId    string          `json:"tenantId"`
+	ContentType string          `json:"contentType"`
+	ContentId   string          `json:"contentId"`
+	Record      json.RawMessage `json:"record"`
+}
+
+// deadLetterQueue stores dead letters. write calls done once the letter is stored or could not be.
+type deadLetterQueue interface {
+	write(letter deadLetter, done func(error))
+	close(ctx context.Context) error
+}
+
+func newDeadLetter(record auditRecord, line []byte, stage, sink, tenantId string, err error) deadLetter {
+	if line == nil {
+		// the record could not be encoded, keep what can be shown of it
+		line, _ = json.Marshal(fmt.Sprint(record.content))
+	}
+	return deadLetter{
+		Time:        time.Now().UTC(),
+		Stage:       stage,
+		Sink:        sink,
+		Error:       err.Error(),
+		TenantId:    tenantId,
+		ContentType: record.contentType,
+		ContentId:   record.contentId,
+		Record:      line,
+	}
+}
+
+// deadLetterDir appends dead letters to a JSONL file in a directory, one file per run. Every letter is synced
+// before it is resolved, the record is not fetched again once it is in the file.
+type deadLetterDir struct {
+	dir  string
+	lock sync.Mutex
+	file *os.File
+}
+
+func newDeadLetterDir(dir string) (*deadLetterDir, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	return &deadLetterDir{dir: dir}, nil
+}
+
+func (d *deadLetterDir) write(letter deadLetter, done func(error)) {
+	line, err := json.Marshal(letter)
+	if err == nil {
+		err = d.append(line)
+	}
+	if err != nil {
+		blobLog(letter.ContentType, letter.ContentId, stageDLQ).Errorf("unable to write dead letter: %v", err)
+	}
+	done(err)
+}
+
+func (d *deadLetterDir) append(line []byte) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.file == nil {
+		name := fmt.Sprintf("deadletter-%s-%d.jsonl", time.Now().UTC().Format("20060102T150405.000Z"), os.Getpid())
+		file, err := os.OpenFile(filepath.Join(d.dir, name), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+		if err != nil {
+			return err
+		}
+		d.file = file
+	}
+	if _, err := d.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return d.file.Sync()
+}
+
+// close ends the file of the run, the next dead letter starts a new one
+func (d *deadLetterDir) close(ctx context.Context) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.file == nil {
+		return nil
+	}
+	err := d.file.Close()
+	d.file = nil
+	return err
+}
+
+// deadLetterSink writes dead letters to one of the configured sinks, as a record holding the letter. The letters are
+// queued on the route of the sink, whose worker is the only one writing to it, and the route is closed after all
+// the others.
+type deadLetterSink struct {
+	route *sinkRoute
+}
+
+func (d deadLetterSink) write(letter deadLetter, done func(error)) {
+	line, err := json.Marshal(letter)
+	var content map[string]interface{}
+	if err == nil {
+		err = json.Unmarshal(line, &content)
+	}
+	if err == nil {
+		entry := sinkEntry{
+			record:   auditRecord{content: content, contentType: letter.ContentType, contentId: letter.ContentId},
+			line:     line,
+			ts:       letter.Time,
+			labels:   map[string]string{"stage": letter.Stage},
+			metadata: map[string]string{},
+		}
+		err = d.route.enqueue(routedEntry{entry: entry, routed: time.Now(), done: done})
+	}
+	if err != nil {
+		blobLog(letter.ContentType, letter.ContentId, stageDLQ).Errorf("unable to write dead letter: %v", err)
+		done(err)
+	}
+}
+
+func (d deadLetterSink) close(ctx context.Context) error {
+	return nil
+}
+
+// replayDeadLetters pushes the dead letters of DeadLetterDir back through the configured sinks. A file is removed
+// once all its records were delivered or dead lettered again, those land in a new file.
+func replayDeadLetters(context *cli.Context) error {
+	dir := context.String(deadLetterDirFlag)
+	if dir == "" {
+		return fmt.Errorf("%v is required to replay dead letters", deadLetterDirFlag)
+	}
+	currentTime = time.Now().UTC()
+	// listed before the sinks are configured, the dead letters of this replay go to a new file
+	paths, err := filepath.Glob(filepath.Join(dir, deadLetterFilePattern))
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		stageLog(stageDLQ).Infof("no dead letters in %v", dir)
+		return nil
+	}
+	configureRecordProcessing(context)
+	router, err := newSinkRouter(context.Int(sinkBufferSizeFlag), context.StringSlice(sinkFiltersFlag))
+	if err != nil {
+		return err
+	}
+	err = configureSinks(context, router, newLokiClient(context))
+	if err != nil {
+		router.close(context.Context)
+		return err
+	}
+
+	replay := &Tracker{hashSet: hashmap.HashMap{}}
+	var wg sync.WaitGroup
+	semaphorChan := make(chan struct{}, MaxConcurrentProcessing)
+	var resultsLock sync.Mutex
+	delivered := map[string]bool{}
+	for _, path := range paths {
+		blob := replay.track(path)
+		blob.onComplete(func(path string, blob *blobDelivery) func() {
+			return func() {
+				resultsLock.Lock()
+				delivered[path] = !blob.hasFailed()
+				resultsLock.Unlock()
+			}
+		}(path, blob))
+		count, skipped, err := replayDeadLetterFile(path, blob, router, &wg, semaphorChan)
+		if err != nil {
+			stageLog(stageDLQ).Errorf("error encountered replaying %v: %v", path, err)
+		} else {
+			stageLog(stageDLQ).Infof("replaying %d dead letters of %v", count, path)
+		}
+		if skipped > 0 {
+			stageLog(stageDLQ).Warnf("%d dead letters of %v cannot be replayed, they are kept in %v", skipped, path, rejectedFile(path))
+		}
+		blob.done(err)
+	}
+	wg.Wait()
+	router.close(context.Context)
+
+	for _, path := range paths {
+		if !delivered[path] {
+			stageLog(stageDLQ).Warnf("%v was not fully replayed, it is kept", path)
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			stageLog(stageDLQ).Errorf("unable to remove replayed %v: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// rejectedFile is where the lines of a dead letter file that cannot be replayed are kept
+func rejectedFile(path string) string {
+	return filepath.Join(filepath.Dir(path), rejectedFilePrefix+strings.TrimPrefix(filepath.Base(path), "deadletter-"))
+}
+
+// replayDeadLetterFile routes the records of a dead letter file, holding blob open for each of them. Lines that cannot
+// be replayed, a broken line or a record that was not an object when it failed, are skipped and kept in a rejected file
+// next to it, which is not replayed again and is rewritten if the file is replayed again.
+func replayDeadLetterFile(path string, blob *blobDelivery, router *sinkRouter, wg *sync.WaitGroup, semaphorChan chan struct{}) (int, int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+	var rejected *os.File
+	defer func() {
+		if rejected != nil {
+			_ = rejected.Close()
+		}
+	}()
+	reject := func(line []byte) error {
+		if rejected == nil {
+			file, err := os.OpenFile(rejectedFile(path), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+			if err != nil {
+				return err
+			}
+			rejected = file
+		}
+		if _, err := rejected.Write(append(line, '\n')); err != nil {
+			return err
+		}
+		return rejected.Sync()
+	}
+
+	count, skipped, lineNumber := 0, 0, 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		lineNumber++
+		var letter deadLetter
+		var content map[string]interface{}
+		err := json.Unmarshal(scanner.Bytes(), &letter)
+		if err == nil {
+			// a record that could not be encoded was kept as a string, only fixing it by hand helps
+			err = json.Unmarshal(letter.Record, &content)
+		}
+		if err != nil {
+			stageLog(stageDLQ).Warnf("skipping line %d of %v, it cannot be replayed: %v", lineNumber, path, err)
+			if err := reject(scanner.Bytes()); err != nil {
+				return count, skipped, fmt.Errorf("unable to keep line %d: %w", lineNumber, err)
+			}
+			skipped++
+			continue
+		}
+		count++
+		record := auditRecord{
+			content:     content,
+			contentType: letter.ContentType,
+			contentId:   letter.ContentId,
+			blob:        blob,
+			sink:        letter.Sink,
+		}
+		blob.add()
+		if record.sink != "" && !router.hasSink(record.sink) {
+			router.deadLetter(record, letter.Record, deadLetterStageReplay, record.sink, errors.New("sink is not configured"), blob.done)
+			continue
+		}
+		semaphorChan <- struct{}{}
+		wg.Add(1)
+		go processRetrievedObject(wg, semaphorChan, record, router)
+	}
+	return count, skipped, scanner.Err()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/cornelk/hashmap"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReplaySkipsAndKeepsUndecodableLetters(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "deadletter-20220701T100000.000Z-1.jsonl")
+	good := deadLetter{Time: time.Now(), Stage: deadLetterStageDeliver, ContentType: "Audit.General", ContentId: "blob1", Record: json.RawMessage(`{"Id":"1","Operation":"UserLoggedIn"}`)}
+	// a record that could not be encoded is kept as a string
+	marshal := newDeadLetter(auditRecord{content: map[string]interface{}{"Id": "2"}, contentType: "Audit.General", contentId: "blob1"}, nil, deadLetterStageMarshal, "", "tenant1", os.ErrInvalid)
+	var lines []string
+	for _, letter := range []deadLetter{good, marshal} {
+		line, err := json.Marshal(letter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, string(line))
+	}
+	lines = append(lines, `{"time":`, lines[0])
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	router, err := newSinkRouter(16, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &fakeSink{}
+	router.add("sink", sink)
+	tracker := &Tracker{hashSet: hashmap.HashMap{}}
+	blob := tracker.track(path)
+	var wg sync.WaitGroup
+	count, skipped, err := replayDeadLetterFile(path, blob, router, &wg, make(chan struct{}, 4))
+	blob.done(err)
+	wg.Wait()
+	router.close(context.Background())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 || skipped != 2 {
+		t.Errorf("%d replayed and %d skipped, want 2 and 2", count, skipped)
+	}
+	if len(sink.lines) != 2 {
+		t.Errorf("the sink got %d records, want 2", len(sink.lines))
+	}
+	if blob.hasFailed() {
+		t.Error("the skipped lines failed the file, it would never be removed")
+	}
+	rejected, err := ioutil.ReadFile(rejectedFile(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := lines[1] + "\n" + lines[2] + "\n"; string(rejected) != want {
+		t.Errorf("rejected file holds %q, want %q", rejected, want)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, deadLetterFilePattern)); len(matches) != 1 {
+		t.Errorf("the rejected file is picked up by the next replay: %v", matches)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	elasticBatchSize = 1000
+	elasticBatchWait = 5 * time.Second
+	elasticTimeout   = 60 * time.Second
+	elasticTemplate  = "o365-audit"
+)
+
+type elasticConfig struct {
+	// URL of the cluster, e.g. https://elastic:9200
+	URL string
+	// IndexPattern may contain {tenant}, {contentType}, {date} and {month}, taken from the record timestamp
+	IndexPattern string
+	Username     string
+	Password     string
+	// APIKey is the base64 encoded id:key pair, sent instead of basic auth when set
+	APIKey     string
+	TenantId   string
+	TLS        *tls.Config
+	MaxRetries int
+	// Template installs an index template mapping the common audit fields for IndexPattern
+	Template bool
+}
+
+type elasticBulkResponse struct {
+	Errors bool                                 `json:"errors"`
+	Items  []map[string]elasticBulkItemResponse `json:"items"`
+}
+
+type elasticBulkItemResponse struct {
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error"`
+}
+
+// elasticOutput indexes records with the _bulk API. Documents are created with the record Id as _id, so
+// records of a blob fetched again are reported as conflicts and not indexed twice. Items rejected with 429
+// or 5xx are retried on their own, other rejections fail their record.
+type elasticOutput struct {
+	*outputBatcher
+	config elasticConfig
+	client http.Client
+}
+
+func newElasticOutput(config elasticConfig) (*elasticOutput, error) {
+	e := &elasticOutput{
+		config: config,
+		client: http.Client{Timeout: elasticTimeout, Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: config.TLS}},
+	}
+	if config.Template {
+		if err := e.putTemplate(); err != nil {
+			return nil, fmt.Errorf("unable to install index template: %w", err)
+		}
+	}
+	e.outputBatcher = newOutputBatcher(elasticBatchSize, elasticBatchWait, e.send)
+	return e, nil
+}
+
+// indexName fills in the index pattern, index names have to be lowercase
+func (e *elasticOutput) indexName(record auditRecord, ts time.Time) string {
+	replacer := strings.NewReplacer(
+		"{tenant}", e.config.TenantId,
+		"{contentType}", record.contentType,
+		"{date}", ts.UTC().Format("2006.01.02"),
+		"{month}", ts.UTC().Format("2006.01"),
+	)
+	return strings.ToLower(replacer.Replace(e.config.IndexPattern))
+}
+
+// write queues the create action and document of a record
+func (e *elasticOutput) write(ctx context.Context, record auditRecord, line []byte, ts time.Time, done func(error)) error {
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	action := map[string]string{"_index": e.indexName(record, ts)}
+	if id := recordField(record.content, "Id"); id != "" {
+		action["_id"] = id
+	}
+	actionLine, err := json.Marshal(map[string]interface{}{"create": action})
+	if err != nil {
+		return err
+	}
+	payload := make([]byte, 0, len(actionLine)+len(line)+2)
+	payload = append(append(payload, actionLine...), '\n')
+	payload = append(append(payload, line...), '\n')
+	return e.add(ctx, payload, done)
+}
+
+func (e *elasticOutput) send(batch []batchItem) {
+	pending := batch
+	err := retryWithBackoff(e.quit, e.config.MaxRetries, "elasticsearch", func() (bool, error) {
+		var err error
+		var retryable bool
+		pending, retryable, err = e.bulk(pending)
+		return retryable, err
+	})
+	if err != nil {
+		sinkLog("elasticsearch").Errorf("dropping %d documents: %v", len(pending), err)
+		resolveBatch(pending, err)
+	}
+}
+
+// bulk sends the items and resolves those Elasticsearch accepted or rejected for good, returning the items to retry
+func (e *elasticOutput) bulk(items []batchItem) ([]batchItem, bool, error) {
+	var body []byte
+	for _, item := range items {
+		body = append(body, item.payload...)
+	}
+	resBody, status, err := e.request(http.MethodPost, "/_bulk", "application/x-ndjson", body)
+	if err != nil {
+		return items, true, err
+	}
+	if status != http.StatusOK {
+		retryable := status == http.StatusTooManyRequests || status >= 500
+		return items, retryable, fmt.Errorf("unexpected HTTP status code: %d, message: %s", status, resBody)
+	}
+	var response elasticBulkResponse
+	if err := json.Unmarshal(resBody, &response); err != nil {
+		return items, true, fmt.Errorf("unable to parse bulk response: %w", err)
+	}
+	if len(response.Items) != len(items) {
+		return items, true, fmt.Errorf("bulk response has %d items for %d documents", len(response.Items), len(items))
+	}
+	var retry []batchItem
+	var lastErr error
+	for i, item := range items {
+		for _, result := range response.Items[i] {
+			switch {
+			case result.Status < 300 || result.Status == http.StatusConflict:
+				// a conflict is a document indexed by an earlier run
+				resolveBatch(items[i:i+1], nil)
+			case result.Status == http.StatusTooManyRequests || result.Status >= 500:
+				lastErr = fmt.Errorf("document rejected with status %d: %s", result.Status, result.Error)
+				retry = append(retry, item)
+			default:
+				err := fmt.Errorf("document rejected with status %d: %s", result.Status, result.Error)
+				sinkLog("elasticsearch").Error(err)
+				resolveBatch(items[i:i+1], err)
+			}
+		}
+	}
+	if len(retry) > 0 {
+		return retry, true, fmt.Errorf("%d documents need to be retried, last error: %w", len(retry), lastErr)
+	}
+	return nil, false, nil
+}
+
+func (e *elasticOutput) request(method string, path string, contentType string, body []byte) ([]byte, int, error) {
+	req, err := http.NewRequest(method, strings.TrimSuffix(e.config.URL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if e.config.APIKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+e.config.APIKey)
+	} else if e.config.Username != "" {
+		req.SetBasicAuth(e.config.Username, e.config.Password)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	resBody, err := ioutil.ReadAll(resp.Body)
+	return resBody, resp.StatusCode, err
+}
+
+// putTemplate installs a composable index template mapping the common audit fields of the indices of IndexPattern
+func (e *elasticOutput) putTemplate() error {
+	pattern := e.config.IndexPattern
+	for _, placeholder := range []string{"{tenant}", "{contentType}", "{date}", "{month}"} {
+		pattern = strings.ReplaceAll(pattern, placeholder, "*")
+	}
+	keyword := map[string]string{"type": "keyword"}
+	template := map[string]interface{}{
+		"index_patterns": []string{strings.ToLower(pattern)},
+		"template": map[string]interface{}{
+			"mappings": map[string]interface{}{
+				"properties": map[string]interface{}{
+					"CreationTime":   map[string]string{"type": "date"},
+					"Id":             keyword,
+					"Operation":      keyword,
+					"OrganizationId": keyword,
+					"RecordType":     map[string]string{"type": "integer"},
+					"ResultStatus":   keyword,
+					"UserKey":        keyword,
+					"UserType":       map[string]string{"type": "integer"},
+					"Workload":       keyword,
+					"ClientIP":       keyword,
+					"ObjectId":       keyword,
+					"UserId":         keyword,
+				},
+			},
+		},
+	}
+	body, err := json.Marshal(template)
+	if err != nil {
+		return err
+	}
+	resBody, status, err := e.request(http.MethodPut, "/_index_template/"+elasticTemplate, "application/json", body)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("unexpected HTTP status code: %d, message: %s", status, resBody)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBulk is an Elasticsearch _bulk endpoint answering every document with the status of its Id on the first
+// request it is part of, and accepting it after that
+type fakeBulk struct {
+	*httptest.Server
+	lock     sync.Mutex
+	statuses map[string]int
+	// requests are the document Ids of every request
+	requests [][]string
+}
+
+func newFakeBulk(t *testing.T, statuses map[string]int) *fakeBulk {
+	bulk := &fakeBulk{statuses: statuses}
+	bulk.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_bulk" || r.Header.Get("Content-Type") != "application/x-ndjson" {
+			http.Error(w, "unexpected request", http.StatusNotFound)
+			return
+		}
+		var ids []string
+		var items []map[string]interface{}
+		scanner := bufio.NewScanner(r.Body)
+		bulk.lock.Lock()
+		defer bulk.lock.Unlock()
+		for scanner.Scan() {
+			var action map[string]map[string]string
+			if err := json.Unmarshal(scanner.Bytes(), &action); err != nil || !scanner.Scan() {
+				http.Error(w, "malformed action", http.StatusBadRequest)
+				return
+			}
+			id := action["create"]["_id"]
+			ids = append(ids, id)
+			status, ok := bulk.statuses[id]
+			if !ok {
+				status = http.StatusCreated
+			}
+			delete(bulk.statuses, id)
+			result := map[string]interface{}{"_id": id, "status": status}
+			if status >= 300 {
+				result["error"] = map[string]string{"type": http.StatusText(status)}
+			}
+			items = append(items, map[string]interface{}{"create": result})
+		}
+		bulk.requests = append(bulk.requests, ids)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"errors": true, "items": items})
+	}))
+	t.Cleanup(bulk.Close)
+	return bulk
+}
+
+func TestElasticBulkRetriesOnlyRetryableItems(t *testing.T) {
+	bulk := newFakeBulk(t, map[string]int{
+		"2": http.StatusConflict,
+		"3": http.StatusTooManyRequests,
+		"4": http.StatusServiceUnavailable,
+		"5": http.StatusBadRequest,
+	})
+	e, err := newElasticOutput(elasticConfig{URL: bulk.URL, IndexPattern: "o365-{contentType}", MaxRetries: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lock sync.Mutex
+	results := map[string]error{}
+	ctx := context.Background()
+	for _, id := range []string{"1", "2", "3", "4", "5"} {
+		id := id
+		record := auditRecord{content: map[string]interface{}{"Id": id}, contentType: "Audit.General"}
+		line, _ := json.Marshal(record.content)
+		err := e.write(ctx, record, line, time.Now(), func(err error) {
+			lock.Lock()
+			results[id] = err
+			lock.Unlock()
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	bulk.lock.Lock()
+	defer bulk.lock.Unlock()
+	if want := [][]string{{"1", "2", "3", "4", "5"}, {"3", "4"}}; !reflect.DeepEqual(bulk.requests, want) {
+		t.Errorf("requests carried %v, want %v", bulk.requests, want)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	for _, id := range []string{"1", "2", "3", "4"} {
+		if err, ok := results[id]; !ok || err != nil {
+			t.Errorf("document %v resolved with %v (resolved: %v), want delivered", id, err, ok)
+		}
+	}
+	if err := results["5"]; err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("document 5 resolved with %v, want the 400 rejection", err)
+	}
+}
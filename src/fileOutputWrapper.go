@@ -1,53 +1,391 @@
 package main
 
 import (
+	"compress/gzip"
 	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
+// idleFileTimeout closes output files nothing was written to for a while, e.g. yesterday's file of a {date} template
+const idleFileTimeout = 10 * time.Minute
+
+// fileSyncInterval is how long written records wait for the fsync that resolves them
+const fileSyncInterval = time.Second
+
+// fileOutputConfig describes where records are written and how files are rotated
+type fileOutputConfig struct {
+	// PathTemplate may contain {tenant}, {contentType}, {contentId}, {date} and {hour}, e.g. "{contentType}/{date}.jsonl"
+	PathTemplate string
+	TenantId     string
+	// MaxBytes and MaxAge rotate a file once it grows past or gets older than them, zero disables either
+	MaxBytes int64
+	MaxAge   time.Duration
+	// Compression of rotated files, "", "gzip" or "zstd"
+	Compression string
+	// MaxFiles is the number of rotated files kept per path, zero keeps all of them
+	MaxFiles int
+	// PerBlob writes every content blob to its own file, closed and compressed once the blob is complete
+	PerBlob bool
+}
+
+func (c fileOutputConfig) validate() error {
+	switch c.Compression {
+	case "", "gzip", "zstd":
+	default:
+		return fmt.Errorf("unknown output compression %q, expected gzip or zstd", c.Compression)
+	}
+	if c.PerBlob && !strings.Contains(c.PathTemplate, "{contentId}") {
+		return fmt.Errorf("output path %v must contain {contentId} to write one file per blob", c.PathTemplate)
+	}
+	return nil
+}
+
+// fileOutputWrapper writes records as JSON lines to the files named by the path template. It outlives a single
+// run so rotation by age keeps working in daemon mode, close only releases the open files. A record is resolved
+// once the file it was written to is fsynced, which happens every fileSyncInterval and when a file is closed.
 type fileOutputWrapper struct {
-	filePath       string
-	writeLock      sync.Mutex
-	openFileHandle *os.File
-	isOpen         bool
+	config    fileOutputConfig
+	writeLock sync.Mutex
+	files     map[string]*openOutputFile
+	// opened remembers when a path was first opened, for MaxAge
+	opened      map[string]time.Time
+	compressing sync.WaitGroup
+	// syncTimer is set while written records wait for a sync
+	syncTimer *time.Timer
+	// synced are the records of synced or closed files, resolved once writeLock is released
+	synced []syncedWrites
 }
 
-func (f *fileOutputWrapper) open() error {
-	if f.openFileHandle != nil || f.isOpen {
-		return fmt.Errorf("attempted to open file, but file handle already present in object: %v", f.openFileHandle)
+type openOutputFile struct {
+	handle    *os.File
+	size      int64
+	lastWrite time.Time
+	// pending are the done callbacks of the records written since the last sync
+	pending []func(error)
+}
+
+type syncedWrites struct {
+	done []func(error)
+	err  error
+}
+
+func newFileOutputWrapper(config fileOutputConfig) (*fileOutputWrapper, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return &fileOutputWrapper{
+		config: config,
+		files:  map[string]*openOutputFile{},
+		opened: map[string]time.Time{},
+	}, nil
+}
+
+// resolvePath fills in the path template for a record
+func (f *fileOutputWrapper) resolvePath(record auditRecord, now time.Time) string {
+	replacer := strings.NewReplacer(
+		"{tenant}", f.config.TenantId,
+		"{contentType}", record.contentType,
+		"{contentId}", record.contentId,
+		"{date}", now.Format("2006-01-02"),
+		"{hour}", now.Format("15"),
+	)
+	return filepath.Clean(replacer.Replace(f.config.PathTemplate))
+}
+
+// unlock releases writeLock and then resolves the records of the files synced meanwhile, a resolved blob may
+// close its file and take the lock again
+func (f *fileOutputWrapper) unlock() {
+	synced := f.synced
+	f.synced = nil
+	f.writeLock.Unlock()
+	for _, writes := range synced {
+		for _, done := range writes.done {
+			done(writes.err)
+		}
+	}
+}
+
+// write appends line followed by a newline to the file of the record, rotating it first if it is due. done is
+// called once the line is fsynced, or with the error that kept it from being.
+func (f *fileOutputWrapper) write(record auditRecord, line []byte, done func(error)) error {
+	f.writeLock.Lock()
+	defer f.unlock()
+	now := time.Now().UTC()
+	path := f.resolvePath(record, now)
+
+	file, ok := f.files[path]
+	if ok && !f.config.PerBlob && f.rotationDue(path, file, int64(len(line)+1), now) {
+		if err := f.rotate(path); err != nil {
+			return err
+		}
+		ok = false
+	}
+	if !ok {
+		var err error
+		file, err = f.open(path, now)
+		if err != nil {
+			return err
+		}
+		if f.config.PerBlob && record.blob != nil {
+			// its records are synced by then, what fails here only leaves the file uncompressed
+			record.blob.onComplete(func() {
+				f.writeLock.Lock()
+				defer f.unlock()
+				if err := f.rotate(path); err != nil {
+					sinkLog("file").Errorf("failed to close output file %v: %v", path, err)
+				}
+			})
+		}
 	}
-	var err error
-	f.openFileHandle, err = os.OpenFile(f.filePath, os.O_CREATE|os.O_APPEND, 0755)
+	// line is shared with the other sinks, the newline goes into a copy
+	buf := make([]byte, 0, len(line)+1)
+	buf = append(append(buf, line...), '\n')
+	written, err := file.handle.Write(buf)
+	file.size += int64(written)
+	file.lastWrite = now
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to write to %v: %w", path, err)
 	}
-	f.isOpen = true
+	file.pending = append(file.pending, done)
+	if f.syncTimer == nil {
+		f.syncTimer = time.AfterFunc(fileSyncInterval, func() {
+			if err := f.flush(); err != nil {
+				sinkLog("file").Errorf("failed to sync output files: %v", err)
+			}
+		})
+	}
+	f.closeIdle(now)
 	return nil
 }
-func (f *fileOutputWrapper) writeBytes(content []byte) (int, error) {
+
+// flush fsyncs every file with records written since its last sync and resolves those records
+func (f *fileOutputWrapper) flush() error {
 	f.writeLock.Lock()
-	write, err := f.openFileHandle.Write(content)
+	defer f.unlock()
+	if f.syncTimer != nil {
+		f.syncTimer.Stop()
+		f.syncTimer = nil
+	}
+	var lastErr error
+	for path, file := range f.files {
+		if len(file.pending) == 0 {
+			continue
+		}
+		err := file.handle.Sync()
+		if err != nil {
+			// what reached the disk is unknown after a failed sync, the next write opens the file again
+			err = fmt.Errorf("failed to sync %v: %w", path, err)
+			lastErr = err
+			_ = file.handle.Close()
+			delete(f.files, path)
+		}
+		f.synced = append(f.synced, syncedWrites{done: file.pending, err: err})
+		file.pending = nil
+	}
+	return lastErr
+}
+
+func (f *fileOutputWrapper) rotationDue(path string, file *openOutputFile, size int64, now time.Time) bool {
+	if f.config.MaxBytes > 0 && file.size > 0 && file.size+size > f.config.MaxBytes {
+		return true
+	}
+	return f.config.MaxAge > 0 && now.Sub(f.opened[path]) >= f.config.MaxAge
+}
+
+func (f *fileOutputWrapper) open(path string, now time.Time) (*openOutputFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return nil, err
+	}
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if _, ok := f.opened[path]; !ok && f.config.PerBlob {
+		// a blob is written again in full when a previous run did not complete it
+		flags |= os.O_TRUNC
+	}
+	handle, err := os.OpenFile(path, flags, 0640)
 	if err != nil {
-		return 0, nil
+		return nil, err
 	}
-	f.writeLock.Unlock()
-	return write, err
+	stat, err := handle.Stat()
+	if err != nil {
+		_ = handle.Close()
+		return nil, err
+	}
+	if _, ok := f.opened[path]; !ok {
+		f.opened[path] = now
+	}
+	file := &openOutputFile{handle: handle, size: stat.Size(), lastWrite: now}
+	f.files[path] = file
+	return file, nil
 }
-func (f *fileOutputWrapper) writeString(stringContent string) (int, error) {
-	f.writeLock.Lock()
-	write, err := f.openFileHandle.WriteString(stringContent)
+
+// closeFile fsyncs and closes the file of path, its pending records fail with the error of either
+func (f *fileOutputWrapper) closeFile(path string) error {
+	file, ok := f.files[path]
+	if !ok {
+		return nil
+	}
+	delete(f.files, path)
+	err := file.handle.Sync()
 	if err != nil {
-		return 0, nil
+		err = fmt.Errorf("failed to sync %v: %w", path, err)
+		_ = file.handle.Close()
+	} else if err = file.handle.Close(); err != nil {
+		err = fmt.Errorf("failed to close %v: %w", path, err)
 	}
-	f.writeLock.Unlock()
-	return write, err
+	if len(file.pending) > 0 {
+		f.synced = append(f.synced, syncedWrites{done: file.pending, err: err})
+	}
+	return err
 }
+
+// rotate closes the file of path and moves it aside, or compresses it in place for per blob files
+func (f *fileOutputWrapper) rotate(path string) error {
+	if err := f.closeFile(path); err != nil {
+		return err
+	}
+	delete(f.opened, path)
+	rotated := path
+	if !f.config.PerBlob {
+		rotated = fmt.Sprintf("%v.%v", path, time.Now().UTC().Format("20060102T150405.000000000"))
+		if err := os.Rename(path, rotated); err != nil {
+			return err
+		}
+	}
+	if f.config.Compression == "" {
+		f.prune(path)
+		return nil
+	}
+	f.compressing.Add(1)
+	go func() {
+		defer f.compressing.Done()
+		if err := compressFile(rotated, f.config.Compression); err != nil {
+			sinkLog("file").Errorf("failed to compress %v: %v", rotated, err)
+		}
+		if !f.config.PerBlob {
+			f.writeLock.Lock()
+			f.prune(path)
+			f.unlock()
+		}
+	}()
+	return nil
+}
+
+// prune removes the oldest rotated files of path beyond MaxFiles
+func (f *fileOutputWrapper) prune(path string) {
+	if f.config.MaxFiles <= 0 || f.config.PerBlob {
+		return
+	}
+	rotated, err := filepath.Glob(path + ".*")
+	if err != nil {
+		sinkLog("file").Errorf("failed to list rotated files of %v: %v", path, err)
+		return
+	}
+	// the rotation timestamp sorts lexically, uncompressed leftovers of an interrupted compression are kept
+	var complete []string
+	for _, name := range rotated {
+		if f.config.Compression == "" || strings.HasSuffix(name, compressionSuffix(f.config.Compression)) {
+			complete = append(complete, name)
+		}
+	}
+	sort.Strings(complete)
+	for len(complete) > f.config.MaxFiles {
+		if err := os.Remove(complete[0]); err != nil {
+			sinkLog("file").Errorf("failed to remove rotated file %v: %v", complete[0], err)
+		}
+		complete = complete[1:]
+	}
+}
+
+func (f *fileOutputWrapper) closeIdle(now time.Time) {
+	if f.config.PerBlob {
+		// per blob files are closed once their blob is complete
+		return
+	}
+	for path, file := range f.files {
+		if now.Sub(file.lastWrite) > idleFileTimeout {
+			if err := f.closeFile(path); err != nil {
+				sinkLog("file").Errorf("failed to close idle output file %v: %v", path, err)
+			}
+		}
+	}
+}
+
+// close fsyncs and closes every open file and waits for pending compressions
 func (f *fileOutputWrapper) close() error {
 	f.writeLock.Lock()
-	err := f.openFileHandle.Close()
+	if f.syncTimer != nil {
+		f.syncTimer.Stop()
+		f.syncTimer = nil
+	}
+	var lastErr error
+	for path := range f.files {
+		if err := f.closeFile(path); err != nil {
+			lastErr = err
+		}
+	}
+	f.unlock()
+	f.compressing.Wait()
+	return lastErr
+}
+
+func compressionSuffix(compression string) string {
+	if compression == "zstd" {
+		return ".zst"
+	}
+	return ".gz"
+}
+
+// newCompressor wraps w with a gzip or zstd writer
+func newCompressor(w io.Writer, compression string) (io.WriteCloser, error) {
+	if compression == "zstd" {
+		return zstd.NewWriter(w)
+	}
+	return gzip.NewWriter(w), nil
+}
+
+// compressFile replaces path with a compressed copy, which is fsynced before the original is removed
+func compressFile(path string, compression string) (err error) {
+	source, err := os.Open(path)
 	if err != nil {
 		return err
 	}
-	return nil
+	defer source.Close()
+	target := path + compressionSuffix(compression)
+	output, err := os.OpenFile(target+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = output.Close()
+			_ = os.Remove(target + ".tmp")
+		}
+	}()
+	writer, err := newCompressor(output, compression)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(writer, source); err != nil {
+		return err
+	}
+	if err = writer.Close(); err != nil {
+		return err
+	}
+	if err = output.Sync(); err != nil {
+		return err
+	}
+	if err = output.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(target+".tmp", target); err != nil {
+		return err
+	}
+	return os.Remove(path)
 }
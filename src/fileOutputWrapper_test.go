@@ -0,0 +1,256 @@
+package main
+
+import (
+	"compress/gzip"
+	"github.com/cornelk/hashmap"
+	"github.com/klauspost/compress/zstd"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func readOutputFile(t *testing.T, path string) string {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var content []byte
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		reader, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err = ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+	case strings.HasSuffix(path, ".zst"):
+		reader, err := zstd.NewReader(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reader.Close()
+		content, err = ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+	default:
+		content, err = ioutil.ReadAll(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return string(content)
+}
+
+func TestFileOutputSizeRotation(t *testing.T) {
+	// every line is 10 bytes with its newline, a file holds 3 of them
+	lines := []string{"line00001", "line00002", "line00003", "line00004", "line00005", "line00006", "line00007"}
+	tests := []struct {
+		name        string
+		compression string
+		maxFiles    int
+		// wantRotated is the content of the rotated files kept, oldest first
+		wantRotated []string
+	}{
+		{
+			name:        "uncompressed",
+			wantRotated: []string{"line00001\nline00002\nline00003\n", "line00004\nline00005\nline00006\n"},
+		},
+		{
+			name:        "gzip",
+			compression: "gzip",
+			wantRotated: []string{"line00001\nline00002\nline00003\n", "line00004\nline00005\nline00006\n"},
+		},
+		{
+			name:        "zstd",
+			compression: "zstd",
+			wantRotated: []string{"line00001\nline00002\nline00003\n", "line00004\nline00005\nline00006\n"},
+		},
+		{
+			name:        "oldest files are pruned",
+			maxFiles:    1,
+			wantRotated: []string{"line00004\nline00005\nline00006\n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			output, err := newFileOutputWrapper(fileOutputConfig{
+				PathTemplate: filepath.Join(dir, "{contentType}", "audit.jsonl"),
+				MaxBytes:     30,
+				Compression:  tt.compression,
+				MaxFiles:     tt.maxFiles,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, line := range lines {
+				if err := output.write(auditRecord{contentType: "Audit.General"}, []byte(line), func(error) {}); err != nil {
+					t.Fatal(err)
+				}
+				// compressions are asynchronous, wait for them for pruning to see them
+				output.compressing.Wait()
+			}
+			if err := output.close(); err != nil {
+				t.Fatal(err)
+			}
+
+			path := filepath.Join(dir, "Audit.General", "audit.jsonl")
+			if got := readOutputFile(t, path); got != "line00007\n" {
+				t.Errorf("current file = %q, want the last line", got)
+			}
+			rotated, _ := filepath.Glob(path + ".*")
+			sort.Strings(rotated)
+			if len(rotated) != len(tt.wantRotated) {
+				t.Fatalf("rotated files = %v, want %d", rotated, len(tt.wantRotated))
+			}
+			for i, name := range rotated {
+				if tt.compression != "" && !strings.HasSuffix(name, compressionSuffix(tt.compression)) {
+					t.Errorf("%v is not compressed", name)
+				}
+				if got := readOutputFile(t, name); got != tt.wantRotated[i] {
+					t.Errorf("%v = %q, want %q", name, got, tt.wantRotated[i])
+				}
+			}
+		})
+	}
+}
+
+func TestFileOutputPerBlob(t *testing.T) {
+	dir := t.TempDir()
+	output, err := newFileOutputWrapper(fileOutputConfig{
+		PathTemplate: filepath.Join(dir, "{contentId}.jsonl"),
+		Compression:  "gzip",
+		PerBlob:      true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a previous run left part of the blob behind, it is written again in full
+	if err := ioutil.WriteFile(filepath.Join(dir, "blob1.jsonl"), []byte("stale\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	tracker := &Tracker{hashSet: hashmap.HashMap{}}
+	blobs := map[string]*blobDelivery{"blob1": tracker.track("blob1"), "blob2": tracker.track("blob2")}
+	for i, line := range []string{"a", "b", "c"} {
+		for contentId, blob := range blobs {
+			blob.add()
+			if err := output.write(auditRecord{contentId: contentId, blob: blob}, []byte(line), blob.done); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if i == 1 {
+			// the fetch of blob1 is over, blob2 stays open
+			blobs["blob1"].done(nil)
+			delete(blobs, "blob1")
+		}
+	}
+	if err := output.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readOutputFile(t, filepath.Join(dir, "blob1.jsonl.gz")); got != "a\nb\n" {
+		t.Errorf("blob1 = %q, want its two records", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "blob1.jsonl")); !os.IsNotExist(err) {
+		t.Errorf("the uncompressed file of the complete blob is left: %v", err)
+	}
+	if got := readOutputFile(t, filepath.Join(dir, "blob2.jsonl")); got != "a\nb\nc\n" {
+		t.Errorf("blob2 = %q, want its three records", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "blob2.jsonl.gz")); !os.IsNotExist(err) {
+		t.Errorf("the incomplete blob was compressed: %v", err)
+	}
+}
+
+func TestFileOutputLeavesSharedLineAlone(t *testing.T) {
+	dir := t.TempDir()
+	// the line has spare capacity, as the lines the router hands to every sink
+	line := make([]byte, 0, 64)
+	line = append(line, `{"Id":"1"}`...)
+	var wg sync.WaitGroup
+	for _, name := range []string{"one", "two"} {
+		output, err := newFileOutputWrapper(fileOutputConfig{PathTemplate: filepath.Join(dir, name+".jsonl")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func(output *fileOutputWrapper) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if err := output.write(auditRecord{}, line, func(error) {}); err != nil {
+					t.Error(err)
+				}
+			}
+			if err := output.close(); err != nil {
+				t.Error(err)
+			}
+		}(output)
+	}
+	wg.Wait()
+	if string(line[:cap(line)][len(line)]) == "\n" {
+		t.Error("the newline was written into the shared line")
+	}
+}
+
+func TestFileOutputResolvesRecordsOnceSynced(t *testing.T) {
+	dir := t.TempDir()
+	output, err := newFileOutputWrapper(fileOutputConfig{PathTemplate: filepath.Join(dir, "{contentType}.jsonl")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lock sync.Mutex
+	results := map[string][]error{}
+	write := func(contentType string) {
+		err := output.write(auditRecord{contentType: contentType}, []byte(`{"Id":"1"}`), func(err error) {
+			lock.Lock()
+			results[contentType] = append(results[contentType], err)
+			lock.Unlock()
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("Audit.General")
+	write("Audit.Exchange")
+	lock.Lock()
+	if len(results) != 0 {
+		t.Errorf("records resolved before their files were synced: %v", results)
+	}
+	lock.Unlock()
+
+	// the sync of the Exchange file fails, its record has to be fetched again
+	output.writeLock.Lock()
+	_ = output.files[filepath.Join(dir, "Audit.Exchange.jsonl")].handle.Close()
+	output.writeLock.Unlock()
+	if err := output.flush(); err == nil {
+		t.Error("flush did not report the failed sync")
+	}
+	lock.Lock()
+	if errs := results["Audit.General"]; len(errs) != 1 || errs[0] != nil {
+		t.Errorf("Audit.General resolved with %v, want one success", errs)
+	}
+	if errs := results["Audit.Exchange"]; len(errs) != 1 || errs[0] == nil {
+		t.Errorf("Audit.Exchange resolved with %v, want one failure", errs)
+	}
+	lock.Unlock()
+
+	// a record still pending when the file closes is resolved by the close
+	write("Audit.General")
+	if err := output.close(); err != nil {
+		t.Fatal(err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if errs := results["Audit.General"]; len(errs) != 2 || errs[1] != nil {
+		t.Errorf("Audit.General resolved with %v, want two successes", errs)
+	}
+}
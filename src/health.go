@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"github.com/heptiolabs/healthcheck"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// readinessState is what the readiness checks look at. It outlives the runs, each run reports to it.
+type readinessState struct {
+	lock    sync.Mutex
+	started time.Time
+	// tokenErr is the error of the last token refresh, nil once one succeeds again
+	tokenErr error
+	listed   map[string]time.Time
+	// sinkFailures holds the failures of a sink since its last delivery, a delivery by the sink removes them
+	sinkFailures map[string]sinkFailures
+}
+
+// sinkFailures are when a sink started failing and when it failed last
+type sinkFailures struct {
+	since time.Time
+	last  time.Time
+}
+
+var readiness = newReadinessState()
+
+func newReadinessState() *readinessState {
+	return &readinessState{
+		started:      time.Now(),
+		listed:       map[string]time.Time{},
+		sinkFailures: map[string]sinkFailures{},
+	}
+}
+
+func (r *readinessState) tokenRefreshed(err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.tokenErr = err
+}
+
+func (r *readinessState) contentListed(contentType string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.listed[contentType] = time.Now()
+}
+
+func (r *readinessState) sinkResolved(name string, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err == nil {
+		delete(r.sinkFailures, name)
+		return
+	}
+	now := time.Now()
+	failures, failing := r.sinkFailures[name]
+	if !failing {
+		failures.since = now
+	}
+	failures.last = now
+	r.sinkFailures[name] = failures
+}
+
+// tokenCheck fails while the last token refresh failed
+func (r *readinessState) tokenCheck() healthcheck.Check {
+	return func() error {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		if r.tokenErr != nil {
+			return fmt.Errorf("token refresh failed: %w", r.tokenErr)
+		}
+		return nil
+	}
+}
+
+// listCheck fails when a content type was not listed successfully for maxAge, counted from the start before the
+// first list
+func (r *readinessState) listCheck(contentTypes []string, maxAge time.Duration) healthcheck.Check {
+	return func() error {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		var stale []string
+		for _, contentType := range contentTypes {
+			last, ok := r.listed[contentType]
+			if !ok {
+				last = r.started
+			}
+			if time.Since(last) > maxAge {
+				stale = append(stale, contentType)
+			}
+		}
+		if len(stale) > 0 {
+			return fmt.Errorf("not listed successfully for %v: %v", maxAge, strings.Join(stale, ", "))
+		}
+		return nil
+	}
+}
+
+// sinkCheck fails when a sink delivered nothing but failures for window and failed within the last window, a sink
+// that got no records since it failed is not reported
+func (r *readinessState) sinkCheck(window time.Duration) healthcheck.Check {
+	return func() error {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		var failing []string
+		for name, failures := range r.sinkFailures {
+			if time.Since(failures.since) > window && time.Since(failures.last) <= window {
+				failing = append(failing, name)
+			}
+		}
+		if len(failing) > 0 {
+			sort.Strings(failing)
+			return fmt.Errorf("failing for %v: %v", window, strings.Join(failing, ", "))
+		}
+		return nil
+	}
+}
+
+// lagCheck fails while the p95 ingestion lag is over the SLO threshold
+func lagCheck(lag *lagTracker) healthcheck.Check {
+	return func() error {
+		return lag.degradedErr()
+	}
+}
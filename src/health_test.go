@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenCheck(t *testing.T) {
+	r := newReadinessState()
+	check := r.tokenCheck()
+	if err := check(); err != nil {
+		t.Errorf("failing before the first refresh: %v", err)
+	}
+	r.tokenRefreshed(errors.New("invalid client secret"))
+	if err := check(); err == nil || !strings.Contains(err.Error(), "invalid client secret") {
+		t.Errorf("err = %v, want the refresh error", err)
+	}
+	r.tokenRefreshed(nil)
+	if err := check(); err != nil {
+		t.Errorf("still failing after a successful refresh: %v", err)
+	}
+}
+
+func TestListCheck(t *testing.T) {
+	r := newReadinessState()
+	check := r.listCheck([]string{"Audit.General", "Audit.Exchange"}, time.Hour)
+	if err := check(); err != nil {
+		t.Errorf("failing within maxAge of the start: %v", err)
+	}
+	r.started = time.Now().Add(-2 * time.Hour)
+	r.contentListed("Audit.General")
+	if err := check(); err == nil || err.Error() != "not listed successfully for 1h0m0s: Audit.Exchange" {
+		t.Errorf("err = %v, want Audit.Exchange reported", err)
+	}
+	r.listed["Audit.General"] = time.Now().Add(-90 * time.Minute)
+	r.contentListed("Audit.Exchange")
+	if err := check(); err == nil || err.Error() != "not listed successfully for 1h0m0s: Audit.General" {
+		t.Errorf("err = %v, want the stale Audit.General reported", err)
+	}
+	r.contentListed("Audit.General")
+	if err := check(); err != nil {
+		t.Errorf("failing with every content type listed: %v", err)
+	}
+}
+
+func TestSinkCheck(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		failures sinkFailures
+		wantErr  bool
+	}{
+		{name: "failing for less than the window", failures: sinkFailures{since: now.Add(-time.Minute), last: now}},
+		{name: "failing continuously", failures: sinkFailures{since: now.Add(-time.Hour), last: now.Add(-time.Minute)}, wantErr: true},
+		{name: "idle since it failed", failures: sinkFailures{since: now.Add(-time.Hour), last: now.Add(-45 * time.Minute)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newReadinessState()
+			r.sinkFailures["loki"] = tt.failures
+			err := r.sinkCheck(30 * time.Minute)()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want an error: %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	r := newReadinessState()
+	check := r.sinkCheck(30 * time.Minute)
+	r.sinkResolved("loki", errors.New("connection refused"))
+	r.sinkResolved("kafka", errors.New("broker down"))
+	for _, name := range []string{"loki", "kafka"} {
+		failures := r.sinkFailures[name]
+		failures.since = failures.since.Add(-time.Hour)
+		r.sinkFailures[name] = failures
+	}
+	// a later failure keeps when the sink started failing
+	r.sinkResolved("loki", errors.New("connection refused"))
+	if err := check(); err == nil || err.Error() != "failing for 30m0s: kafka, loki" {
+		t.Errorf("err = %v, want both sinks reported", err)
+	}
+	r.sinkResolved("kafka", nil)
+	if err := check(); err == nil || err.Error() != "failing for 30m0s: loki" {
+		t.Errorf("err = %v, want only loki reported after kafka delivered", err)
+	}
+}
+
+func TestLagCheck(t *testing.T) {
+	l := newTestLagTracker(t, time.Minute)
+	now := time.Now()
+	check := lagCheck(l)
+	l.observe(auditRecord{contentType: "Audit.General", contentCreated: now}, "loki", now)
+	l.evaluate(now)
+	if err := check(); err != nil {
+		t.Errorf("failing without lag: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		l.observe(auditRecord{contentType: "Audit.General", contentCreated: now.Add(-10 * time.Minute)}, "loki", now)
+	}
+	l.evaluate(now)
+	if err := check(); err == nil {
+		t.Error("not failing with the p95 lag over the threshold")
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"github.com/xdg-go/scram"
+	"o365logexporter/promtail-client/promtail"
+	"strings"
+	"sync"
+	"time"
+)
+
+type kafkaConfig struct {
+	Brokers []string
+	// TopicTemplate may contain {tenant} and {contentType}, e.g. "o365.{contentType}"
+	TopicTemplate string
+	// KeyField is the record field used as message key, records of the same key land on the same partition
+	KeyField string
+	TenantId string
+	TLS      *tls.Config
+	// SASLMechanism is PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512, empty disables SASL
+	SASLMechanism string
+	SASLUsername  string
+	SASLPassword  string
+	MaxRetries    int
+}
+
+// kafkaOutput produces records with an idempotent producer, every record is resolved from its delivery report
+type kafkaOutput struct {
+	config   kafkaConfig
+	producer sarama.AsyncProducer
+	// inflight counts the messages without delivery report
+	inflight  sync.WaitGroup
+	reporters sync.WaitGroup
+	closeOnce sync.Once
+}
+
+func newKafkaOutput(config kafkaConfig) (*kafkaOutput, error) {
+	saramaConfig, err := config.saramaConfig()
+	if err != nil {
+		return nil, err
+	}
+	producer, err := sarama.NewAsyncProducer(config.Brokers, saramaConfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create kafka producer: %w", err)
+	}
+	return startKafkaOutput(config, producer), nil
+}
+
+// startKafkaOutput starts resolving records from the delivery reports of producer
+func startKafkaOutput(config kafkaConfig, producer sarama.AsyncProducer) *kafkaOutput {
+	k := &kafkaOutput{config: config, producer: producer}
+	k.reporters.Add(2)
+	go k.successes()
+	go k.errors()
+	return k
+}
+
+func (c kafkaConfig) saramaConfig() (*sarama.Config, error) {
+	conf := sarama.NewConfig()
+	conf.ClientID = "o365LogExporter"
+	// idempotent production needs Kafka 0.11, acks from all replicas and a single in-flight request per broker
+	conf.Version = sarama.V2_1_0_0
+	conf.Producer.Idempotent = true
+	conf.Producer.RequiredAcks = sarama.WaitForAll
+	conf.Net.MaxOpenRequests = 1
+	conf.Producer.Retry.Max = outputMaxRetries
+	if c.MaxRetries > 0 {
+		conf.Producer.Retry.Max = c.MaxRetries
+	}
+	conf.Producer.Retry.Backoff = outputMinBackoff
+	conf.Producer.Compression = sarama.CompressionSnappy
+	conf.Producer.Flush.Frequency = 500 * time.Millisecond
+	conf.Producer.Return.Successes = true
+	conf.Producer.Return.Errors = true
+
+	if c.TLS != nil {
+		conf.Net.TLS.Enable = true
+		conf.Net.TLS.Config = c.TLS
+	}
+	switch c.SASLMechanism {
+	case "":
+	case sarama.SASLTypePlaintext:
+		conf.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+	case sarama.SASLTypeSCRAMSHA256:
+		conf.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+		conf.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient { return &scramClient{hashGenerator: scram.HashGeneratorFcn(sha256.New)} }
+	case sarama.SASLTypeSCRAMSHA512:
+		conf.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+		conf.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient { return &scramClient{hashGenerator: scram.HashGeneratorFcn(sha512.New)} }
+	default:
+		return nil, fmt.Errorf("unknown SASL mechanism %q, expected PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512", c.SASLMechanism)
+	}
+	if c.SASLMechanism != "" {
+		conf.Net.SASL.Enable = true
+		conf.Net.SASL.User = c.SASLUsername
+		conf.Net.SASL.Password = c.SASLPassword
+	}
+	return conf, conf.Validate()
+}
+
+// topic fills in the topic template for a record
+func (k *kafkaOutput) topic(record auditRecord) string {
+	return strings.NewReplacer("{tenant}", k.config.TenantId, "{contentType}", record.contentType).Replace(k.config.TopicTemplate)
+}
+
+// write hands the record to the producer, blocking while it is saturated. done is called from the delivery report.
+func (k *kafkaOutput) write(ctx context.Context, record auditRecord, line []byte, done func(error)) error {
+	message := &sarama.ProducerMessage{
+		Topic: k.topic(record),
+		Value: sarama.ByteEncoder(line),
+		Headers: []sarama.RecordHeader{
+			{Key: []byte("tenant"), Value: []byte(k.config.TenantId)},
+			{Key: []byte("contentType"), Value: []byte(record.contentType)},
+			{Key: []byte("contentId"), Value: []byte(record.contentId)},
+		},
+		Metadata: done,
+	}
+	if key := recordField(record.content, k.config.KeyField); key != "" {
+		message.Key = sarama.StringEncoder(key)
+	}
+	k.inflight.Add(1)
+	select {
+	case k.producer.Input() <- message:
+		return nil
+	case <-ctx.Done():
+		k.inflight.Done()
+		return ctx.Err()
+	}
+}
+
+func (k *kafkaOutput) successes() {
+	defer k.reporters.Done()
+	for message := range k.producer.Successes() {
+		k.report(message, nil)
+	}
+}
+
+func (k *kafkaOutput) errors() {
+	defer k.reporters.Done()
+	for producerErr := range k.producer.Errors() {
+		sinkLog("kafka").Errorf("unable to produce to %v: %v", producerErr.Msg.Topic, producerErr.Err)
+		k.report(producerErr.Msg, producerErr.Err)
+	}
+}
+
+func (k *kafkaOutput) report(message *sarama.ProducerMessage, err error) {
+	if done, ok := message.Metadata.(func(error)); ok && done != nil {
+		done(err)
+	}
+	k.inflight.Done()
+}
+
+// flush waits for the delivery report of every message produced so far
+func (k *kafkaOutput) flush(ctx context.Context) error {
+	return promtail.WaitGroupContext(ctx, &k.inflight)
+}
+
+// close flushes the producer and waits for the remaining delivery reports
+func (k *kafkaOutput) close(ctx context.Context) error {
+	k.closeOnce.Do(k.producer.AsyncClose)
+	return promtail.WaitGroupContext(ctx, &k.reporters)
+}
+
+// scramClient implements sarama.SCRAMClient on top of xdg-go/scram
+type scramClient struct {
+	hashGenerator scram.HashGeneratorFcn
+	conversation  *scram.ClientConversation
+}
+
+func (s *scramClient) Begin(userName, password, authzID string) error {
+	client, err := s.hashGenerator.NewClient(userName, password, authzID)
+	if err != nil {
+		return err
+	}
+	s.conversation = client.NewConversation()
+	return nil
+}
+
+func (s *scramClient) Step(challenge string) (string, error) {
+	return s.conversation.Step(challenge)
+}
+
+func (s *scramClient) Done() bool {
+	return s.conversation.Done()
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"reflect"
+	"testing"
+)
+
+// newMockKafkaOutput returns a kafka output producing to a mock producer configured like the real one
+func newMockKafkaOutput(t *testing.T, config kafkaConfig) (*kafkaOutput, *mocks.AsyncProducer) {
+	t.Helper()
+	saramaConfig, err := config.saramaConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	producer := mocks.NewAsyncProducer(t, saramaConfig)
+	return startKafkaOutput(config, producer), producer
+}
+
+// writeKafka writes the record and returns the channel its delivery report arrives on
+func writeKafka(t *testing.T, output *kafkaOutput, record auditRecord, line string) chan error {
+	t.Helper()
+	result := make(chan error, 1)
+	if err := output.write(context.Background(), record, []byte(line), func(err error) { result <- err }); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestKafkaMessageMapping(t *testing.T) {
+	tests := []struct {
+		name      string
+		keyField  string
+		content   map[string]interface{}
+		wantTopic string
+		wantKey   sarama.Encoder
+	}{
+		{
+			name:      "string key",
+			keyField:  "UserId",
+			content:   map[string]interface{}{"UserId": "user@contoso.com"},
+			wantTopic: "o365.tenant1.Audit.Exchange",
+			wantKey:   sarama.StringEncoder("user@contoso.com"),
+		},
+		{
+			name:      "number key",
+			keyField:  "RecordType",
+			content:   map[string]interface{}{"RecordType": float64(2)},
+			wantTopic: "o365.tenant1.Audit.Exchange",
+			wantKey:   sarama.StringEncoder("2"),
+		},
+		{
+			name:      "missing key field",
+			keyField:  "UserId",
+			content:   map[string]interface{}{},
+			wantTopic: "o365.tenant1.Audit.Exchange",
+		},
+		{
+			name:      "no key field",
+			content:   map[string]interface{}{"UserId": "user@contoso.com"},
+			wantTopic: "o365.tenant1.Audit.Exchange",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output, producer := newMockKafkaOutput(t, kafkaConfig{TopicTemplate: "o365.{tenant}.{contentType}", KeyField: tt.keyField, TenantId: "tenant1"})
+			producer.ExpectInputWithMessageCheckerFunctionAndSucceed(func(message *sarama.ProducerMessage) error {
+				if message.Topic != tt.wantTopic {
+					return fmt.Errorf("topic = %v, want %v", message.Topic, tt.wantTopic)
+				}
+				if !reflect.DeepEqual(message.Key, tt.wantKey) {
+					return fmt.Errorf("key = %#v, want %#v", message.Key, tt.wantKey)
+				}
+				if value, _ := message.Value.Encode(); string(value) != `{"Id":"1"}` {
+					return fmt.Errorf("value = %s, want the line", value)
+				}
+				headers := map[string]string{}
+				for _, header := range message.Headers {
+					headers[string(header.Key)] = string(header.Value)
+				}
+				wantHeaders := map[string]string{"tenant": "tenant1", "contentType": "Audit.Exchange", "contentId": "blob1"}
+				if !reflect.DeepEqual(headers, wantHeaders) {
+					return fmt.Errorf("headers = %v, want %v", headers, wantHeaders)
+				}
+				return nil
+			})
+			result := writeKafka(t, output, auditRecord{content: tt.content, contentType: "Audit.Exchange", contentId: "blob1"}, `{"Id":"1"}`)
+			if err := output.close(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-result; err != nil {
+				t.Errorf("delivery err = %v", err)
+			}
+		})
+	}
+}
+
+func TestKafkaDeliveryReports(t *testing.T) {
+	output, producer := newMockKafkaOutput(t, kafkaConfig{TopicTemplate: "o365"})
+	producer.ExpectInputAndSucceed()
+	producer.ExpectInputAndFail(sarama.ErrNotEnoughReplicas)
+	producer.ExpectInputAndSucceed()
+	var results []chan error
+	for i := 0; i < 3; i++ {
+		results = append(results, writeKafka(t, output, auditRecord{contentType: "Audit.General"}, fmt.Sprintf(`{"Id":"%d"}`, i)))
+	}
+	// flush returns once every message got its report
+	if err := output.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for i, result := range results {
+		select {
+		case err := <-result:
+			if i == 1 && !errors.Is(err, sarama.ErrNotEnoughReplicas) {
+				t.Errorf("failed send: err = %v, want %v", err, sarama.ErrNotEnoughReplicas)
+			}
+			if i != 1 && err != nil {
+				t.Errorf("record %d: err = %v", i, err)
+			}
+		default:
+			t.Errorf("flush returned before the report of record %d", i)
+		}
+	}
+	if err := output.close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newKafkaBroker starts an in-process broker leading partition 0 of topic, answering the version 3 produce requests
+// of the configured protocol version with kerror
+func newKafkaBroker(t *testing.T, topic string, kerror sarama.KError) *sarama.MockBroker {
+	t.Helper()
+	broker := sarama.NewMockBroker(t, 1)
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetController(broker.BrokerID()).
+			SetLeader(topic, 0, broker.BrokerID()),
+		"InitProducerIDRequest": sarama.NewMockWrapper(&sarama.InitProducerIDResponse{ProducerID: 1000, ProducerEpoch: 1}),
+		"ProduceRequest":        sarama.NewMockProduceResponse(t).SetVersion(3).SetError(topic, 0, kerror),
+	})
+	t.Cleanup(broker.Close)
+	return broker
+}
+
+func TestKafkaDeliveryReportsFromBroker(t *testing.T) {
+	tests := []struct {
+		name    string
+		kerror  sarama.KError
+		wantErr error
+	}{
+		{name: "acknowledged", kerror: sarama.ErrNoError},
+		{name: "rejected", kerror: sarama.ErrMessageSizeTooLarge, wantErr: sarama.ErrMessageSizeTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := newKafkaBroker(t, "o365.Audit.General", tt.kerror)
+			output, err := newKafkaOutput(kafkaConfig{Brokers: []string{broker.Addr()}, TopicTemplate: "o365.{contentType}", MaxRetries: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var results []chan error
+			for i := 0; i < 3; i++ {
+				results = append(results, writeKafka(t, output, auditRecord{contentType: "Audit.General"}, fmt.Sprintf(`{"Id":"%d"}`, i)))
+			}
+			if err := output.flush(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			for i, result := range results {
+				select {
+				case err := <-result:
+					if !errors.Is(err, tt.wantErr) {
+						t.Errorf("record %d: err = %v, want %v", i, err, tt.wantErr)
+					}
+				default:
+					t.Errorf("flush returned before the report of record %d", i)
+				}
+			}
+			if err := output.close(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			// the producer is idempotent and waits for every replica
+			initialized, produced := false, 0
+			for _, exchange := range broker.History() {
+				switch request := exchange.Request.(type) {
+				case *sarama.InitProducerIDRequest:
+					initialized = true
+				case *sarama.ProduceRequest:
+					produced++
+					if request.RequiredAcks != sarama.WaitForAll {
+						t.Errorf("produced with acks %v, want all replicas", request.RequiredAcks)
+					}
+				}
+			}
+			if !initialized || produced == 0 {
+				t.Errorf("broker saw producer id request %v and %d produce requests, want both", initialized, produced)
+			}
+		})
+	}
+}
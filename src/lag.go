@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"math"
+	"math/rand"
+	"o365logexporter/promtail-client/promtail"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the points the ingestion lag is measured from: when Microsoft made the content blob available, and when the
+// audited event happened. The gap between the two is Microsoft's delay, the rest is ours.
+const (
+	lagFromContentCreated = "content_created"
+	lagFromCreationTime   = "creation_time"
+)
+
+const (
+	// the SLO window is cut in lagSlices slices keeping up to lagSliceSamples samples each, a busy slice keeps a
+	// random subset weighted by the records it saw, so the p95 covers the whole window with bounded memory
+	lagSlices           = 60
+	lagSliceSamples     = 200
+	lagEvaluateInterval = 30 * time.Second
+)
+
+var (
+	ingestionLagHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "o365_exporter",
+		Name:      "ingestion_lag_seconds",
+		Help:      "Time from the content blob creation or the record CreationTime to the delivery of the record by a sink.",
+		// 30s to about 68h
+		Buckets: prometheus.ExponentialBuckets(30, 2, 14),
+	}, []string{"content_type", "from", "sink"})
+	ingestionLagLastGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "o365_exporter",
+		Name:      "ingestion_lag_last_seconds",
+		Help:      "Ingestion lag of the last delivered record.",
+	}, []string{"content_type", "from"})
+	ingestionLagP95Gauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "o365_exporter",
+		Name:      "ingestion_lag_p95_seconds",
+		Help:      "95th percentile of the ingestion lag over the SLO window.",
+	}, []string{"content_type", "from", "sink"})
+	lagSLODegradedGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "o365_exporter",
+		Name:      "lag_slo_degraded",
+		Help:      "1 while the p95 ingestion lag of a content type is over the SLO threshold.",
+	})
+)
+
+// lagKey is what a p95 is computed for. Every sink delivers every record, the sink keeps them from being counted
+// once per sink.
+type lagKey struct {
+	contentType string
+	from        string
+	sink        string
+}
+
+// lagSlice holds the samples of a slice of the window, seen counts the records of the slice
+type lagSlice struct {
+	start   time.Time
+	seen    int
+	samples []float64
+}
+
+// lagTracker keeps the lag samples of the SLO window to compute the p95 per content type, lag source and sink
+type lagTracker struct {
+	lock    sync.Mutex
+	samples map[lagKey][]*lagSlice
+
+	window time.Duration
+	// sloFrom is the lag source the threshold applies to, a zero threshold disables the SLO
+	sloFrom      string
+	sloThreshold time.Duration
+	// over describes what is over the threshold while degraded
+	over []string
+}
+
+var ingestionLag = &lagTracker{samples: map[lagKey][]*lagSlice{}, window: time.Hour, sloFrom: lagFromContentCreated}
+
+// configure sets the SLO, from is the lag source it applies to
+func (l *lagTracker) configure(window time.Duration, from string, threshold time.Duration) error {
+	if from != lagFromContentCreated && from != lagFromCreationTime {
+		return fmt.Errorf("unknown lag source %q, expected %v or %v", from, lagFromContentCreated, lagFromCreationTime)
+	}
+	if window <= 0 {
+		return fmt.Errorf("the lag SLO window must be positive")
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.window = window
+	l.sloFrom = from
+	l.sloThreshold = threshold
+	return nil
+}
+
+// observe records the lag of a record delivered by sink. Records without contentCreated were not listed in this
+// process, they are replayed dead letters whose lag says nothing about the pipeline.
+func (l *lagTracker) observe(record auditRecord, sink string, delivered time.Time) {
+	if record.contentCreated.IsZero() {
+		return
+	}
+	l.add(record.contentType, lagFromContentCreated, sink, delivered.Sub(record.contentCreated), delivered)
+	if value := recordField(record.content, "CreationTime"); value != "" {
+		if ts, err := promtail.ParseTimestamp(value); err == nil {
+			l.add(record.contentType, lagFromCreationTime, sink, delivered.Sub(ts), delivered)
+		}
+	}
+}
+
+func (l *lagTracker) add(contentType, from, sink string, lag time.Duration, at time.Time) {
+	seconds := lag.Seconds()
+	ingestionLagHistogram.WithLabelValues(contentType, from, sink).Observe(seconds)
+	ingestionLagLastGauge.WithLabelValues(contentType, from).Set(seconds)
+	key := lagKey{contentType: contentType, from: from, sink: sink}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	slices := l.samples[key]
+	if len(slices) == 0 || at.Sub(slices[len(slices)-1].start) >= l.window/lagSlices {
+		slices = append(slices, &lagSlice{start: at})
+		l.samples[key] = slices
+	}
+	slice := slices[len(slices)-1]
+	slice.seen++
+	if len(slice.samples) < lagSliceSamples {
+		slice.samples = append(slice.samples, seconds)
+	} else if i := rand.Intn(slice.seen); i < lagSliceSamples {
+		slice.samples[i] = seconds
+	}
+}
+
+// run evaluates the SLO every lagEvaluateInterval
+func (l *lagTracker) run() {
+	ticker := time.NewTicker(lagEvaluateInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		l.evaluate(now)
+	}
+}
+
+// evaluate drops the slices past the window, updates the p95 gauges and the degraded state. The oldest slice is
+// kept until it ends outside the window, the p95 covers up to a slice more than the window.
+func (l *lagTracker) evaluate(now time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	var over []string
+	for key, slices := range l.samples {
+		sliceLength := l.window / lagSlices
+		expired := sort.Search(len(slices), func(i int) bool { return now.Sub(slices[i].start) < l.window+sliceLength })
+		slices = slices[expired:]
+		if len(slices) == 0 {
+			delete(l.samples, key)
+			ingestionLagP95Gauge.DeleteLabelValues(key.contentType, key.from, key.sink)
+			continue
+		}
+		l.samples[key] = slices
+		p95 := lagPercentile(slices, 0.95)
+		ingestionLagP95Gauge.WithLabelValues(key.contentType, key.from, key.sink).Set(p95)
+		if l.sloThreshold > 0 && key.from == l.sloFrom && p95 > l.sloThreshold.Seconds() {
+			over = append(over, fmt.Sprintf("%v to %v (%v)", key.contentType, key.sink, time.Duration(p95*float64(time.Second)).Round(time.Second)))
+		}
+	}
+	sort.Strings(over)
+	if degraded := len(over) > 0; degraded != (len(l.over) > 0) {
+		if degraded {
+			stageLog(stageDeliver).Warnf("degraded: p95 ingestion lag from %v over %v for %v", l.sloFrom, l.sloThreshold, strings.Join(over, ", "))
+		} else {
+			stageLog(stageDeliver).Infof("p95 ingestion lag from %v back under %v", l.sloFrom, l.sloThreshold)
+		}
+	}
+	l.over = over
+	if len(over) > 0 {
+		lagSLODegradedGauge.Set(1)
+	} else {
+		lagSLODegradedGauge.Set(0)
+	}
+}
+
+// degradedErr describes what is over the SLO threshold, nil while the lag is under it
+func (l *lagTracker) degradedErr() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if len(l.over) == 0 {
+		return nil
+	}
+	return fmt.Errorf("p95 ingestion lag from %v over %v for %v", l.sloFrom, l.sloThreshold, strings.Join(l.over, ", "))
+}
+
+type weightedLag struct {
+	lag    float64
+	weight float64
+}
+
+// lagPercentile returns the nearest rank percentile of the slice samples, each weighing for the records of its slice
+// it stands for
+func lagPercentile(slices []*lagSlice, percentile float64) float64 {
+	var lags []weightedLag
+	total := 0.0
+	for _, slice := range slices {
+		weight := float64(slice.seen) / float64(len(slice.samples))
+		for _, lag := range slice.samples {
+			lags = append(lags, weightedLag{lag: lag, weight: weight})
+		}
+		total += float64(slice.seen)
+	}
+	sort.Slice(lags, func(i, j int) bool { return lags[i].lag < lags[j].lag })
+	rank := math.Ceil(percentile * total)
+	cumulated := 0.0
+	for _, lag := range lags {
+		cumulated += lag.weight
+		// the weights are fractions, the rounding is not to miss the last one
+		if cumulated >= rank-1e-9 {
+			return lag.lag
+		}
+	}
+	return lags[len(lags)-1].lag
+}
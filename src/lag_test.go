@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestLagTracker(t *testing.T, threshold time.Duration) *lagTracker {
+	t.Helper()
+	l := &lagTracker{samples: map[lagKey][]*lagSlice{}}
+	if err := l.configure(time.Hour, lagFromContentCreated, threshold); err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestLagP95CoversTheWindow(t *testing.T) {
+	l := newTestLagTracker(t, 10*time.Minute)
+	start := time.Now()
+	// a late first half hour followed by a busier on time one, the late records are still 40% of the window
+	for i := 0; i < 40000; i++ {
+		l.add("Audit.General", lagFromContentCreated, "loki", 20*time.Minute, start.Add(time.Duration(i)*30*time.Minute/40000))
+	}
+	for i := 0; i < 60000; i++ {
+		l.add("Audit.General", lagFromContentCreated, "loki", 10*time.Second, start.Add(30*time.Minute+time.Duration(i)*30*time.Minute/60000))
+	}
+	now := start.Add(time.Hour)
+	l.evaluate(now)
+	if got := lagPercentile(l.samples[lagKey{"Audit.General", lagFromContentCreated, "loki"}], 0.95); got != (20 * time.Minute).Seconds() {
+		t.Errorf("p95 = %vs, want the lag of the first half hour", got)
+	}
+	if l.degradedErr() == nil {
+		t.Error("not degraded with the p95 over the threshold")
+	}
+
+	// once the late half hour left the window, only the on time records are left
+	l.evaluate(now.Add(31 * time.Minute))
+	if got := lagPercentile(l.samples[lagKey{"Audit.General", lagFromContentCreated, "loki"}], 0.95); got != 10 {
+		t.Errorf("p95 = %vs, want 10s", got)
+	}
+	if err := l.degradedErr(); err != nil {
+		t.Errorf("still degraded: %v", err)
+	}
+}
+
+func TestLagIsKeptPerSink(t *testing.T) {
+	l := newTestLagTracker(t, time.Minute)
+	now := time.Now()
+	record := auditRecord{contentType: "Audit.Exchange", contentCreated: now.Add(-2 * time.Minute)}
+	// a slow sink delivers the records two minutes late, a fast one right away
+	for i := 0; i < 100; i++ {
+		l.observe(record, "slow", now)
+		l.observe(auditRecord{contentType: "Audit.Exchange", contentCreated: now}, "fast", now)
+	}
+	l.evaluate(now)
+	for sink, want := range map[string]float64{"slow": 120, "fast": 0} {
+		slices := l.samples[lagKey{"Audit.Exchange", lagFromContentCreated, sink}]
+		if len(slices) != 1 || slices[0].seen != 100 {
+			t.Fatalf("%v: samples %v, want 100 in one slice", sink, slices)
+		}
+		if got := lagPercentile(slices, 0.95); got != want {
+			t.Errorf("%v: p95 = %vs, want %vs", sink, got, want)
+		}
+	}
+	err := l.degradedErr()
+	if err == nil {
+		t.Fatal("not degraded by the slow sink")
+	}
+	if want := "p95 ingestion lag from content_created over 1m0s for Audit.Exchange to slow (2m0s)"; err.Error() != want {
+		t.Errorf("err = %q, want %q", err, want)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// the fields set on the log lines, consistently named so that they can be filtered on
+const (
+	logFieldTenant      = "tenant"
+	logFieldContentType = "contentType"
+	logFieldContentId   = "contentId"
+	logFieldStage       = "stage"
+	logFieldSink        = "sink"
+)
+
+// the stages of the pipeline a log line is about
+const (
+	stageConfig  = "config"
+	stageRun     = "run"
+	stageList    = "list"
+	stageFetch   = "fetch"
+	stageProcess = "process"
+	stageRoute   = "route"
+	stageDeliver = "deliver"
+	stageArchive = "archive"
+	stageHistory = "history"
+	stageDLQ     = "dlq"
+	stageHealth  = "health"
+)
+
+// secretFlagPattern matches the names of the flags holding credentials, their values are never logged
+var secretFlagPattern = regexp.MustCompile(`(?i)secret|password|token|apikey|accesskey|dsn|headers`)
+
+// logger is the operational log. Lines written with the standard log package, by dependencies among others, end up
+// in it at info level.
+var logger = logrus.New()
+
+// configureLogging sets the format and level of logger, --debug forces the debug level
+func configureLogging(context *cli.Context) error {
+	switch format := context.String(logFormatFlag); format {
+	case "logfmt":
+		logger.SetFormatter(&logrus.TextFormatter{DisableColors: true, FullTimestamp: true, TimestampFormat: time.RFC3339Nano})
+	case "json":
+		logger.SetFormatter(&logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano})
+	default:
+		return fmt.Errorf("unknown log format %q, expected logfmt or json", format)
+	}
+	level, err := logrus.ParseLevel(context.String(logLevelFlag))
+	if err != nil {
+		return err
+	}
+	if context.Bool(debugFlag) {
+		level = logrus.DebugLevel
+	}
+	logger.SetLevel(level)
+	// records may be written to stdout, keep operational logs apart
+	logger.SetOutput(os.Stderr)
+	logger.AddHook(tenantHook{})
+	log.SetFlags(0)
+	log.SetOutput(logger.WriterLevel(logrus.InfoLevel))
+	return nil
+}
+
+// tenantHook adds the tenant to every line once it is known
+type tenantHook struct{}
+
+func (tenantHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (tenantHook) Fire(entry *logrus.Entry) error {
+	if _, ok := entry.Data[logFieldTenant]; !ok && TenantID != "" {
+		entry.Data[logFieldTenant] = TenantID
+	}
+	return nil
+}
+
+func stageLog(stage string) *logrus.Entry {
+	return logger.WithField(logFieldStage, stage)
+}
+
+func sinkLog(sink string) *logrus.Entry {
+	return logger.WithFields(logrus.Fields{logFieldStage: stageDeliver, logFieldSink: sink})
+}
+
+func blobLog(contentType, contentId, stage string) *logrus.Entry {
+	return logger.WithFields(logrus.Fields{logFieldStage: stage, logFieldContentType: contentType, logFieldContentId: contentId})
+}
+
+func recordLog(record auditRecord, stage string) *logrus.Entry {
+	return blobLog(record.contentType, record.contentId, stage)
+}
+
+// logFlags logs the value of every set flag at debug level, redacting the credentials whatever name they were set by
+func logFlags(context *cli.Context) {
+	for _, flag := range context.App.Flags {
+		names := flag.Names()
+		if len(names) == 0 || !context.IsSet(names[0]) {
+			continue
+		}
+		entry := stageLog(stageConfig).WithField("flag", names[0])
+		if secretFlagPattern.MatchString(strings.Join(names, " ")) {
+			entry.WithField("value", "<redacted>").Debug("flag set")
+		} else if values := context.StringSlice(names[0]); values != nil {
+			redacted := make([]string, len(values))
+			for i, value := range values {
+				redacted[i] = redactFlagValue(value)
+			}
+			entry.WithField("value", fmt.Sprint(redacted)).Debug("flag set")
+		} else {
+			entry.WithField("value", redactFlagValue(fmt.Sprint(context.Value(names[0])))).Debug("flag set")
+		}
+	}
+}
+
+// redactFlagValue drops the credentials a URL can carry in its userinfo and query, whatever flag it was set by.
+// Values without a scheme, such as listen addresses, are kept as they are.
+func redactFlagValue(value string) string {
+	if !strings.Contains(value, "://") {
+		return value
+	}
+	return redactURL(value)
+}
+
+// logLevelHandler reports the log level, PUT or POST with a level parameter changes it
+func logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		level, err := logrus.ParseLevel(r.FormValue("level"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logger.SetLevel(level)
+		stageLog(stageHealth).Warnf("log level set to %v", level)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_, _ = fmt.Fprintln(w, logger.GetLevel())
+}
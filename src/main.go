@@ -5,15 +5,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/cornelk/hashmap"
+	"github.com/jmespath/go-jmespath"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 	"github.com/urfave/cli/v2/altsrc"
-	"log"
 	"net/http"
 	"net/url"
 	"o365logexporter/promtail-client/promtail"
 	"os"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,15 +24,157 @@ import "github.com/heptiolabs/healthcheck"
 
 const MaxEntriesChanSize = 10000
 
+// MaxConcurrentProcessing bounds the records processed at once, a saturated sink blocks fetching beyond it
+const MaxConcurrentProcessing = 64
+
+// outputShutdownTimeout bounds how long the end of a run waits for the in-flight batches of each output
+const outputShutdownTimeout = time.Minute
+
 const (
 	debugFlag          = "debug"
+	logFormatFlag      = "LogFormat"
+	logLevelFlag       = "LogLevel"
 	loadConfigFileFlag = "load"
 	runAsDaemonFlag    = "daemonize"
 	runIntervalFlag    = "RunInterval"
 	outputFileFlag     = "output_file"
 )
 
-const lokiAddressFlag = "LokiAddress"
+const (
+	outputMaxMBFlag       = "OutputMaxMB"
+	outputMaxAgeFlag      = "OutputMaxAge"
+	outputCompressionFlag = "OutputCompression"
+	outputMaxFilesFlag    = "OutputMaxFiles"
+	outputPerBlobFlag     = "OutputPerBlob"
+	stdoutOutputFlag      = "StdoutOutput"
+	stdoutEnvelopeFlag    = "StdoutEnvelope"
+)
+
+const (
+	syslogAddressFlag            = "SyslogAddress"
+	syslogNetworkFlag            = "SyslogNetwork"
+	syslogFormatFlag             = "SyslogFormat"
+	syslogFacilityFlag           = "SyslogFacility"
+	syslogCAFileFlag             = "SyslogCAFile"
+	syslogInsecureSkipVerifyFlag = "SyslogInsecureSkipVerify"
+)
+
+const (
+	splunkURLFlag                = "SplunkURL"
+	splunkTokenFlag              = "SplunkToken"
+	splunkIndexFlag              = "SplunkIndex"
+	splunkSourcetypesFlag        = "SplunkSourcetypes"
+	splunkAckTimeoutFlag         = "SplunkAckTimeout"
+	splunkCAFileFlag             = "SplunkCAFile"
+	splunkInsecureSkipVerifyFlag = "SplunkInsecureSkipVerify"
+)
+
+const (
+	elasticURLFlag                = "ElasticURL"
+	elasticIndexFlag              = "ElasticIndex"
+	elasticUsernameFlag           = "ElasticUsername"
+	elasticPasswordFlag           = "ElasticPassword"
+	elasticAPIKeyFlag             = "ElasticAPIKey"
+	elasticCAFileFlag             = "ElasticCAFile"
+	elasticInsecureSkipVerifyFlag = "ElasticInsecureSkipVerify"
+	elasticTemplateFlag           = "ElasticTemplate"
+)
+
+const (
+	kafkaBrokersFlag            = "KafkaBrokers"
+	kafkaTopicFlag              = "KafkaTopic"
+	kafkaKeyFieldFlag           = "KafkaKeyField"
+	kafkaSASLMechanismFlag      = "KafkaSASLMechanism"
+	kafkaUsernameFlag           = "KafkaUsername"
+	kafkaPasswordFlag           = "KafkaPassword"
+	kafkaTLSFlag                = "KafkaTLS"
+	kafkaCAFileFlag             = "KafkaCAFile"
+	kafkaInsecureSkipVerifyFlag = "KafkaInsecureSkipVerify"
+)
+
+const (
+	otlpEndpointFlag           = "OtlpEndpoint"
+	otlpProtocolFlag           = "OtlpProtocol"
+	otlpHeadersFlag            = "OtlpHeaders"
+	otlpCompressionFlag        = "OtlpCompression"
+	otlpCAFileFlag             = "OtlpCAFile"
+	otlpInsecureSkipVerifyFlag = "OtlpInsecureSkipVerify"
+	otlpInsecureFlag           = "OtlpInsecure"
+)
+
+const (
+	webhookURLFlag                = "WebhookURL"
+	webhookMethodFlag             = "WebhookMethod"
+	webhookHeadersFlag            = "WebhookHeaders"
+	webhookTemplateFlag           = "WebhookTemplate"
+	webhookJMESPathFlag           = "WebhookJMESPath"
+	webhookBatchSizeFlag          = "WebhookBatchSize"
+	webhookHMACSecretFlag         = "WebhookHMACSecret"
+	webhookSignatureHeaderFlag    = "WebhookSignatureHeader"
+	webhookCAFileFlag             = "WebhookCAFile"
+	webhookInsecureSkipVerifyFlag = "WebhookInsecureSkipVerify"
+)
+
+const (
+	databaseDriverFlag = "DatabaseDriver"
+	databaseDSNFlag    = "DatabaseDSN"
+	databaseTableFlag  = "DatabaseTable"
+)
+
+const (
+	parquetDirFlag     = "ParquetDir"
+	parquetMaxRowsFlag = "ParquetMaxRows"
+	parquetMaxAgeFlag  = "ParquetMaxAge"
+)
+
+const (
+	sinkFiltersFlag    = "SinkFilters"
+	sinkBufferSizeFlag = "SinkBufferSize"
+	deadLetterDirFlag  = "DeadLetterDir"
+	deadLetterSinkFlag = "DeadLetterSink"
+)
+
+const (
+	s3EndpointFlag    = "S3Endpoint"
+	s3BucketFlag      = "S3Bucket"
+	s3RegionFlag      = "S3Region"
+	s3AccessKeyFlag   = "S3AccessKey"
+	s3SecretKeyFlag   = "S3SecretKey"
+	s3PrefixFlag      = "S3Prefix"
+	s3CompressionFlag = "S3Compression"
+	s3InsecureFlag    = "S3Insecure"
+	s3RequiredFlag    = "S3Required"
+)
+
+const (
+	lokiAddressFlag        = "LokiAddress"
+	lokiMaxRetriesFlag     = "LokiMaxRetries"
+	lokiBufferDirFlag      = "LokiBufferDir"
+	lokiBufferMaxBytesFlag = "LokiBufferMaxMB"
+	lokiBatchMaxKBFlag     = "LokiBatchMaxKB"
+	lokiFormatFlag         = "LokiFormat"
+	lokiGzipFlag           = "LokiGzip"
+	lokiPushWorkersFlag    = "LokiPushWorkers"
+)
+
+const (
+	lokiTenantIdFlag           = "LokiTenantId"
+	lokiUsernameFlag           = "LokiUsername"
+	lokiPasswordFlag           = "LokiPassword"
+	lokiBearerTokenFlag        = "LokiBearerToken"
+	lokiCAFileFlag             = "LokiCAFile"
+	lokiCertFileFlag           = "LokiCertFile"
+	lokiKeyFileFlag            = "LokiKeyFile"
+	lokiServerNameFlag         = "LokiServerName"
+	lokiInsecureSkipVerifyFlag = "LokiInsecureSkipVerify"
+	lokiProxyURLFlag           = "LokiProxyURL"
+)
+
+const (
+	timestampFieldFlag  = "TimestampField"
+	lokiSortEntriesFlag = "LokiSortEntries"
+	lokiMaxEntryAgeFlag = "LokiMaxEntryAge"
+)
 const (
 	clientSecretFlag  = "ClientSecret"
 	tenantIdFlag      = "TenantId"
@@ -38,9 +183,25 @@ const (
 )
 
 const (
-	historyFileFlag = "HistoryFile"
-	jmesLabelsFlag  = "JMESLabels"
-	staticLabelFlag = "StaticLabel"
+	historyFileFlag      = "HistoryFile"
+	jmesLabelsFlag       = "JMESLabels"
+	jmesMetadataFlag     = "JMESMetadata"
+	staticLabelFlag      = "StaticLabel"
+	labelCardinalityFlag = "LabelCardinalityLimit"
+)
+
+const (
+	healthAddressFlag          = "HealthAddress"
+	adminAddressFlag           = "AdminAddress"
+	goroutineThresholdFlag     = "GoroutineThreshold"
+	readyStaleIntervalsFlag    = "ReadyStaleIntervals"
+	readySinkFailureWindowFlag = "ReadySinkFailureWindow"
+)
+
+const (
+	lagSLOThresholdFlag = "LagSLOThreshold"
+	lagSLOWindowFlag    = "LagSLOWindow"
+	lagSLOFromFlag      = "LagSLOFrom"
 )
 
 const (
@@ -61,7 +222,6 @@ var chunkDuration time.Duration
 var chunkCount int
 
 func main() {
-
 	chunkDuration = time.Hour * 2
 	chunkCount = 1
 	flags := []cli.Flag{
@@ -78,6 +238,53 @@ func main() {
 			Value:   "5m",
 			EnvVars: []string{"APP_RUN_INTERVAL"},
 		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    healthAddressFlag,
+			Usage:   "listen address of the health and metrics endpoints in daemon mode",
+			Value:   "0.0.0.0:8090",
+			EnvVars: []string{"APP_HEALTH_ADDRESS"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    adminAddressFlag,
+			Usage:   "listen address of the unauthenticated admin endpoints in daemon mode, keep it on loopback; empty disables them",
+			Value:   "127.0.0.1:8091",
+			EnvVars: []string{"APP_ADMIN_ADDRESS"},
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:    goroutineThresholdFlag,
+			Usage:   "goroutine count above which the daemon reports not live",
+			Value:   10000,
+			EnvVars: []string{"APP_GOROUTINE_THRESHOLD"},
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:    readyStaleIntervalsFlag,
+			Usage:   "run intervals without a successful list of a content type after which the daemon reports not ready",
+			Value:   3,
+			EnvVars: []string{"APP_READY_STALE_INTERVALS"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    readySinkFailureWindowFlag,
+			Usage:   "how long a sink may fail every record before the daemon reports not ready, a sink that did not fail within it is not reported",
+			Value:   "15m",
+			EnvVars: []string{"APP_READY_SINK_FAILURE_WINDOW"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    lagSLOThresholdFlag,
+			Usage:   "p95 ingestion lag above which the daemon reports degraded, e.g. 30m, unset disables the SLO",
+			EnvVars: []string{"APP_LAG_SLO_THRESHOLD"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    lagSLOWindowFlag,
+			Usage:   "window the p95 ingestion lag is computed over",
+			Value:   "1h",
+			EnvVars: []string{"APP_LAG_SLO_WINDOW"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    lagSLOFromFlag,
+			Usage:   "lag the SLO applies to: content_created, our own delay, or creation_time, including Microsoft's",
+			Value:   lagFromContentCreated,
+			EnvVars: []string{"APP_LAG_SLO_FROM"},
+		}),
 		altsrc.NewStringFlag(&cli.StringFlag{
 			Name:        tenantIdFlag,
 			Destination: &TenantID,
@@ -99,10 +306,380 @@ func main() {
 		altsrc.NewStringFlag(&cli.StringFlag{
 			Name:      outputFileFlag,
 			Aliases:   []string{"f"},
+			Usage:     "output path, may contain {tenant}, {contentType}, {contentId}, {date} and {hour}",
 			TakesFile: true,
 			Required:  false,
 			EnvVars:   []string{"APP_OUTPUT_FILE"},
 		}),
+		altsrc.NewInt64Flag(&cli.Int64Flag{
+			Name:    outputMaxMBFlag,
+			Usage:   "rotate output files larger than this many MiB; 0 disables",
+			EnvVars: []string{"APP_OUTPUT_MAX_MB"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    outputMaxAgeFlag,
+			Usage:   "rotate output files older than this duration, e.g. 24h",
+			EnvVars: []string{"APP_OUTPUT_MAX_AGE"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    outputCompressionFlag,
+			Usage:   "compression of rotated output files, gzip or zstd",
+			EnvVars: []string{"APP_OUTPUT_COMPRESSION"},
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:    outputMaxFilesFlag,
+			Usage:   "rotated files kept per output path; 0 keeps all",
+			EnvVars: []string{"APP_OUTPUT_MAX_FILES"},
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:    outputPerBlobFlag,
+			Usage:   "write each content blob to its own file, the output path must contain {contentId}",
+			EnvVars: []string{"APP_OUTPUT_PER_BLOB"},
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:    stdoutOutputFlag,
+			Usage:   "write records to stdout as JSON lines, logs are written to stderr",
+			EnvVars: []string{"APP_STDOUT_OUTPUT"},
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:    stdoutEnvelopeFlag,
+			Usage:   "wrap stdout records as {tenant, contentType, contentId, record}",
+			EnvVars: []string{"APP_STDOUT_ENVELOPE"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    syslogAddressFlag,
+			Usage:   "host:port of a syslog receiver",
+			EnvVars: []string{"APP_SYSLOG_ADDRESS"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    syslogNetworkFlag,
+			Usage:   "udp, tcp or tls",
+			Value:   "tcp",
+			EnvVars: []string{"APP_SYSLOG_NETWORK"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    syslogFormatFlag,
+			Usage:   "rfc5424 sends the record JSON as message, cef or leef map the common audit fields",
+			Value:   "rfc5424",
+			EnvVars: []string{"APP_SYSLOG_FORMAT"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    syslogFacilityFlag,
+			Usage:   "facility of records, sign-in and password operations use authpriv",
+			Value:   "local0",
+			EnvVars: []string{"APP_SYSLOG_FACILITY"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:      syslogCAFileFlag,
+			Usage:     "PEM CA bundle used to verify the syslog receiver over tls",
+			TakesFile: true,
+			EnvVars:   []string{"APP_SYSLOG_CA_FILE"},
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:    syslogInsecureSkipVerifyFlag,
+			EnvVars: []string{"APP_SYSLOG_INSECURE_SKIP_VERIFY"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    splunkURLFlag,
+			Usage:   "Splunk HTTP Event Collector base URL, e.g. https://splunk:8088",
+			EnvVars: []string{"APP_SPLUNK_URL"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    splunkTokenFlag,
+			EnvVars: []string{"APP_SPLUNK_TOKEN"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    splunkIndexFlag,
+			Usage:   "index of the events, defaults to the index of the token",
+			EnvVars: []string{"APP_SPLUNK_INDEX"},
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:    splunkSourcetypesFlag,
+			Usage:   "contentType=sourcetype overrides, o365:management:activity is used otherwise",
+			EnvVars: []string{"APP_SPLUNK_SOURCETYPES"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    splunkAckTimeoutFlag,
+			Usage:   "wait up to this duration for indexer acknowledgement before a blob counts as delivered, e.g. 5m; empty disables acknowledgement",
+			EnvVars: []string{"APP_SPLUNK_ACK_TIMEOUT"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:      splunkCAFileFlag,
+			Usage:     "PEM CA bundle used to verify Splunk",
+			TakesFile: true,
+			EnvVars:   []string{"APP_SPLUNK_CA_FILE"},
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:    splunkInsecureSkipVerifyFlag,
+			EnvVars: []string{"APP_SPLUNK_INSECURE_SKIP_VERIFY"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    elasticURLFlag,
+			Usage:   "Elasticsearch or OpenSearch URL, e.g. https://elastic:9200",
+			EnvVars: []string{"APP_ELASTIC_URL"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    elasticIndexFlag,
+			Usage:   "index name, may contain {tenant}, {contentType}, {date} and {month} of the record",
+			Value:   "o365-{contentType}-{date}",
+			EnvVars: []string{"APP_ELASTIC_INDEX"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    elasticUsernameFlag,
+			EnvVars: []string{"APP_ELASTIC_USERNAME"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    elasticPasswordFlag,
+			EnvVars: []string{"APP_ELASTIC_PASSWORD"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    elasticAPIKeyFlag,
+			Usage:   "base64 encoded API key, used instead of username and password",
+			EnvVars: []string{"APP_ELASTIC_API_KEY"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:      elasticCAFileFlag,
+			Usage:     "PEM CA bundle used to verify Elasticsearch",
+			TakesFile: true,
+			EnvVars:   []string{"APP_ELASTIC_CA_FILE"},
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:    elasticInsecureSkipVerifyFlag,
+			EnvVars: []string{"APP_ELASTIC_INSECURE_SKIP_VERIFY"},
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:    elasticTemplateFlag,
+			Usage:   "install an index template mapping the common audit fields",
+			EnvVars: []string{"APP_ELASTIC_TEMPLATE"},
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:    kafkaBrokersFlag,
+			Usage:   "host:port of the Kafka bootstrap brokers",
+			EnvVars: []string{"APP_KAFKA_BROKERS"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    kafkaTopicFlag,
+			Usage:   "topic of the records, may contain {tenant} and {contentType}",
+			Value:   "o365.{contentType}",
+			EnvVars: []string{"APP_KAFKA_TOPIC"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    kafkaKeyFieldFlag,
+			Usage:   "record field used as message key, e.g. Id or UserId",
+			Value:   "Id",
+			EnvVars: []string{"APP_KAFKA_KEY_FIELD"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    kafkaSASLMechanismFlag,
+			Usage:   "PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512",
+			EnvVars: []string{"APP_KAFKA_SASL_MECHANISM"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    kafkaUsernameFlag,
+			EnvVars: []string{"APP_KAFKA_USERNAME"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    kafkaPasswordFlag,
+			EnvVars: []string{"APP_KAFKA_PASSWORD"},
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:    kafkaTLSFlag,
+			Usage:   "connect to the brokers over TLS",
+			EnvVars: []string{"APP_KAFKA_TLS"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:      kafkaCAFileFlag,
+			Usage:     "PEM CA bundle used to verify the brokers",
+			TakesFile: true,
+			EnvVars:   []string{"APP_KAFKA_CA_FILE"},
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:    kafkaInsecureSkipVerifyFlag,
+			EnvVars: []string{"APP_KAFKA_INSECURE_SKIP_VERIFY"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    otlpEndpointFlag,
+			Usage:   "OTLP collector, a URL for http/protobuf or host:port for grpc",
+			EnvVars: []string{"APP_OTLP_ENDPOINT"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    otlpProtocolFlag,
+			Usage:   "http/protobuf or grpc",
+			Value:   "http/protobuf",
+			EnvVars: []string{"APP_OTLP_PROTOCOL"},
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:    otlpHeadersFlag,
+			Usage:   "key=value headers sent with every export request",
+			EnvVars: []string{"APP_OTLP_HEADERS"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    otlpCompressionFlag,
+			Usage:   "gzip or none",
+			Value:   "gzip",
+			EnvVars: []string{"APP_OTLP_COMPRESSION"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:      otlpCAFileFlag,
+			Usage:     "PEM CA bundle used to verify the collector",
+			TakesFile: true,
+			EnvVars:   []string{"APP_OTLP_CA_FILE"},
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:    otlpInsecureSkipVerifyFlag,
+			EnvVars: []string{"APP_OTLP_INSECURE_SKIP_VERIFY"},
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:    otlpInsecureFlag,
+			Usage:   "connect to a grpc collector without TLS",
+			EnvVars: []string{"APP_OTLP_INSECURE"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    webhookURLFlag,
+			Usage:   "URL the records are sent to",
+			EnvVars: []string{"APP_WEBHOOK_URL"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    webhookMethodFlag,
+			Value:   http.MethodPost,
+			EnvVars: []string{"APP_WEBHOOK_METHOD"},
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:    webhookHeadersFlag,
+			Usage:   "name=value headers sent with every request",
+			EnvVars: []string{"APP_WEBHOOK_HEADERS"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    webhookTemplateFlag,
+			Usage:   "Go template of the body given .Tenant, .ContentType, .ContentId and .Record, @file reads it from a file",
+			EnvVars: []string{"APP_WEBHOOK_TEMPLATE"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    webhookJMESPathFlag,
+			Usage:   "JMESPath projection of the record sent as body, instead of a template",
+			EnvVars: []string{"APP_WEBHOOK_JMESPATH"},
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:    webhookBatchSizeFlag,
+			Usage:   "send up to this many bodies as one JSON array, 0 sends every record alone",
+			EnvVars: []string{"APP_WEBHOOK_BATCH_SIZE"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    webhookHMACSecretFlag,
+			Usage:   "sign the body with HMAC-SHA256",
+			EnvVars: []string{"APP_WEBHOOK_HMAC_SECRET"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    webhookSignatureHeaderFlag,
+			Value:   "X-Signature-256",
+			EnvVars: []string{"APP_WEBHOOK_SIGNATURE_HEADER"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:      webhookCAFileFlag,
+			Usage:     "PEM CA bundle used to verify the webhook server",
+			TakesFile: true,
+			EnvVars:   []string{"APP_WEBHOOK_CA_FILE"},
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:    webhookInsecureSkipVerifyFlag,
+			EnvVars: []string{"APP_WEBHOOK_INSECURE_SKIP_VERIFY"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    databaseDriverFlag,
+			Usage:   "postgres or sqlite",
+			Value:   "postgres",
+			EnvVars: []string{"APP_DATABASE_DRIVER"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    databaseDSNFlag,
+			Usage:   "postgres connection string, or path of the SQLite database",
+			EnvVars: []string{"APP_DATABASE_DSN"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    databaseTableFlag,
+			Value:   "o365_audit",
+			EnvVars: []string{"APP_DATABASE_TABLE"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    parquetDirFlag,
+			Usage:   "root directory of the Parquet files, partitioned as tenant=/content_type=/date=",
+			EnvVars: []string{"APP_PARQUET_DIR"},
+		}),
+		altsrc.NewInt64Flag(&cli.Int64Flag{
+			Name:    parquetMaxRowsFlag,
+			Usage:   "complete a Parquet file once it holds this many rows, 0 disables",
+			Value:   1000000,
+			EnvVars: []string{"APP_PARQUET_MAX_ROWS"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    parquetMaxAgeFlag,
+			Usage:   "complete a Parquet file this long after it was opened, files are completed at the end of every run regardless",
+			Value:   "15m",
+			EnvVars: []string{"APP_PARQUET_MAX_AGE"},
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:    sinkFiltersFlag,
+			Usage:   "sink=JMESPath pairs, a sink only receives the records its expression is true for, e.g. splunk=Operation == 'UserLoggedIn'",
+			EnvVars: []string{"APP_SINK_FILTERS"},
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:    sinkBufferSizeFlag,
+			Usage:   "records buffered per sink, a sink with a full buffer for 30s fails the records routed to it",
+			Value:   10000,
+			EnvVars: []string{"APP_SINK_BUFFER_SIZE"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    deadLetterDirFlag,
+			Usage:   "directory the records failing processing or delivery are written to as JSONL, replayed with dlq replay",
+			EnvVars: []string{"APP_DEAD_LETTER_DIR"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    deadLetterSinkFlag,
+			Usage:   "configured sink the failed records are written to instead of a directory, e.g. kafka",
+			EnvVars: []string{"APP_DEAD_LETTER_SINK"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    s3EndpointFlag,
+			Usage:   "host:port of an S3 compatible service to archive the raw content blobs to",
+			EnvVars: []string{"APP_S3_ENDPOINT"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    s3BucketFlag,
+			EnvVars: []string{"APP_S3_BUCKET"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    s3RegionFlag,
+			EnvVars: []string{"APP_S3_REGION"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    s3AccessKeyFlag,
+			EnvVars: []string{"APP_S3_ACCESS_KEY"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    s3SecretKeyFlag,
+			EnvVars: []string{"APP_S3_SECRET_KEY"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    s3PrefixFlag,
+			Usage:   "key prefix of the archived blobs and manifests",
+			EnvVars: []string{"APP_S3_PREFIX"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    s3CompressionFlag,
+			Usage:   "gzip or zstd",
+			Value:   "gzip",
+			EnvVars: []string{"APP_S3_COMPRESSION"},
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:    s3InsecureFlag,
+			Usage:   "connect to the S3 endpoint over plain HTTP",
+			EnvVars: []string{"APP_S3_INSECURE"},
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:    s3RequiredFlag,
+			Usage:   "fail a blob that could not be archived, it is fetched and delivered to the sinks again on the next run; otherwise it is listed with the error in the run manifest",
+			EnvVars: []string{"APP_S3_REQUIRED"},
+		}),
 		altsrc.NewStringFlag(&cli.StringFlag{
 			Name:     publisherIdFlag,
 			Required: false,
@@ -134,8 +711,21 @@ func main() {
 		altsrc.NewBoolFlag(&cli.BoolFlag{
 			Name:    debugFlag,
 			Aliases: []string{"d"},
+			Usage:   "log at debug level, including the flag values with credentials redacted",
 			EnvVars: []string{"APP_DEBUG"},
 		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    logFormatFlag,
+			Usage:   "format of the operational log: logfmt or json",
+			Value:   "logfmt",
+			EnvVars: []string{"APP_LOG_FORMAT"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    logLevelFlag,
+			Usage:   "log level: debug, info, warn or error, changed at runtime with PUT /admin/loglevel?level=debug on AdminAddress",
+			Value:   "info",
+			EnvVars: []string{"APP_LOG_LEVEL"},
+		}),
 		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
 			Name:    staticLabelFlag,
 			Aliases: []string{"l"},
@@ -152,97 +742,343 @@ func main() {
 			Aliases: []string{"loki"},
 			EnvVars: []string{"APP_LOKI_ADDRESS"},
 		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:    lokiMaxRetriesFlag,
+			Usage:   "retries per batch on network errors, 429 and 5xx; negative disables retries",
+			Value:   10,
+			EnvVars: []string{"APP_LOKI_MAX_RETRIES"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:      lokiBufferDirFlag,
+			Usage:     "directory buffering batches while Loki is unavailable, replayed in order on recovery",
+			TakesFile: true,
+			EnvVars:   []string{"APP_LOKI_BUFFER_DIR"},
+		}),
+		altsrc.NewInt64Flag(&cli.Int64Flag{
+			Name:    lokiBufferMaxBytesFlag,
+			Usage:   "disk budget of the Loki buffer in MiB, a batch beyond it fails and its blob is fetched again; 0 is unlimited",
+			Value:   1024,
+			EnvVars: []string{"APP_LOKI_BUFFER_MAX_MB"},
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:    lokiBatchMaxKBFlag,
+			Usage:   "uncompressed size in KiB at which a Loki batch is sent, larger batches are split; 0 is unlimited",
+			Value:   1024,
+			EnvVars: []string{"APP_LOKI_BATCH_MAX_KB"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    lokiFormatFlag,
+			Usage:   "push format, proto (snappy compressed) or json",
+			Value:   "proto",
+			EnvVars: []string{"APP_LOKI_FORMAT"},
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:    lokiGzipFlag,
+			Usage:   "gzip JSON push requests",
+			EnvVars: []string{"APP_LOKI_GZIP"},
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:    lokiPushWorkersFlag,
+			Usage:   "batches pushed in parallel by the proto client, streams keep their order",
+			Value:   1,
+			EnvVars: []string{"APP_LOKI_PUSH_WORKERS"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    lokiTenantIdFlag,
+			Usage:   "sent as X-Scope-OrgID to multi-tenant Loki",
+			EnvVars: []string{"APP_LOKI_TENANT_ID"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    lokiUsernameFlag,
+			Usage:   "basic auth username, e.g. the Grafana Cloud user id",
+			EnvVars: []string{"APP_LOKI_USERNAME"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    lokiPasswordFlag,
+			EnvVars: []string{"APP_LOKI_PASSWORD"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    lokiBearerTokenFlag,
+			EnvVars: []string{"APP_LOKI_BEARER_TOKEN"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:      lokiCAFileFlag,
+			Usage:     "PEM CA bundle used to verify Loki",
+			TakesFile: true,
+			EnvVars:   []string{"APP_LOKI_CA_FILE"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:      lokiCertFileFlag,
+			Usage:     "PEM client certificate for mTLS",
+			TakesFile: true,
+			EnvVars:   []string{"APP_LOKI_CERT_FILE"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:      lokiKeyFileFlag,
+			Usage:     "PEM client key for mTLS",
+			TakesFile: true,
+			EnvVars:   []string{"APP_LOKI_KEY_FILE"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    lokiServerNameFlag,
+			EnvVars: []string{"APP_LOKI_SERVER_NAME"},
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:    lokiInsecureSkipVerifyFlag,
+			EnvVars: []string{"APP_LOKI_INSECURE_SKIP_VERIFY"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    lokiProxyURLFlag,
+			Usage:   "proxy for Loki requests, defaults to HTTP_PROXY/HTTPS_PROXY",
+			EnvVars: []string{"APP_LOKI_PROXY_URL"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    timestampFieldFlag,
+			Usage:   "JMESPath expression of the record field used as entry timestamp",
+			Value:   "CreationTime",
+			EnvVars: []string{"APP_TIMESTAMP_FIELD"},
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:    lokiSortEntriesFlag,
+			Usage:   "sort entries by timestamp within each stream before pushing, for Loki without out-of-order writes",
+			EnvVars: []string{"APP_LOKI_SORT_ENTRIES"},
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    lokiMaxEntryAgeFlag,
+			Usage:   "clamp older entry timestamps to this age, should match Loki's reject_old_samples_max_age",
+			EnvVars: []string{"APP_LOKI_MAX_ENTRY_AGE"},
+		}),
 		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
 			Name:    jmesLabelsFlag,
 			EnvVars: []string{"APP_JMES_LABELS"},
 		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:    jmesMetadataFlag,
+			Usage:   "name=JMESPath expression sent as Loki structured metadata instead of a label, e.g. UserId=UserId",
+			EnvVars: []string{"APP_JMES_METADATA"},
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:    labelCardinalityFlag,
+			Usage:   "label=maxValues[:window[:drop|bucket|line|metadata]], e.g. UserId=1000:1h:metadata",
+			EnvVars: []string{"APP_LABEL_CARDINALITY_LIMITS"},
+		}),
 	}
 	app := &cli.App{
 		EnableBashCompletion: true,
 		Name:                 "gcli",
-		Before:               altsrc.InitInputSourceWithContext(flags, altsrc.NewYamlSourceFromFlagFunc(loadConfigFileFlag)),
-		Flags:                flags,
-		Action:               runMain,
+		Before: func(context *cli.Context) error {
+			err := altsrc.InitInputSourceWithContext(flags, altsrc.NewYamlSourceFromFlagFunc(loadConfigFileFlag))(context)
+			if err != nil {
+				return err
+			}
+			err = configureLogging(context)
+			if err != nil {
+				return err
+			}
+			logFlags(context)
+			return nil
+		},
+		Flags:  flags,
+		Action: runMain,
+		Commands: []*cli.Command{
+			{
+				Name:  "dlq",
+				Usage: "manage the dead letter queue",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "replay",
+						Usage:  "push the dead letters of DeadLetterDir back through the configured sinks",
+						Action: replayDeadLetters,
+					},
+				},
+			},
+		},
 	}
 	err := app.RunContext(context.Background(), os.Args)
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal(err)
 	}
-	log.Printf("Execution Time: %vs", time.Since(currentTime).Seconds())
+	stageLog(stageRun).Infof("Execution Time: %vs", time.Since(currentTime).Seconds())
 
 }
 
 var availableContentChan chan ListAvailableContentResponse
-var retrievedContentObjects chan interface{}
+var retrievedContentObjects chan auditRecord
+
+// auditRecord is a single record of a content blob
+type auditRecord struct {
+	content     map[string]interface{}
+	contentType string
+	contentId   string
+	blob        *blobDelivery
+	// contentCreated is when the blob of the record was made available, zero for replayed records
+	contentCreated time.Time
+	// sink restricts routing to a single sink, it is set when replaying a record that failed there
+	sink string
+}
 
 var tracker *Tracker
+
+// currentRun follows the outcome of the run per content type
+var currentRun *runOutcome
+
+// outputFile is kept across daemon runs so files rotate by age
+var outputFile *fileOutputWrapper
+
+// contentArchive is the S3 archive of the raw blobs, created once as the file output
+var contentArchive *s3Archive
 var jmesLabels = map[string]string{}
+var jmesMetadata = map[string]string{}
+var timestampField string
+var cardinalityLimits = map[string]promtail.CardinalityLimit{}
 
 func runMain(context *cli.Context) error {
 
 	if context.Bool(debugFlag) {
-		log.Println("debug mode is enabled")
-		for _, flag := range context.FlagNames() {
-			if flagValue := context.Value(flag); flagValue == nil {
-				log.Printf("%v present;\n", flag)
-			} else {
-				log.Printf("%v = %v;\n", flag, flagValue)
+		stageLog(stageConfig).Debug("debug mode is enabled")
+	}
+
+	configureRecordProcessing(context)
+	if err := configureArchive(context); err != nil {
+		return err
+	}
+
+	if context.Bool(runAsDaemonFlag) {
+		stageLog(stageRun).Info("starting as daemon")
+		if runInterval := context.String(runIntervalFlag); runInterval != "" {
+			stageLog(stageConfig).Debugf("run interval set to %v", runInterval)
+		}
+		sleepDuration, err := time.ParseDuration(context.String(runIntervalFlag))
+
+		if err != nil {
+			stageLog(stageConfig).Fatalf("Unable to parse duration value %v, run interval: %v", err, sleepDuration)
+		}
+		sinkFailureWindow, err := time.ParseDuration(context.String(readySinkFailureWindowFlag))
+		if err != nil {
+			stageLog(stageConfig).Fatalf("Unable to parse duration value %v: %v", context.String(readySinkFailureWindowFlag), err)
+		}
+		health := healthcheck.NewHandler()
+
+		health.AddLivenessCheck("goroutine-threshold", healthcheck.GoroutineCountCheck(context.Int(goroutineThresholdFlag)))
+		health.AddLivenessCheck("gc-timeout", healthcheck.GCMaxPauseCheck(time.Second*3))
+		health.AddReadinessCheck("token-refresh", readiness.tokenCheck())
+		// a run takes the interval plus its own duration, which the interval count leaves room for
+		staleAfter := time.Duration(context.Int(readyStaleIntervalsFlag)) * sleepDuration
+		health.AddReadinessCheck("content-listed", readiness.listCheck(enabledContentTypes(context), staleAfter))
+		health.AddReadinessCheck("sink-failing", readiness.sinkCheck(sinkFailureWindow))
+		if err := configureLagSLO(context); err != nil {
+			stageLog(stageConfig).Fatal(err)
+		}
+		health.AddReadinessCheck("lag-slo", lagCheck(ingestionLag))
+		go ingestionLag.run()
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		mux.Handle("/", health)
+		go func() {
+			err := http.ListenAndServe(context.String(healthAddressFlag), mux)
+			if err != nil {
+				stageLog(stageHealth).Fatalf("Error creating healthcheck http endpoint: %v", err)
 			}
+		}()
+		// the admin endpoints change the process and are not authenticated, they are kept off the health address
+		if adminAddress := context.String(adminAddressFlag); adminAddress != "" {
+			adminMux := http.NewServeMux()
+			adminMux.HandleFunc("/admin/loglevel", logLevelHandler)
+			go func() {
+				err := http.ListenAndServe(adminAddress, adminMux)
+				if err != nil {
+					stageLog(stageHealth).Fatalf("Error creating admin http endpoint: %v", err)
+				}
+			}()
+		}
+		for {
+			err = runFunc(context)
+			if err != nil {
+				stageLog(stageRun).Errorf("error encountered during func run: %v", err)
+				//return err
+			}
+			stageLog(stageRun).Infof("Sleeping for %v", sleepDuration)
+			time.Sleep(sleepDuration)
+		}
+
+	} else {
+		return runFunc(context)
+
+	}
+
+}
+
+// configureLagSLO applies the lag SLO flags to ingestionLag
+func configureLagSLO(context *cli.Context) error {
+	window, err := time.ParseDuration(context.String(lagSLOWindowFlag))
+	if err != nil {
+		return fmt.Errorf("unable to parse duration value %v: %w", context.String(lagSLOWindowFlag), err)
+	}
+	var threshold time.Duration
+	if value := context.String(lagSLOThresholdFlag); value != "" {
+		threshold, err = time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("unable to parse duration value %v: %w", value, err)
+		}
+		stageLog(stageConfig).Infof("p95 ingestion lag SLO set to %v over %v", threshold, window)
+	}
+	return ingestionLag.configure(window, context.String(lagSLOFromFlag), threshold)
+}
+
+// enabledContentTypes returns the content types enabled by the flags, in listing order
+func enabledContentTypes(context *cli.Context) []string {
+	var contentTypes []string
+	for _, enabled := range []struct {
+		flag        string
+		contentType string
+	}{
+		{getGeneralContentFlag, ContentType_General},
+		{getExchangeContentFlag, ContentType_Exchange},
+		{getAzureAdContentFlag, ContentType_AAD},
+		{getSharepointContentFlag, ContentType_Sharepoint},
+		{getDLPContentFlag, ContentType_DLP},
+	} {
+		if context.Bool(enabled.flag) {
+			contentTypes = append(contentTypes, enabled.contentType)
 		}
 	}
+	return contentTypes
+}
 
+// configureRecordProcessing loads the label, metadata and timestamp options used by processRetrievedObject
+func configureRecordProcessing(context *cli.Context) {
 	if staticLabels := context.StringSlice(staticLabelFlag); len(staticLabels) > 0 {
-		log.Printf("static labels set to: %v\n", staticLabels)
+		stageLog(stageConfig).Infof("static labels set to: %v", staticLabels)
 	}
 	if dynamicLabels := context.StringSlice(jmesLabelsFlag); len(dynamicLabels) > 0 {
-		log.Printf("JMESPath labels set to: %v", dynamicLabels)
+		stageLog(stageConfig).Infof("JMESPath labels set to: %v", dynamicLabels)
 		for _, label := range dynamicLabels {
 			k, v, err := splitStringOnChar(label, '=')
 			if err != nil {
-				log.Fatal(err)
+				stageLog(stageConfig).Fatal(err)
 			}
 			jmesLabels[k] = v
 		}
 	}
-
-	if context.Bool(runAsDaemonFlag) {
-		log.Println("starting as daemon")
-		health := healthcheck.NewHandler()
-
-		health.AddLivenessCheck("goroutine-threshold", healthcheck.GoroutineCountCheck(100))
-		health.AddLivenessCheck("gc-timeout", healthcheck.GCMaxPauseCheck(time.Second*3))
-		go func() {
-			err := http.ListenAndServe("0.0.0.0:8090", health)
+	if metadataFields := context.StringSlice(jmesMetadataFlag); len(metadataFields) > 0 {
+		stageLog(stageConfig).Infof("JMESPath structured metadata set to: %v", metadataFields)
+		for _, field := range metadataFields {
+			k, v, err := splitStringOnChar(field, '=')
 			if err != nil {
-				log.Fatalf("Error creating healthcheck http endpoint: %v", err)
-			}
-		}()
-		if context.Bool(debugFlag) {
-			if runInterval := context.String(runIntervalFlag); runInterval != "" {
-				log.Printf("run interval set to %v", runInterval)
+				stageLog(stageConfig).Fatal(err)
 			}
+			jmesMetadata[k] = v
 		}
-		sleepDuration, err := time.ParseDuration(context.String(runIntervalFlag))
-
+	}
+	timestampField = context.String(timestampFieldFlag)
+	for _, spec := range context.StringSlice(labelCardinalityFlag) {
+		label, limit, err := parseCardinalityLimit(spec)
 		if err != nil {
-			log.Fatalf("Unable to parse duration value %v, run interval: %v", err, sleepDuration)
-		}
-		for {
-			err = runFunc(context)
-			if err != nil {
-				log.Printf("error encountered during func run: %v", err)
-				log.Println(err)
-				//return err
-			}
-			log.Printf("Sleeping for %v", sleepDuration)
-			time.Sleep(sleepDuration)
+			stageLog(stageConfig).Fatal(err)
 		}
-
-	} else {
-		return runFunc(context)
-
+		stageLog(stageConfig).Infof("label %v limited to %v distinct values per %v, overflow action: %v", label, limit.MaxValues, limit.Window, limit.Action)
+		cardinalityLimits[label] = limit
 	}
-
 }
 
 func runFunc(context *cli.Context) error {
@@ -253,49 +1089,39 @@ func runFunc(context *cli.Context) error {
 		historyFilePath: context.String(historyFileFlag),
 	}
 	tracker.load()
-	staticLabels := map[string]string{}
-	for _, staticLabel := range context.StringSlice(staticLabelFlag) {
-		k, v, err := splitStringOnChar(staticLabel, '=')
-		if err != nil {
-			log.Fatal(err)
-		}
-		staticLabels[k] = v
-	}
+	currentRun = newRunOutcome()
 	var wg sync.WaitGroup
-	var loki promtail.Client
-	if lokiAddress := context.String(lokiAddressFlag); lokiAddress != "" {
-		conf := promtail.ClientConfig{
-			PushURL:            lokiAddress,
-			Labels:             staticLabels,
-			SendLevel:          promtail.DEBUG,
-			PrintLevel:         promtail.DISABLE,
-			BatchWait:          time.Second * 5,
-			BatchEntriesNumber: 500,
-		}
-		var err error
-		loki, err = promtail.NewClientProto(conf)
-		if err != nil {
-			log.Fatal(fmt.Errorf("failed to generate promtail client from config: %w", err))
-		}
-	}
 
 	// to manage request concurrency limit
 	semaphorChan := make(chan struct{}, 20)
+	// to manage processing concurrency, blocks the loop below while the sinks are saturated
+	processSemaphorChan := make(chan struct{}, MaxConcurrentProcessing)
 
 	//
 	availableContentChan = make(chan ListAvailableContentResponse, MaxEntriesChanSize)
 
 	// to hold responses
-	retrievedContentObjects = make(chan interface{}, MaxEntriesChanSize)
+	retrievedContentObjects = make(chan auditRecord, MaxEntriesChanSize)
+
+	available, retrieved := availableContentChan, retrievedContentObjects
+	stopSampling := make(chan struct{})
+	defer close(stopSampling)
+	go sampleChannelDepths(stopSampling, map[string]func() int{
+		"available_content": func() int { return len(available) },
+		"retrieved_content": func() int { return len(retrieved) },
+		"fetch_slots":       func() int { return len(semaphorChan) },
+		"process_slots":     func() int { return len(processSemaphorChan) },
+	})
 
 	defer func(t *Tracker) {
 		close(semaphorChan)
+		close(processSemaphorChan)
 		close(availableContentChan)
 		close(retrievedContentObjects)
 
 		err := t.pruneHistory(time.Hour * 24 * 14)
 		if err != nil {
-			log.Println(err)
+			stageLog(stageHistory).Error(err)
 		}
 	}(tracker)
 
@@ -303,76 +1129,52 @@ func runFunc(context *cli.Context) error {
 
 	client, err := NewApiClientWithCustomEndpoint(TenantID, ApplicationID, ClientSecret, AzureADAuthEndpointGlobal, ServiceRootEndpointGlobal)
 	if err != nil {
-		log.Fatal(err)
+		// a daemon keeps running, reporting not ready until a refresh succeeds
+		return err
 	}
 	err = client.refreshToken()
 	if err != nil {
 		return err
 	}
 
-	if context.Bool(getGeneralContentFlag) {
-		err := client.getContentForType(ContentType_General, context.Bool(debugFlag), &wg, context.Context)
-		if err != nil {
-			log.Fatal(err)
-		}
-	}
-	if context.Bool(getExchangeContentFlag) {
-		err := client.getContentForType(ContentType_Exchange, context.Bool(debugFlag), &wg, context.Context)
-		if err != nil {
-			log.Fatal(err)
-		}
-	}
-	if context.Bool(getAzureAdContentFlag) {
-		err := client.getContentForType(ContentType_AAD, context.Bool(debugFlag), &wg, context.Context)
-		if err != nil {
-			log.Fatal(err)
-		}
-	}
-	if context.Bool(getSharepointContentFlag) {
-		err := client.getContentForType(ContentType_Sharepoint, context.Bool(debugFlag), &wg, context.Context)
-		if err != nil {
-			log.Fatal(err)
-		}
+	router, err := newSinkRouter(context.Int(sinkBufferSizeFlag), context.StringSlice(sinkFiltersFlag))
+	if err != nil {
+		return err
 	}
-	if context.Bool(getDLPContentFlag) {
-		err := client.getContentForType(ContentType_DLP, context.Bool(debugFlag), &wg, context.Context)
-		if err != nil {
-			log.Fatal(err)
-		}
+	// created last, its buffer replay starts right away and only closing the router shuts it down
+	err = configureSinks(context, router, newLokiClient(context))
+	if err != nil {
+		router.close(context.Context)
+		return err
 	}
 
-	var outputFile *fileOutputWrapper
-
-	if filePath := context.String(outputFileFlag); filePath != "" {
-		outputFile = &fileOutputWrapper{filePath: filePath}
-		err := outputFile.open()
-		if err != nil {
-			return err
-		}
-		defer func(file *fileOutputWrapper) {
-			err := file.close()
-			if err != nil {
-
-			}
-		}(outputFile)
+	if contentArchive != nil {
+		contentArchive.startRun()
+	}
+	// the listing feeds the loop below, nothing may return before it is drained
+	for _, contentType := range enabledContentTypes(context) {
+		client.getContentForType(contentType, context.Bool(debugFlag), &wg, context.Context)
 	}
 loop:
 	for {
 		select {
 		case result := <-retrievedContentObjects:
+			processSemaphorChan <- struct{}{}
 			wg.Add(1)
-			go processRetrievedObject(&wg, result, outputFile, "" != context.String(lokiAddressFlag), loki)
+			go processRetrievedObject(&wg, processSemaphorChan, result, router)
 		case result := <-availableContentChan:
-			if context.Bool(debugFlag) {
-				log.Printf("received content with uri %v from channel", result.ContentUri)
-			}
+			blobLog(result.ContentType, result.ContentId, stageFetch).Debugf("received content with uri %v from channel", result.ContentUri)
 			contentUri, err := url.ParseRequestURI(result.ContentUri)
 			if err != nil {
-				log.Printf("Error parsing request uri: %v", result.ContentUri)
-				return err
+				// only this blob fails, the listing is still sending on the channels
+				blobLog(result.ContentType, result.ContentId, stageFetch).Errorf("Error parsing request uri: %v", logStringSani(result.ContentUri))
+				blobsFetchedCounter.WithLabelValues(result.ContentType, resultLabel(err)).Inc()
+				currentRun.blobFailed(result.ContentType)
+				tracker.track(result.ContentUri).done(err)
+				continue
 			}
 			wg.Add(1)
-			go processAvailableObject(contentUri, &wg, retrievedContentObjects, semaphorChan, client, context)
+			go processAvailableObject(result, contentUri, &wg, retrievedContentObjects, semaphorChan, client, contentArchive, context)
 		default:
 			break
 		}
@@ -392,95 +1194,581 @@ loop:
 	if len(semaphorChan) > 0 || len(retrievedContentObjects) > 0 || len(availableContentChan) > 0 {
 		goto loop
 	}
-	if "" != context.String(lokiAddressFlag) {
-		loki.Shutdown()
+	router.close(context.Context)
+	if contentArchive != nil {
+		if err := contentArchive.endRun(context.Context); err != nil {
+			stageLog(stageArchive).Errorf("error encountered writing archive manifest: %v", err)
+		}
 	}
-	return nil
+	// the records are resolved once the sinks are closed
+	currentRun.end(time.Now())
+	return currentRun.listErr()
 
 }
-func processAvailableObject(contentUri *url.URL, group *sync.WaitGroup, retrievedcontentChannel chan interface{}, semephorChan chan struct{}, client *ApiClient, cliContext *cli.Context) {
-	//var regOpts = compileListQueryOptions(nil)
-	nextPageUri := contentUri.String()
+
+// configureArchive creates contentArchive when an S3 endpoint is set
+func configureArchive(context *cli.Context) error {
+	endpoint := context.String(s3EndpointFlag)
+	if endpoint == "" {
+		return nil
+	}
 	var err error
-	var thisBatch []map[string]interface{}
-	for {
+	contentArchive, err = newS3Archive(s3Config{
+		Endpoint:    endpoint,
+		Bucket:      context.String(s3BucketFlag),
+		Region:      context.String(s3RegionFlag),
+		AccessKey:   context.String(s3AccessKeyFlag),
+		SecretKey:   context.String(s3SecretKeyFlag),
+		Insecure:    context.Bool(s3InsecureFlag),
+		Prefix:      context.String(s3PrefixFlag),
+		Compression: context.String(s3CompressionFlag),
+		TenantId:    TenantID,
+		Required:    context.Bool(s3RequiredFlag),
+	})
+	return err
+}
+
+// newLokiClient creates the Loki client when an address is set, nil otherwise
+func newLokiClient(context *cli.Context) promtail.ClientV2 {
+	staticLabels := map[string]string{}
+	for _, staticLabel := range context.StringSlice(staticLabelFlag) {
+		k, v, err := splitStringOnChar(staticLabel, '=')
 		if err != nil {
-			log.Println(err)
-			//log.Fatal(err)
+			stageLog(stageConfig).Fatal(err)
 		}
-		for _, retrievedContentObject := range thisBatch {
-			retrievedcontentChannel <- &retrievedContentObject
+		staticLabels[k] = v
+	}
+	var loki promtail.ClientV2
+	if lokiAddress := context.String(lokiAddressFlag); lokiAddress != "" {
+		var maxEntryAge time.Duration
+		if age := context.String(lokiMaxEntryAgeFlag); age != "" {
+			var err error
+			maxEntryAge, err = time.ParseDuration(age)
+			if err != nil {
+				stageLog(stageConfig).Fatalf("Unable to parse duration value %v: %v", age, err)
+			}
 		}
-		if nextPageUri == "" {
-			break
+		conf := promtail.ClientConfig{
+			PushURL:            lokiAddress,
+			Labels:             staticLabels,
+			SendLevel:          promtail.DEBUG,
+			PrintLevel:         promtail.DISABLE,
+			BatchWait:          time.Second * 5,
+			BatchEntriesNumber: 500,
+			BatchSize:          context.Int(lokiBatchMaxKBFlag) * 1024,
+			Gzip:               context.Bool(lokiGzipFlag),
+			PushWorkers:        context.Int(lokiPushWorkersFlag),
+			CardinalityLimits:  cardinalityLimits,
+			MaxRetries:         context.Int(lokiMaxRetriesFlag),
+			BufferDir:          context.String(lokiBufferDirFlag),
+			BufferMaxBytes:     context.Int64(lokiBufferMaxBytesFlag) * 1024 * 1024,
+			SortEntries:        context.Bool(lokiSortEntriesFlag),
+			MaxEntryAge:        maxEntryAge,
+			Logger:             sinkLog("loki"),
+			TenantID:           context.String(lokiTenantIdFlag),
+			BearerToken:        context.String(lokiBearerTokenFlag),
+			ProxyURL:           context.String(lokiProxyURLFlag),
+			TLS: promtail.TLSConfig{
+				CAFile:             context.String(lokiCAFileFlag),
+				CertFile:           context.String(lokiCertFileFlag),
+				KeyFile:            context.String(lokiKeyFileFlag),
+				ServerName:         context.String(lokiServerNameFlag),
+				InsecureSkipVerify: context.Bool(lokiInsecureSkipVerifyFlag),
+			},
 		}
-		newUrl, err := url.Parse(nextPageUri)
+		if username := context.String(lokiUsernameFlag); username != "" {
+			conf.BasicAuth = &promtail.BasicAuth{Username: username, Password: context.String(lokiPasswordFlag)}
+		}
+		var err error
+		switch format := context.String(lokiFormatFlag); format {
+		case "proto":
+			loki, err = promtail.NewClientProtoV2(conf)
+		case "json":
+			loki, err = promtail.NewClientJsonV2(conf)
+		default:
+			err = fmt.Errorf("unknown Loki push format %q", format)
+		}
+		if err != nil {
+			stageLog(stageConfig).Fatal(fmt.Errorf("failed to generate promtail client from config: %w", err))
+		}
+	}
+	return loki
+}
+
+// configureSinks creates the outputs enabled by the flags and adds them to router
+func configureSinks(cliContext *cli.Context, router *sinkRouter, loki promtail.ClientV2) error {
+	var err error
+	if loki != nil {
+		router.add("loki", sinkFuncs{
+			write: func(ctx context.Context, entry sinkEntry, done func(error)) error {
+				return loki.Push(ctx, promtail.Entry{
+					Timestamp:  entry.ts,
+					Line:       string(entry.line),
+					Labels:     entry.labels,
+					Metadata:   entry.metadata,
+					Level:      promtail.INFO,
+					OnDelivery: done,
+				})
+			},
+			flush: func(ctx context.Context) error {
+				report, err := loki.Flush(ctx)
+				sinkLog("loki").WithFields(logrus.Fields{
+					"delivered": report.Delivered,
+					"buffered":  report.Buffered,
+					"dropped":   report.Dropped,
+				}).Info("loki delivery report")
+				return err
+			},
+			close: loki.Shutdown,
+		})
+	}
+
+	if filePath := cliContext.String(outputFileFlag); filePath != "" {
+		if outputFile == nil {
+			var maxAge time.Duration
+			if age := cliContext.String(outputMaxAgeFlag); age != "" {
+				maxAge, err = time.ParseDuration(age)
+				if err != nil {
+					stageLog(stageConfig).Fatalf("Unable to parse duration value %v: %v", age, err)
+				}
+			}
+			outputFile, err = newFileOutputWrapper(fileOutputConfig{
+				PathTemplate: filePath,
+				TenantId:     TenantID,
+				MaxBytes:     cliContext.Int64(outputMaxMBFlag) * 1024 * 1024,
+				MaxAge:       maxAge,
+				Compression:  cliContext.String(outputCompressionFlag),
+				MaxFiles:     cliContext.Int(outputMaxFilesFlag),
+				PerBlob:      cliContext.Bool(outputPerBlobFlag),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		file := outputFile
+		router.add("file", sinkFuncs{
+			// records are resolved once their file is fsynced
+			write: func(ctx context.Context, entry sinkEntry, done func(error)) error {
+				return file.write(entry.record, entry.line, done)
+			},
+			flush: func(ctx context.Context) error {
+				return file.flush()
+			},
+			// the files stay open across daemon runs, closing them only releases the handles until the next write
+			close: func(ctx context.Context) error {
+				return file.close()
+			},
+		})
+	}
+
+	if cliContext.Bool(stdoutOutputFlag) {
+		stdout := newStdoutOutput(cliContext.Bool(stdoutEnvelopeFlag), TenantID)
+		router.add("stdout", sinkFuncs{
+			write: func(ctx context.Context, entry sinkEntry, done func(error)) error {
+				if err := stdout.write(entry.record, entry.line); err != nil {
+					return err
+				}
+				done(nil)
+				return nil
+			},
+		})
+	}
+
+	if syslogAddress := cliContext.String(syslogAddressFlag); syslogAddress != "" {
+		facility, err := parseSyslogFacility(cliContext.String(syslogFacilityFlag))
+		if err != nil {
+			return err
+		}
+		conf := syslogConfig{
+			Network:  cliContext.String(syslogNetworkFlag),
+			Address:  syslogAddress,
+			Format:   cliContext.String(syslogFormatFlag),
+			Facility: facility,
+			TenantId: TenantID,
+		}
+		if conf.Network == "tls" {
+			conf.TLS, err = loadTLSConfig(cliContext.String(syslogCAFileFlag), cliContext.Bool(syslogInsecureSkipVerifyFlag))
+			if err != nil {
+				return err
+			}
+		}
+		syslog, err := newSyslogOutput(conf)
+		if err != nil {
+			return err
+		}
+		router.add("syslog", sinkFuncs{
+			write: func(ctx context.Context, entry sinkEntry, done func(error)) error {
+				return syslog.write(ctx, entry.record, entry.line, entry.ts, done)
+			},
+			flush: syslog.flush,
+			close: syslog.close,
+		})
+	}
+
+	if splunkURL := cliContext.String(splunkURLFlag); splunkURL != "" {
+		sourcetypes, err := parseSplunkSourcetypes(cliContext.StringSlice(splunkSourcetypesFlag))
+		if err != nil {
+			return err
+		}
+		conf := splunkConfig{
+			URL:         splunkURL,
+			Token:       cliContext.String(splunkTokenFlag),
+			Index:       cliContext.String(splunkIndexFlag),
+			Sourcetypes: sourcetypes,
+			TenantId:    TenantID,
+		}
+		if ackTimeout := cliContext.String(splunkAckTimeoutFlag); ackTimeout != "" {
+			conf.AckTimeout, err = time.ParseDuration(ackTimeout)
+			if err != nil {
+				stageLog(stageConfig).Fatalf("Unable to parse duration value %v: %v", ackTimeout, err)
+			}
+		}
+		conf.TLS, err = loadTLSConfig(cliContext.String(splunkCAFileFlag), cliContext.Bool(splunkInsecureSkipVerifyFlag))
+		if err != nil {
+			return err
+		}
+		splunk, err := newSplunkOutput(conf)
+		if err != nil {
+			return err
+		}
+		router.add("splunk", sinkFuncs{
+			write: func(ctx context.Context, entry sinkEntry, done func(error)) error {
+				return splunk.write(ctx, entry.record, entry.line, entry.ts, done)
+			},
+			flush: splunk.flush,
+			close: splunk.close,
+		})
+	}
+
+	if elasticURL := cliContext.String(elasticURLFlag); elasticURL != "" {
+		conf := elasticConfig{
+			URL:          elasticURL,
+			IndexPattern: cliContext.String(elasticIndexFlag),
+			Username:     cliContext.String(elasticUsernameFlag),
+			Password:     cliContext.String(elasticPasswordFlag),
+			APIKey:       cliContext.String(elasticAPIKeyFlag),
+			TenantId:     TenantID,
+			Template:     cliContext.Bool(elasticTemplateFlag),
+		}
+		conf.TLS, err = loadTLSConfig(cliContext.String(elasticCAFileFlag), cliContext.Bool(elasticInsecureSkipVerifyFlag))
+		if err != nil {
+			return err
+		}
+		elastic, err := newElasticOutput(conf)
+		if err != nil {
+			return err
+		}
+		router.add("elasticsearch", sinkFuncs{
+			write: func(ctx context.Context, entry sinkEntry, done func(error)) error {
+				return elastic.write(ctx, entry.record, entry.line, entry.ts, done)
+			},
+			flush: elastic.flush,
+			close: elastic.close,
+		})
+	}
+
+	if brokers := cliContext.StringSlice(kafkaBrokersFlag); len(brokers) > 0 {
+		conf := kafkaConfig{
+			Brokers:       brokers,
+			TopicTemplate: cliContext.String(kafkaTopicFlag),
+			KeyField:      cliContext.String(kafkaKeyFieldFlag),
+			TenantId:      TenantID,
+			SASLMechanism: cliContext.String(kafkaSASLMechanismFlag),
+			SASLUsername:  cliContext.String(kafkaUsernameFlag),
+			SASLPassword:  cliContext.String(kafkaPasswordFlag),
+		}
+		if cliContext.Bool(kafkaTLSFlag) {
+			conf.TLS, err = loadTLSConfig(cliContext.String(kafkaCAFileFlag), cliContext.Bool(kafkaInsecureSkipVerifyFlag))
+			if err != nil {
+				return err
+			}
+		}
+		kafka, err := newKafkaOutput(conf)
+		if err != nil {
+			return err
+		}
+		router.add("kafka", sinkFuncs{
+			write: func(ctx context.Context, entry sinkEntry, done func(error)) error {
+				return kafka.write(ctx, entry.record, entry.line, done)
+			},
+			flush: kafka.flush,
+			close: kafka.close,
+		})
+	}
+
+	if endpoint := cliContext.String(otlpEndpointFlag); endpoint != "" {
+		conf := otlpConfig{
+			Endpoint:    endpoint,
+			Protocol:    cliContext.String(otlpProtocolFlag),
+			Compression: cliContext.String(otlpCompressionFlag),
+			TenantId:    TenantID,
+			Insecure:    cliContext.Bool(otlpInsecureFlag),
+		}
+		conf.Headers, err = parseHeaderPairs(cliContext.StringSlice(otlpHeadersFlag))
+		if err != nil {
+			return err
+		}
+		conf.TLS, err = loadTLSConfig(cliContext.String(otlpCAFileFlag), cliContext.Bool(otlpInsecureSkipVerifyFlag))
+		if err != nil {
+			return err
+		}
+		otlp, err := newOtlpOutput(conf)
+		if err != nil {
+			return err
+		}
+		router.add("otlp", sinkFuncs{
+			write: func(ctx context.Context, entry sinkEntry, done func(error)) error {
+				return otlp.write(ctx, entry.record, entry.ts, done)
+			},
+			flush: otlp.flush,
+			close: otlp.close,
+		})
+	}
+
+	if webhookURL := cliContext.String(webhookURLFlag); webhookURL != "" {
+		conf := webhookConfig{
+			URL:             webhookURL,
+			Method:          cliContext.String(webhookMethodFlag),
+			BatchSize:       cliContext.Int(webhookBatchSizeFlag),
+			HMACSecret:      cliContext.String(webhookHMACSecretFlag),
+			SignatureHeader: cliContext.String(webhookSignatureHeaderFlag),
+			TenantId:        TenantID,
+		}
+		conf.Headers, err = parseHeaderPairs(cliContext.StringSlice(webhookHeadersFlag))
+		if err != nil {
+			return err
+		}
+		if tmpl := cliContext.String(webhookTemplateFlag); tmpl != "" {
+			if cliContext.String(webhookJMESPathFlag) != "" {
+				return fmt.Errorf("%v and %v are mutually exclusive", webhookTemplateFlag, webhookJMESPathFlag)
+			}
+			conf.Template, err = parseWebhookTemplate(tmpl)
+			if err != nil {
+				return fmt.Errorf("unable to parse webhook template: %w", err)
+			}
+		}
+		if expression := cliContext.String(webhookJMESPathFlag); expression != "" {
+			conf.Projection, err = jmespath.Compile(expression)
+			if err != nil {
+				return fmt.Errorf("unable to compile webhook projection: %w", err)
+			}
+		}
+		conf.TLS, err = loadTLSConfig(cliContext.String(webhookCAFileFlag), cliContext.Bool(webhookInsecureSkipVerifyFlag))
+		if err != nil {
+			return err
+		}
+		webhook, err := newWebhookOutput(conf)
+		if err != nil {
+			return err
+		}
+		router.add("webhook", sinkFuncs{
+			write: func(ctx context.Context, entry sinkEntry, done func(error)) error {
+				return webhook.write(ctx, entry.record, entry.line, done)
+			},
+			flush: webhook.flush,
+			close: webhook.outputBatcher.close,
+		})
+	}
+
+	if dsn := cliContext.String(databaseDSNFlag); dsn != "" {
+		database, err := newDatabaseOutput(databaseConfig{
+			Driver:   cliContext.String(databaseDriverFlag),
+			DSN:      dsn,
+			Table:    cliContext.String(databaseTableFlag),
+			TenantId: TenantID,
+		})
+		if err != nil {
+			return err
+		}
+		router.add("database", sinkFuncs{
+			write: func(ctx context.Context, entry sinkEntry, done func(error)) error {
+				return database.write(ctx, entry.record, entry.line, done)
+			},
+			flush: database.flush,
+			close: database.close,
+		})
+	}
+
+	if dir := cliContext.String(parquetDirFlag); dir != "" {
+		conf := parquetConfig{
+			Dir:      dir,
+			TenantId: TenantID,
+			MaxRows:  cliContext.Int64(parquetMaxRowsFlag),
+		}
+		if age := cliContext.String(parquetMaxAgeFlag); age != "" {
+			conf.MaxAge, err = time.ParseDuration(age)
+			if err != nil {
+				return fmt.Errorf("unable to parse duration value %v: %w", age, err)
+			}
+		}
+		parquet, err := newParquetOutput(conf)
 		if err != nil {
-			log.Printf("Error encountered attempting to parse: %v", nextPageUri)
+			return err
+		}
+		router.add("parquet", sinkFuncs{
+			write: func(ctx context.Context, entry sinkEntry, done func(error)) error {
+				return parquet.write(entry.record, entry.line, done)
+			},
+			flush: parquet.flush,
+			close: parquet.close,
+		})
+	}
+	if err := router.setDeadLetters(cliContext.String(deadLetterDirFlag), cliContext.String(deadLetterSinkFlag), TenantID); err != nil {
+		return err
+	}
+	return router.checkFilters()
+}
+func processAvailableObject(content ListAvailableContentResponse, contentUri *url.URL, group *sync.WaitGroup, retrievedcontentChannel chan auditRecord, semephorChan chan struct{}, client *ApiClient, archive *s3Archive, cliContext *cli.Context) {
+	defer group.Done()
+	//var regOpts = compileListQueryOptions(nil)
+	blob := tracker.track(content.ContentUri)
+	contentCreated, parseErr := promtail.ParseTimestamp(content.ContentCreated)
+	if parseErr != nil {
+		blobLog(content.ContentType, content.ContentId, stageFetch).Warnf("unable to parse contentCreated, its lag is not measured: %v", parseErr)
+	}
+	run := currentRun
+	blob.onComplete(func() {
+		if blob.hasFailed() {
+			run.blobFailed(content.ContentType)
 		}
+	})
+	nextPageUri := contentUri.String()
+	var err error
+	// an archive failure is listed in the manifest, it only fails the blob when the archive is required, as its records
+	// are delivered to the sinks again
+	var archiveBlob *s3BlobWriter
+	var archiveErr error
+	if archive != nil {
+		archiveBlob, archiveErr = archive.blob(cliContext.Context, content)
+	}
+	for nextPageUri != "" {
 		// semephorChan for http request concurrency limiting
 		semephorChan <- struct{}{}
 		//log.Printf("making request to uri: %v", newUrl.String())
-		req, err := http.NewRequestWithContext(cliContext.Context, http.MethodGet, newUrl.String(), nil)
+		var req *http.Request
+		req, err = http.NewRequestWithContext(cliContext.Context, http.MethodGet, nextPageUri, nil)
 		if err != nil {
-			fmt.Printf("HTTP request error: %v", err)
+			<-semephorChan
+			err = fmt.Errorf("HTTP request error: %w", err)
+			break
 		}
 		// Deal with request Headers
 		req.Header.Add("Content-Type", "application/json")
 		req.Header.Add("Authorization", client.token.GetAccessToken())
 
+		// a fresh slice per page, records of the previous page may still be in flight
+		var thisBatch []map[string]interface{}
 		nextPageUri, err = client.performRequest(req, &thisBatch)
 		<-semephorChan
+		if err != nil {
+			break
+		}
+		if archiveBlob != nil {
+			if archiveErr = archiveBlob.write(thisBatch); archiveErr != nil {
+				archiveBlob.abort(archiveErr)
+				archiveBlob = nil
+			}
+		}
+		for _, retrievedContentObject := range thisBatch {
+			blob.add()
+			retrievedcontentChannel <- auditRecord{
+				content:        retrievedContentObject,
+				contentType:    content.ContentType,
+				contentId:      content.ContentId,
+				blob:           blob,
+				contentCreated: contentCreated,
+			}
+		}
+	}
+	if archiveBlob != nil {
+		if err != nil {
+			// the blob is fetched and archived again on the next run
+			archiveBlob.abort(err)
+		} else {
+			archiveErr = archiveBlob.upload()
+			if archiveErr == nil {
+				blobsArchivedCounter.WithLabelValues(content.ContentType, resultLabel(nil)).Inc()
+			}
+		}
+	}
+	if archiveErr != nil && err == nil {
+		archiveFailed(archive, content, archiveErr)
+		if archive.config.Required {
+			blob.add()
+			blob.done(archiveErr)
+		}
 	}
 	if err != nil {
-		log.Println(err)
+		blobLog(content.ContentType, content.ContentId, stageFetch).Errorf("error encountered retrieving content %v: %v", logStringSani(content.ContentUri), err)
 	}
+	blobsFetchedCounter.WithLabelValues(content.ContentType, resultLabel(err)).Inc()
+	blob.done(err)
+}
 
-	group.Done()
+// archiveFailed reports a blob missing from the archive and lists it in the manifest of the run
+func archiveFailed(archive *s3Archive, content ListAvailableContentResponse, err error) {
+	blobLog(content.ContentType, content.ContentId, stageArchive).Errorf("the blob is missing from the archive: %v", err)
+	blobsArchivedCounter.WithLabelValues(content.ContentType, resultLabel(err)).Inc()
+	archive.failed(content, err)
 }
-func processRetrievedObject(waitGroup *sync.WaitGroup, content interface{}, fileOutput *fileOutputWrapper, useLoki bool, lokiOutput promtail.Client) {
+func processRetrievedObject(waitGroup *sync.WaitGroup, semaphorChan chan struct{}, record auditRecord, router *sinkRouter) {
 	defer waitGroup.Done()
+	defer func() { <-semaphorChan }()
 	var labels = map[string]string{}
+	var metadata = map[string]string{}
 
-	jsonObj, err := json.Marshal(&content)
-	if err != nil {
-		log.Println(err)
-	}
-	err = extractJMESLabels(jsonObj, &jmesLabels, &labels)
+	jsonObj, err := json.Marshal(record.content)
 	if err != nil {
-		log.Println(err)
-	}
-
-	if len(jsonObj) == 0 {
-		log.Printf("Encountered zero length marshalled json from object, possibly disposed before print?: %v\n", content)
+		recordLog(record, stageProcess).Errorf("unable to marshal record: %v", err)
+		router.deadLetter(record, nil, deadLetterStageMarshal, "", err, record.blob.done)
 		return
-	} else if len(jsonObj) < 20 {
-		log.Printf("Encountered zero length marshalled json from object, possibly disposed before print?: %v\n", content)
 	}
+	var data interface{} = record.content
+	// with a dead letter queue a record missing labels is kept there instead of being sent incomplete
+	err = extractJMESLabels(data, &jmesLabels, &labels)
 	if err != nil {
-		log.Print(err)
-		return
-	}
-	if useLoki {
-		//log.Println("sending to loki")
-		if err != nil {
-			log.Printf("error marshalling content object: %v", err)
+		recordLog(record, stageProcess).Warnf("unable to extract labels: %v", err)
+		if router.deadLetters != nil {
+			router.deadLetter(record, jsonObj, deadLetterStageLabels, "", err, record.blob.done)
+			return
 		}
-		lokiOutput.LogRaw(string(jsonObj), labels, promtail.INFO)
 	}
-	if fileOutput != nil {
-		//log.Println("writing to outputFile")
-		_, err := fileOutput.writeBytes(append([]byte{'\n'}, jsonObj...))
-		if err != nil {
-			log.Fatalf("failed to write to file: %v", err)
+	err = extractJMESLabels(data, &jmesMetadata, &metadata)
+	if err != nil {
+		recordLog(record, stageProcess).Warnf("unable to extract structured metadata: %v", err)
+		if router.deadLetters != nil {
+			router.deadLetter(record, jsonObj, deadLetterStageMetadata, "", err, record.blob.done)
 			return
 		}
 	}
+	ts, tsErr := extractTimestamp(data, timestampField)
+	if tsErr != nil {
+		recordLog(record, stageProcess).Debugf("unable to read record timestamp from %v, using current time: %v", timestampField, tsErr)
+	}
+
+	if len(jsonObj) < 20 {
+		recordLog(record, stageProcess).Warnf("Encountered unexpectedly short marshalled json from object: %v", record.content)
+	}
+	router.route(sinkEntry{
+		record:   record,
+		line:     jsonObj,
+		ts:       ts,
+		labels:   labels,
+		metadata: metadata,
+	})
+	recordsCounter.WithLabelValues(record.contentType).Inc()
+	record.blob.done(nil)
 }
-func (g *ApiClient) getContentForType(contentType string, debug bool, waitGroup *sync.WaitGroup, ctx context.Context) error {
+
+// getContentForType lists the content of contentType chunk by chunk in the background. A failed list is recorded in
+// the run outcome, the content type is only reported listed once all its chunks were.
+func (g *ApiClient) getContentForType(contentType string, debug bool, waitGroup *sync.WaitGroup, ctx context.Context) {
+	var chunks sync.WaitGroup
+	var failed int32
 	for i := 0; i < chunkCount; i++ {
-		waitGroup.Add(1)
+		chunks.Add(1)
 		go func(wg *sync.WaitGroup, idx int, contentType string, ctime time.Time, debug bool, ctx context.Context, availcontentChan chan ListAvailableContentResponse) {
+			defer wg.Done()
 			// add 'token' to channel to keep track of concurrency (will block if concurrency limit is met
 			//semaphorChan <- struct{}{}
 			offset := time.Duration(chunkDuration.Nanoseconds() * (int64)(idx))
@@ -489,24 +1777,36 @@ func (g *ApiClient) getContentForType(contentType string, debug bool, waitGroup
 
 			availContent, err := g.ListAvailableContent(startTime, endTime, contentType, ctx)
 			if err != nil {
-				log.Fatalln(fmt.Errorf("error encountered while attempting to list available content: %w", err))
-
+				err = fmt.Errorf("error encountered while attempting to list available content from %v to %v: %w", startTime, endTime, err)
+				blobLog(contentType, "", stageList).Error(err)
+				atomic.StoreInt32(&failed, 1)
+				currentRun.listFailed(contentType, err)
+				return
 			}
+			blobsListedCounter.WithLabelValues(contentType).Add(float64(len(availContent)))
+			currentRun.listed(contentType)
 			for _, contentResponse := range availContent {
 				if _, loaded := tracker.hashSet.GetOrInsert(contentResponse.ContentUri, currentTimeUnixString); !loaded {
 					availcontentChan <- contentResponse
 				} else {
-					log.Printf("duplicate entry found %v \n", contentResponse.ContentUri)
+					blobsDuplicateCounter.WithLabelValues(contentType).Inc()
+					blobLog(contentType, contentResponse.ContentId, stageList).Debugf("duplicate entry found %v", logStringSani(contentResponse.ContentUri))
 				}
 				// otherwise, it was already fetched
 			}
 			// remove token from semaphor to allow another to start
 			//<-semaphorChan
-
-			wg.Done()
-		}(waitGroup, i, contentType, currentTime, debug, ctx, availableContentChan)
+		}(&chunks, i, contentType, currentTime, debug, ctx, availableContentChan)
 	}
-	return nil
+	waitGroup.Add(1)
+	go func() {
+		defer waitGroup.Done()
+		chunks.Wait()
+		if atomic.LoadInt32(&failed) == 0 {
+			lastListSuccessGauge.WithLabelValues(contentType).SetToCurrentTime()
+			readiness.contentListed(contentType)
+		}
+	}()
 }
 func (g *ApiClient) ListAvailableContent(startDateTime, endDateTime time.Time, contentType string, ctx context.Context, opts ...ListQueryOption) ([]ListAvailableContentResponse, error) {
 	//resource := fmt.Sprintf("/subscriptions/content")//?contentType={ContentType}&amp;startTime={0}&amp;endTime={1}")
@@ -529,7 +1829,7 @@ func (g *ApiClient) ListAvailableContent(startDateTime, endDateTime time.Time, c
 
 	for {
 		if err != nil {
-			log.Printf("Error encountered attempting to parse: %v", logStringSani(nextPageUri))
+			blobLog(contentType, "", stageList).Errorf("Error encountered attempting to parse: %v", logStringSani(nextPageUri))
 			return nil, err
 		}
 		availableContent = append(availableContent, thisBatch...)
@@ -538,7 +1838,7 @@ func (g *ApiClient) ListAvailableContent(startDateTime, endDateTime time.Time, c
 		}
 		newUrl, err := url.Parse(nextPageUri)
 		if err != nil {
-			log.Printf("Error encountered attempting to parse: %v", nextPageUri)
+			blobLog(contentType, "", stageList).Errorf("Error encountered attempting to parse: %v", logStringSani(nextPageUri))
 			return nil, err
 		}
 		req, err := http.NewRequestWithContext(reqOpts.Context(), http.MethodGet, newUrl.String(), nil)
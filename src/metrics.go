@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	blobsListedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "o365_exporter",
+		Name:      "blobs_listed_total",
+		Help:      "Content blobs returned by the list API.",
+	}, []string{"content_type"})
+	blobsDuplicateCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "o365_exporter",
+		Name:      "blobs_duplicate_total",
+		Help:      "Listed content blobs skipped because they are in the history already.",
+	}, []string{"content_type"})
+	blobsFetchedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "o365_exporter",
+		Name:      "blobs_fetched_total",
+		Help:      "Content blobs fetched, by result: success or failure.",
+	}, []string{"content_type", "result"})
+	blobsArchivedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "o365_exporter",
+		Name:      "blobs_archived_total",
+		Help:      "Content blobs uploaded to the S3 archive, by result: success or failure.",
+	}, []string{"content_type", "result"})
+	recordsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "o365_exporter",
+		Name:      "records_total",
+		Help:      "Records processed and routed to the sinks.",
+	}, []string{"content_type"})
+	apiRequestHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "o365_exporter",
+		Name:      "api_request_duration_seconds",
+		Help:      "Duration of the requests to the Management Activity and token APIs, by endpoint and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"endpoint", "code"})
+	tokenRefreshCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "o365_exporter",
+		Name:      "token_refreshes_total",
+		Help:      "Access token refreshes, by result: success or failure.",
+	}, []string{"result"})
+	channelDepthGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "o365_exporter",
+		Name:      "channel_depth",
+		Help:      "Items waiting in the internal channels and slots in use, sampled every second during a run.",
+	}, []string{"channel"})
+	lastListSuccessGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "o365_exporter",
+		Name:      "last_list_success_timestamp_seconds",
+		Help:      "Time the content of a content type was last listed successfully.",
+	}, []string{"content_type"})
+	lastRunSuccessGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "o365_exporter",
+		Name:      "last_run_success_timestamp_seconds",
+		Help:      "Time a run last ended with every blob of a content type delivered.",
+	}, []string{"content_type"})
+)
+
+// resultLabel is the result label of an outcome
+func resultLabel(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// observeApiRequest records the duration and status of a request to the API, code is "error" when no response was received
+func observeApiRequest(req *http.Request, code string, start time.Time) {
+	endpoint := "content"
+	switch {
+	case strings.HasSuffix(req.URL.Path, "/oauth2/token"):
+		endpoint = "token"
+	case strings.HasSuffix(req.URL.Path, "/subscriptions/content"):
+		endpoint = "list"
+	}
+	apiRequestHistogram.WithLabelValues(endpoint, code).Observe(time.Since(start).Seconds())
+}
+
+// sampleChannelDepths sets the channel depth gauges every second until quit is closed
+func sampleChannelDepths(quit chan struct{}, depths map[string]func() int) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		for name, depth := range depths {
+			channelDepthGauge.WithLabelValues(name).Set(float64(depth()))
+		}
+		select {
+		case <-ticker.C:
+		case <-quit:
+			for name := range depths {
+				channelDepthGauge.WithLabelValues(name).Set(0)
+			}
+			return
+		}
+	}
+}
+
+// runOutcome follows the content types listed in a run and whether a list or a blob of theirs failed
+type runOutcome struct {
+	lock       sync.Mutex
+	failed     map[string]bool
+	listErrors []error
+}
+
+func newRunOutcome() *runOutcome {
+	return &runOutcome{failed: map[string]bool{}}
+}
+
+func (r *runOutcome) listed(contentType string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.failed[contentType]; !ok {
+		r.failed[contentType] = false
+	}
+}
+
+func (r *runOutcome) blobFailed(contentType string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.failed[contentType] = true
+}
+
+func (r *runOutcome) listFailed(contentType string, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.failed[contentType] = true
+	r.listErrors = append(r.listErrors, err)
+}
+
+// listErr is the error of the failed lists of the run, the first one wrapped
+func (r *runOutcome) listErr() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	switch len(r.listErrors) {
+	case 0:
+		return nil
+	case 1:
+		return r.listErrors[0]
+	}
+	return fmt.Errorf("%d lists failed, first: %w", len(r.listErrors), r.listErrors[0])
+}
+
+// end sets the last run success time of the content types without a failed blob
+func (r *runOutcome) end(now time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for contentType, failed := range r.failed {
+		if !failed {
+			lastRunSuccessGauge.WithLabelValues(contentType).Set(float64(now.Unix()))
+		}
+	}
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	_ "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// batch size and wait follow the defaults of the OpenTelemetry batch log record processor
+const (
+	otlpBatchSize = 512
+	otlpBatchWait = 5 * time.Second
+	otlpTimeout   = 10 * time.Second
+	otlpLogsPath  = "/v1/logs"
+	otlpExport    = "/opentelemetry.proto.collector.logs.v1.LogsService/Export"
+)
+
+// severity numbers of the OpenTelemetry log data model
+const (
+	otlpSeverityInfo = 9
+	otlpSeverityWarn = 13
+)
+
+type otlpConfig struct {
+	// Endpoint is the collector URL for http/protobuf, /v1/logs is appended when it has no path, or host:port for grpc
+	Endpoint string
+	// Protocol is http/protobuf or grpc
+	Protocol string
+	Headers  map[string]string
+	// Compression is gzip or none
+	Compression string
+	TenantId    string
+	TLS         *tls.Config
+	// Insecure connects to a grpc endpoint without TLS
+	Insecure   bool
+	MaxRetries int
+}
+
+// otlpOutput exports records as OTLP log records. Every content type has its own batcher so an export request holds
+// one ResourceLogs per content type, carrying the tenant and content type as resource attributes.
+//
+// The request is encoded here following the opentelemetry-proto logs and collector messages:
+//
+//	ExportLogsServiceRequest { repeated ResourceLogs resource_logs = 1; }
+//	ResourceLogs  { Resource resource = 1; repeated ScopeLogs scope_logs = 2; }
+//	Resource      { repeated KeyValue attributes = 1; }
+//	ScopeLogs     { InstrumentationScope scope = 1; repeated LogRecord log_records = 2; }
+//	LogRecord     { fixed64 time_unix_nano = 1; fixed64 observed_time_unix_nano = 11; SeverityNumber severity_number = 2;
+//	                string severity_text = 3; AnyValue body = 5; repeated KeyValue attributes = 6; }
+//	KeyValue      { string key = 1; AnyValue value = 2; }
+//	AnyValue      { oneof value { string string_value = 1; bool bool_value = 2; int64 int_value = 3; double double_value = 4;
+//	                ArrayValue array_value = 5; KeyValueList kvlist_value = 6; } }
+type otlpOutput struct {
+	config otlpConfig
+	client http.Client
+	url    string
+	conn   *grpc.ClientConn
+	// ctx bounds every export, close cancels it once its own context is done so a hanging export gives up
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	batchersLock sync.Mutex
+	batchers     map[string]*outputBatcher
+	closed       bool
+}
+
+func newOtlpOutput(config otlpConfig) (*otlpOutput, error) {
+	switch config.Compression {
+	case "gzip", "none":
+	default:
+		return nil, fmt.Errorf("unknown OTLP compression %q, expected gzip or none", config.Compression)
+	}
+	o := &otlpOutput{config: config, batchers: map[string]*outputBatcher{}}
+	o.ctx, o.cancel = context.WithCancel(context.Background())
+	switch config.Protocol {
+	case "http/protobuf":
+		endpoint, err := url.Parse(config.Endpoint)
+		if err != nil {
+			o.cancel()
+			return nil, fmt.Errorf("unable to parse OTLP endpoint: %w", err)
+		}
+		if endpoint.Path == "" || endpoint.Path == "/" {
+			endpoint.Path = otlpLogsPath
+		}
+		o.url = endpoint.String()
+		o.client = http.Client{Timeout: otlpTimeout, Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: config.TLS}}
+	case "grpc":
+		creds := insecure.NewCredentials()
+		if !config.Insecure {
+			tlsConfig := config.TLS
+			if tlsConfig == nil {
+				tlsConfig = &tls.Config{}
+			}
+			creds = credentials.NewTLS(tlsConfig)
+		}
+		conn, err := grpc.Dial(config.Endpoint, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			o.cancel()
+			return nil, fmt.Errorf("unable to connect to the OTLP endpoint: %w", err)
+		}
+		o.conn = conn
+	default:
+		o.cancel()
+		return nil, fmt.Errorf("unknown OTLP protocol %q, expected http/protobuf or grpc", config.Protocol)
+	}
+	return o, nil
+}
+
+// write queues the record as a log record timestamped with ts
+func (o *otlpOutput) write(ctx context.Context, record auditRecord, ts time.Time, done func(error)) error {
+	batcher, err := o.batcher(record.contentType)
+	if err != nil {
+		return err
+	}
+	return batcher.add(ctx, encodeOtlpLogRecord(record, ts), done)
+}
+
+func (o *otlpOutput) batcher(contentType string) (*outputBatcher, error) {
+	o.batchersLock.Lock()
+	defer o.batchersLock.Unlock()
+	if o.closed {
+		return nil, errOutputClosed
+	}
+	batcher, ok := o.batchers[contentType]
+	if !ok {
+		batcher = newOutputBatcher(otlpBatchSize, otlpBatchWait, func(batch []batchItem) { o.send(contentType, batch, batcher.quit) })
+		o.batchers[contentType] = batcher
+	}
+	return batcher, nil
+}
+
+// flush sends the records queued so far
+func (o *otlpOutput) flush(ctx context.Context) error {
+	o.batchersLock.Lock()
+	batchers := make([]*outputBatcher, 0, len(o.batchers))
+	for _, batcher := range o.batchers {
+		batchers = append(batchers, batcher)
+	}
+	o.batchersLock.Unlock()
+	for _, batcher := range batchers {
+		if err := batcher.flush(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close sends the remaining records and closes the grpc connection, an export still running when ctx is done is
+// aborted
+func (o *otlpOutput) close(ctx context.Context) error {
+	o.batchersLock.Lock()
+	o.closed = true
+	o.batchersLock.Unlock()
+	defer o.cancel()
+	go func() {
+		select {
+		case <-ctx.Done():
+			o.cancel()
+		case <-o.ctx.Done():
+		}
+	}()
+	var err error
+	for _, batcher := range o.batchers {
+		if closeErr := batcher.close(ctx); closeErr != nil {
+			err = closeErr
+		}
+	}
+	if err == nil && o.conn != nil {
+		err = o.conn.Close()
+	}
+	return err
+}
+
+func (o *otlpOutput) send(contentType string, batch []batchItem, quit <-chan struct{}) {
+	request := o.encodeRequest(contentType, batch)
+	err := retryWithBackoff(quit, o.config.MaxRetries, "otlp", func() (bool, error) {
+		if o.conn != nil {
+			return o.exportGrpc(request, quit)
+		}
+		return o.exportHttp(request, quit)
+	})
+	if err != nil {
+		sinkLog("otlp").Errorf("dropping %d log records: %v", len(batch), err)
+	}
+	resolveBatch(batch, err)
+}
+
+// exportHttp posts the request, 429, 502, 503 and 504 are retried after the Retry-After delay if the collector sent one
+func (o *otlpOutput) exportHttp(request []byte, quit <-chan struct{}) (bool, error) {
+	body := request
+	if o.config.Compression == "gzip" {
+		var buf bytes.Buffer
+		writer := gzip.NewWriter(&buf)
+		if _, err := writer.Write(request); err != nil {
+			return false, err
+		}
+		if err := writer.Close(); err != nil {
+			return false, err
+		}
+		body = buf.Bytes()
+	}
+	ctx, cancel := context.WithTimeout(o.ctx, otlpTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	if o.config.Compression == "gzip" {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	for key, value := range o.config.Headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		// not retried once aborted by close
+		return o.ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+	resBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return true, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		logOtlpPartialSuccess(resBody)
+		return false, nil
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			o.waitRetryDelay(time.Duration(seconds)*time.Second, quit)
+		}
+		return true, fmt.Errorf("unexpected HTTP status code: %d", resp.StatusCode)
+	}
+	return false, fmt.Errorf("unexpected HTTP status code: %d, message: %s", resp.StatusCode, resBody)
+}
+
+// exportGrpc calls LogsService/Export, retrying the status codes the OTLP specification lists as retryable after the
+// RetryInfo delay if the collector sent one
+func (o *otlpOutput) exportGrpc(request []byte, quit <-chan struct{}) (bool, error) {
+	ctx, cancel := context.WithTimeout(o.ctx, otlpTimeout)
+	defer cancel()
+	if len(o.config.Headers) > 0 {
+		ctx = metadata.NewOutgoingContext(ctx, metadata.New(o.config.Headers))
+	}
+	options := []grpc.CallOption{grpc.ForceCodec(otlpRawCodec{})}
+	if o.config.Compression == "gzip" {
+		options = append(options, grpc.UseCompressor("gzip"))
+	}
+	var response []byte
+	err := o.conn.Invoke(ctx, otlpExport, &request, &response, options...)
+	if err == nil {
+		logOtlpPartialSuccess(response)
+		return false, nil
+	}
+	if o.ctx.Err() != nil {
+		// aborted by close
+		return false, err
+	}
+	st := status.Convert(err)
+	var retryInfo *errdetails.RetryInfo
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok {
+			retryInfo = info
+		}
+	}
+	switch st.Code() {
+	case codes.Canceled, codes.DeadlineExceeded, codes.Aborted, codes.OutOfRange, codes.Unavailable, codes.DataLoss:
+	case codes.ResourceExhausted:
+		// only retryable when the collector says it can recover
+		if retryInfo == nil {
+			return false, err
+		}
+	default:
+		return false, err
+	}
+	if retryInfo != nil && retryInfo.RetryDelay != nil {
+		o.waitRetryDelay(retryInfo.RetryDelay.AsDuration(), quit)
+	}
+	return true, err
+}
+
+// waitRetryDelay waits the delay a collector asked for, at most outputMaxBackoff and not beyond shutdown
+func (o *otlpOutput) waitRetryDelay(delay time.Duration, quit <-chan struct{}) {
+	if delay <= 0 {
+		return
+	}
+	if delay > outputMaxBackoff {
+		delay = outputMaxBackoff
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-quit:
+	case <-o.ctx.Done():
+	}
+}
+
+// logOtlpPartialSuccess logs the records an accepted export request rejected:
+//
+//	ExportLogsServiceResponse { ExportLogsPartialSuccess partial_success = 1; }
+//	ExportLogsPartialSuccess  { int64 rejected_log_records = 1; string error_message = 2; }
+func logOtlpPartialSuccess(response []byte) {
+	partial := protoField(response, 1)
+	if partial == nil {
+		return
+	}
+	var rejected uint64
+	if value := protoField(partial, 1); value != nil {
+		rejected, _ = protowire.ConsumeVarint(value)
+	}
+	message := string(protoField(partial, 2))
+	if rejected > 0 || message != "" {
+		sinkLog("otlp").Warnf("collector rejected %d log records: %v", rejected, message)
+	}
+}
+
+// protoField returns the raw value of the last occurrence of a varint or length delimited field, nil when absent
+func protoField(message []byte, field protowire.Number) []byte {
+	var found []byte
+	for len(message) > 0 {
+		number, wireType, n := protowire.ConsumeTag(message)
+		if n < 0 {
+			return found
+		}
+		message = message[n:]
+		switch wireType {
+		case protowire.BytesType:
+			value, m := protowire.ConsumeBytes(message)
+			if m < 0 {
+				return found
+			}
+			if number == field {
+				found = value
+			}
+			n = m
+		default:
+			n = protowire.ConsumeFieldValue(number, wireType, message)
+			if n < 0 {
+				return found
+			}
+			if number == field && wireType == protowire.VarintType {
+				found = message[:n]
+			}
+		}
+		message = message[n:]
+	}
+	return found
+}
+
+// otlpRawCodec passes already encoded protobuf messages to grpc
+type otlpRawCodec struct{}
+
+func (otlpRawCodec) Marshal(v interface{}) ([]byte, error) {
+	message, ok := v.(*[]byte)
+	if !ok {
+		return nil, fmt.Errorf("unexpected message type %T", v)
+	}
+	return *message, nil
+}
+
+func (otlpRawCodec) Unmarshal(data []byte, v interface{}) error {
+	message, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", v)
+	}
+	*message = append((*message)[:0], data...)
+	return nil
+}
+
+func (otlpRawCodec) Name() string {
+	return "proto"
+}
+
+// encodeRequest wraps the encoded log records of a batch in a single ResourceLogs of their content type
+func (o *otlpOutput) encodeRequest(contentType string, batch []batchItem) []byte {
+	var resource []byte
+	for _, attribute := range [][2]string{
+		{"service.name", "o365LogExporter"},
+		{"o365.tenant_id", o.config.TenantId},
+		{"o365.content_type", contentType},
+	} {
+		resource = appendOtlpMessage(resource, 1, otlpKeyValue(attribute[0], otlpAnyValue(attribute[1])))
+	}
+
+	var scope []byte
+	scope = protowire.AppendTag(scope, 1, protowire.BytesType)
+	scope = protowire.AppendString(scope, "o365LogExporter")
+
+	var scopeLogs []byte
+	scopeLogs = appendOtlpMessage(scopeLogs, 1, scope)
+	for _, item := range batch {
+		scopeLogs = appendOtlpMessage(scopeLogs, 2, item.payload)
+	}
+
+	var resourceLogs []byte
+	resourceLogs = appendOtlpMessage(resourceLogs, 1, resource)
+	resourceLogs = appendOtlpMessage(resourceLogs, 2, scopeLogs)
+	return appendOtlpMessage(nil, 1, resourceLogs)
+}
+
+// encodeOtlpLogRecord maps a record to a LogRecord with the full record as structured body
+func encodeOtlpLogRecord(record auditRecord, ts time.Time) []byte {
+	severity, severityText := uint64(otlpSeverityInfo), "INFO"
+	switch strings.ToLower(recordField(record.content, "ResultStatus")) {
+	case "failed", "failure", "false":
+		severity, severityText = otlpSeverityWarn, "WARN"
+	}
+
+	var buf []byte
+	if !ts.IsZero() {
+		buf = protowire.AppendTag(buf, 1, protowire.Fixed64Type)
+		buf = protowire.AppendFixed64(buf, uint64(ts.UnixNano()))
+	}
+	buf = protowire.AppendTag(buf, 11, protowire.Fixed64Type)
+	buf = protowire.AppendFixed64(buf, uint64(time.Now().UnixNano()))
+	buf = protowire.AppendTag(buf, 2, protowire.VarintType)
+	buf = protowire.AppendVarint(buf, severity)
+	buf = protowire.AppendTag(buf, 3, protowire.BytesType)
+	buf = protowire.AppendString(buf, severityText)
+	buf = appendOtlpMessage(buf, 5, otlpAnyValue(record.content))
+	for _, attribute := range [][2]string{
+		{"o365.workload", recordField(record.content, "Workload")},
+		{"o365.operation", recordField(record.content, "Operation")},
+		{"o365.content_id", record.contentId},
+	} {
+		if attribute[1] != "" {
+			buf = appendOtlpMessage(buf, 6, otlpKeyValue(attribute[0], otlpAnyValue(attribute[1])))
+		}
+	}
+	return buf
+}
+
+func appendOtlpMessage(buf []byte, field protowire.Number, message []byte) []byte {
+	buf = protowire.AppendTag(buf, field, protowire.BytesType)
+	return protowire.AppendBytes(buf, message)
+}
+
+func otlpKeyValue(key string, value []byte) []byte {
+	var buf []byte
+	buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+	buf = protowire.AppendString(buf, key)
+	return appendOtlpMessage(buf, 2, value)
+}
+
+// otlpAnyValue encodes a decoded JSON value, integral numbers become int_value
+func otlpAnyValue(value interface{}) []byte {
+	var buf []byte
+	switch v := value.(type) {
+	case string:
+		buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+		buf = protowire.AppendString(buf, v)
+	case bool:
+		buf = protowire.AppendTag(buf, 2, protowire.VarintType)
+		buf = protowire.AppendVarint(buf, protowire.EncodeBool(v))
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<63 {
+			buf = protowire.AppendTag(buf, 3, protowire.VarintType)
+			buf = protowire.AppendVarint(buf, uint64(int64(v)))
+		} else {
+			buf = protowire.AppendTag(buf, 4, protowire.Fixed64Type)
+			buf = protowire.AppendFixed64(buf, math.Float64bits(v))
+		}
+	case []interface{}:
+		var array []byte
+		for _, element := range v {
+			array = appendOtlpMessage(array, 1, otlpAnyValue(element))
+		}
+		buf = appendOtlpMessage(buf, 5, array)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		var list []byte
+		for _, key := range keys {
+			list = appendOtlpMessage(list, 1, otlpKeyValue(key, otlpAnyValue(v[key])))
+		}
+		buf = appendOtlpMessage(buf, 6, list)
+	case nil:
+		// an empty AnyValue is the null value
+	default:
+		buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+		buf = protowire.AppendString(buf, fmt.Sprint(v))
+	}
+	return buf
+}
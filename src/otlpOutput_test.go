@@ -0,0 +1,281 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func otlpString(value string) *commonpb.AnyValue {
+	return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}
+}
+
+func otlpAttributes(pairs ...string) []*commonpb.KeyValue {
+	var attributes []*commonpb.KeyValue
+	for i := 0; i < len(pairs); i += 2 {
+		attributes = append(attributes, &commonpb.KeyValue{Key: pairs[i], Value: otlpString(pairs[i+1])})
+	}
+	return attributes
+}
+
+// sendOtlp sends one batch of a record through the output and returns what it was resolved with
+func sendOtlp(o *otlpOutput, quit chan struct{}) error {
+	record := auditRecord{content: map[string]interface{}{"Id": "1"}, contentType: "Audit.General"}
+	var result error
+	o.send("Audit.General", []batchItem{{payload: encodeOtlpLogRecord(record, time.Now()), done: func(err error) { result = err }}}, quit)
+	return result
+}
+
+func TestOtlpRequestDecodesWithUpstreamTypes(t *testing.T) {
+	o := &otlpOutput{config: otlpConfig{TenantId: "tenant1"}}
+	ts := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+	record := auditRecord{
+		content: map[string]interface{}{
+			"Id": "1", "Operation": "UserLoggedIn", "Workload": "AzureActiveDirectory", "ResultStatus": "Failed",
+			"Count": float64(3), "Ratio": 0.5, "Ok": true, "Nothing": nil,
+			"Targets": []interface{}{map[string]interface{}{"Type": float64(1)}},
+		},
+		contentType: "Audit.AzureActiveDirectory",
+		contentId:   "blob1",
+	}
+	encoded := o.encodeRequest(record.contentType, []batchItem{{payload: encodeOtlpLogRecord(record, ts)}})
+
+	var request collogspb.ExportLogsServiceRequest
+	if err := proto.Unmarshal(encoded, &request); err != nil {
+		t.Fatal(err)
+	}
+	if len(request.ResourceLogs) != 1 || len(request.ResourceLogs[0].ScopeLogs) != 1 {
+		t.Fatalf("request = %v, want a single ResourceLogs with a single ScopeLogs", &request)
+	}
+	resource := request.ResourceLogs[0].Resource
+	wantResource := otlpAttributes("service.name", "o365LogExporter", "o365.tenant_id", "tenant1", "o365.content_type", "Audit.AzureActiveDirectory")
+	if !proto.Equal(resource, &resourcepb.Resource{Attributes: wantResource}) {
+		t.Errorf("resource = %v, want %v", resource, wantResource)
+	}
+	scopeLogs := request.ResourceLogs[0].ScopeLogs[0]
+	if scopeLogs.Scope.GetName() != "o365LogExporter" {
+		t.Errorf("scope = %v, want o365LogExporter", scopeLogs.Scope)
+	}
+	if len(scopeLogs.LogRecords) != 1 {
+		t.Fatalf("%d log records, want 1", len(scopeLogs.LogRecords))
+	}
+
+	got := scopeLogs.LogRecords[0]
+	if got.ObservedTimeUnixNano == 0 {
+		t.Error("observed time is not set")
+	}
+	got.ObservedTimeUnixNano = 0
+	kv := func(key string, value *commonpb.AnyValue) *commonpb.KeyValue {
+		return &commonpb.KeyValue{Key: key, Value: value}
+	}
+	want := &logspb.LogRecord{
+		TimeUnixNano:   uint64(ts.UnixNano()),
+		SeverityNumber: logspb.SeverityNumber_SEVERITY_NUMBER_WARN,
+		SeverityText:   "WARN",
+		Body: &commonpb.AnyValue{Value: &commonpb.AnyValue_KvlistValue{KvlistValue: &commonpb.KeyValueList{Values: []*commonpb.KeyValue{
+			kv("Count", &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: 3}}),
+			kv("Id", otlpString("1")),
+			kv("Nothing", &commonpb.AnyValue{}),
+			kv("Ok", &commonpb.AnyValue{Value: &commonpb.AnyValue_BoolValue{BoolValue: true}}),
+			kv("Operation", otlpString("UserLoggedIn")),
+			kv("Ratio", &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: 0.5}}),
+			kv("ResultStatus", otlpString("Failed")),
+			kv("Targets", &commonpb.AnyValue{Value: &commonpb.AnyValue_ArrayValue{ArrayValue: &commonpb.ArrayValue{Values: []*commonpb.AnyValue{
+				{Value: &commonpb.AnyValue_KvlistValue{KvlistValue: &commonpb.KeyValueList{Values: []*commonpb.KeyValue{
+					kv("Type", &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: 1}}),
+				}}}},
+			}}}}),
+			kv("Workload", otlpString("AzureActiveDirectory")),
+		}}}},
+		Attributes: otlpAttributes("o365.workload", "AzureActiveDirectory", "o365.operation", "UserLoggedIn", "o365.content_id", "blob1"),
+	}
+	if !proto.Equal(got, want) {
+		t.Errorf("log record = %v\nwant %v", got, want)
+	}
+}
+
+func TestOtlpHttpRetryClassification(t *testing.T) {
+	tests := []struct {
+		name      string
+		statuses  []int
+		wantPosts int
+		wantErr   bool
+	}{
+		{name: "accepted", statuses: []int{http.StatusOK}, wantPosts: 1},
+		{name: "unavailable is retried", statuses: []int{http.StatusServiceUnavailable, http.StatusOK}, wantPosts: 2},
+		{name: "throttled is retried", statuses: []int{http.StatusTooManyRequests, http.StatusOK}, wantPosts: 2},
+		{name: "bad request is not retried", statuses: []int{http.StatusBadRequest}, wantPosts: 1, wantErr: true},
+		{name: "internal error is not retried", statuses: []int{http.StatusInternalServerError}, wantPosts: 1, wantErr: true},
+		{name: "retries run out", statuses: []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway}, wantPosts: 2, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var lock sync.Mutex
+			posts := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != otlpLogsPath || r.Header.Get("Content-Type") != "application/x-protobuf" {
+					http.Error(w, "unexpected request", http.StatusNotFound)
+					return
+				}
+				reader, err := gzip.NewReader(r.Body)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				body, err := ioutil.ReadAll(reader)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				var request collogspb.ExportLogsServiceRequest
+				if err := proto.Unmarshal(body, &request); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				lock.Lock()
+				code := tt.statuses[posts]
+				posts++
+				lock.Unlock()
+				w.WriteHeader(code)
+			}))
+			defer server.Close()
+			o, err := newOtlpOutput(otlpConfig{Endpoint: server.URL, Protocol: "http/protobuf", Compression: "gzip", MaxRetries: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = sendOtlp(o, make(chan struct{}))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want an error: %v", err, tt.wantErr)
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			if posts != tt.wantPosts {
+				t.Errorf("%d posts, want %d", posts, tt.wantPosts)
+			}
+		})
+	}
+}
+
+// fakeLogsService answers the exports with failures before accepting them, or blocks them when block is set
+type fakeLogsService struct {
+	collogspb.UnimplementedLogsServiceServer
+	lock     sync.Mutex
+	failures []error
+	calls    int
+	block    bool
+}
+
+func (s *fakeLogsService) Export(ctx context.Context, request *collogspb.ExportLogsServiceRequest) (*collogspb.ExportLogsServiceResponse, error) {
+	s.lock.Lock()
+	s.calls++
+	if s.block {
+		s.lock.Unlock()
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	defer s.lock.Unlock()
+	if len(s.failures) > 0 {
+		err := s.failures[0]
+		s.failures = s.failures[1:]
+		return nil, err
+	}
+	return &collogspb.ExportLogsServiceResponse{}, nil
+}
+
+func newFakeCollector(t *testing.T, service *fakeLogsService) *otlpOutput {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	collogspb.RegisterLogsServiceServer(server, service)
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+	o, err := newOtlpOutput(otlpConfig{Endpoint: listener.Addr().String(), Protocol: "grpc", Compression: "gzip", Insecure: true, MaxRetries: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = o.conn.Close() })
+	return o
+}
+
+func TestOtlpGrpcRetryClassification(t *testing.T) {
+	retryInfo, err := status.New(codes.ResourceExhausted, "slow down").WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		failures  []error
+		wantCalls int
+		wantErr   bool
+		// minDuration is the least the send takes, the delay of the RetryInfo
+		minDuration time.Duration
+	}{
+		{name: "accepted", wantCalls: 1},
+		{name: "unavailable is retried", failures: []error{status.Error(codes.Unavailable, "down")}, wantCalls: 2},
+		{name: "exhausted without retry info is not retried", failures: []error{status.Error(codes.ResourceExhausted, "too big")}, wantCalls: 1, wantErr: true},
+		{name: "exhausted with retry info waits its delay", failures: []error{retryInfo.Err()}, wantCalls: 2, minDuration: time.Second},
+		{name: "invalid argument is not retried", failures: []error{status.Error(codes.InvalidArgument, "bad")}, wantCalls: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := &fakeLogsService{failures: tt.failures}
+			o := newFakeCollector(t, service)
+			start := time.Now()
+			err := sendOtlp(o, make(chan struct{}))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want an error: %v", err, tt.wantErr)
+			}
+			if elapsed := time.Since(start); elapsed < tt.minDuration {
+				t.Errorf("retried after %v, want at least %v", elapsed, tt.minDuration)
+			}
+			service.lock.Lock()
+			defer service.lock.Unlock()
+			if service.calls != tt.wantCalls {
+				t.Errorf("%d calls, want %d", service.calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestOtlpCloseAbortsHangingExport(t *testing.T) {
+	service := &fakeLogsService{block: true}
+	o := newFakeCollector(t, service)
+	resolved := make(chan error, 1)
+	record := auditRecord{content: map[string]interface{}{"Id": "1"}, contentType: "Audit.General"}
+	if err := o.write(context.Background(), record, time.Now(), func(err error) { resolved <- err }); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := o.close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("close returned %v, want the deadline of its context", err)
+	}
+	select {
+	case err := <-resolved:
+		if err == nil {
+			t.Error("the aborted record was resolved as delivered")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the export was not aborted by close")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"o365logexporter/promtail-client/promtail"
+	"sync"
+	"time"
+)
+
+var errOutputClosed = errors.New("output is closed")
+
+// batchItem is one encoded record waiting in an outputBatcher
+type batchItem struct {
+	payload []byte
+	done    func(error)
+	// flushed marks a flush request instead of a record
+	flushed chan struct{}
+}
+
+// outputBatcher collects records for an output and hands them to send in batches of batchSize, or whatever
+// arrived within batchWait. send runs on a single goroutine, so batches are delivered in order, and it is
+// responsible for calling the done callbacks of the batch.
+type outputBatcher struct {
+	items     chan batchItem
+	quit      chan struct{}
+	closeOnce sync.Once
+	waitGroup sync.WaitGroup
+	batchSize int
+	batchWait time.Duration
+	send      func(batch []batchItem)
+}
+
+func newOutputBatcher(batchSize int, batchWait time.Duration, send func(batch []batchItem)) *outputBatcher {
+	b := &outputBatcher{
+		items:     make(chan batchItem, batchSize*2),
+		quit:      make(chan struct{}),
+		batchSize: batchSize,
+		batchWait: batchWait,
+		send:      send,
+	}
+	b.waitGroup.Add(1)
+	go b.run()
+	return b
+}
+
+// add queues a record, blocking while the output is saturated
+func (b *outputBatcher) add(ctx context.Context, payload []byte, done func(error)) error {
+	select {
+	case <-b.quit:
+		return errOutputClosed
+	default:
+	}
+	select {
+	case b.items <- batchItem{payload: payload, done: done}:
+		return nil
+	case <-b.quit:
+		return errOutputClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// flush sends everything queued so far and waits for it
+func (b *outputBatcher) flush(ctx context.Context) error {
+	flushed := make(chan struct{})
+	select {
+	case b.items <- batchItem{flushed: flushed}:
+	case <-b.quit:
+		return errOutputClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// close sends the remaining records and stops the batcher
+func (b *outputBatcher) close(ctx context.Context) error {
+	b.closeOnce.Do(func() { close(b.quit) })
+	return promtail.WaitGroupContext(ctx, &b.waitGroup)
+}
+
+func (b *outputBatcher) run() {
+	var batch []batchItem
+	maxWait := time.NewTimer(b.batchWait)
+	defer func() {
+		// pick up whatever was queued while shutting down
+		var flushed []chan struct{}
+		for {
+			select {
+			case item := <-b.items:
+				if item.flushed != nil {
+					flushed = append(flushed, item.flushed)
+					continue
+				}
+				batch = append(batch, item)
+				continue
+			default:
+			}
+			break
+		}
+		if len(batch) > 0 {
+			b.send(batch)
+		}
+		for _, marker := range flushed {
+			close(marker)
+		}
+		b.waitGroup.Done()
+	}()
+	for {
+		select {
+		case <-b.quit:
+			return
+		case item := <-b.items:
+			if item.flushed != nil {
+				if len(batch) > 0 {
+					b.send(batch)
+					batch = nil
+				}
+				close(item.flushed)
+				maxWait.Reset(b.batchWait)
+				continue
+			}
+			batch = append(batch, item)
+			if len(batch) >= b.batchSize {
+				b.send(batch)
+				batch = nil
+				maxWait.Reset(b.batchWait)
+			}
+		case <-maxWait.C:
+			if len(batch) > 0 {
+				b.send(batch)
+				batch = nil
+			}
+			maxWait.Reset(b.batchWait)
+		}
+	}
+}
+
+// resolveBatch reports the outcome of a batch to its records
+func resolveBatch(batch []batchItem, err error) {
+	for _, item := range batch {
+		if item.done != nil {
+			item.done(err)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/xitongsys/parquet-go/writer"
+	"o365logexporter/promtail-client/promtail"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// parquetWriters is the number of goroutines encoding a row group
+	parquetWriters  = 4
+	parquetRollTick = 30 * time.Second
+)
+
+// parquetPromoted are the record fields stored as columns, the others go to the extra JSON column
+var parquetPromoted = map[string]bool{
+	"Id": true, "CreationTime": true, "RecordType": true, "Operation": true, "OrganizationId": true, "UserType": true,
+	"UserKey": true, "UserId": true, "Workload": true, "ResultStatus": true, "ObjectId": true, "ClientIP": true,
+}
+
+// parquetRow is the file schema. Tenant, content type and date are not stored, they are the Hive partition of the file.
+type parquetRow struct {
+	Id             *string `parquet:"name=id, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	CreationTime   *int64  `parquet:"name=creation_time, type=INT64, convertedtype=TIMESTAMP_MILLIS, repetitiontype=OPTIONAL"`
+	RecordType     *int32  `parquet:"name=record_type, type=INT32, repetitiontype=OPTIONAL"`
+	Operation      *string `parquet:"name=operation, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	OrganizationId *string `parquet:"name=organization_id, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	UserType       *int32  `parquet:"name=user_type, type=INT32, repetitiontype=OPTIONAL"`
+	UserKey        *string `parquet:"name=user_key, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	UserId         *string `parquet:"name=user_id, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	Workload       *string `parquet:"name=workload, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	ResultStatus   *string `parquet:"name=result_status, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	ObjectId       *string `parquet:"name=object_id, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	ClientIP       *string `parquet:"name=client_ip, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	ContentId      string  `parquet:"name=content_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Extra          string  `parquet:"name=extra, type=BYTE_ARRAY, convertedtype=JSON"`
+}
+
+type parquetConfig struct {
+	// Dir is the root of the partition directories
+	Dir      string
+	TenantId string
+	// MaxRows and MaxAge roll a file once it holds MaxRows rows or was opened MaxAge ago, zero disables either
+	MaxRows int64
+	MaxAge  time.Duration
+}
+
+// parquetFile is a file being written. It is named with a leading dot, which Spark and DuckDB skip, until it is complete.
+type parquetFile struct {
+	path    string
+	file    *os.File
+	buffer  *bufio.Writer
+	writer  *writer.ParquetWriter
+	rows    int64
+	opened  time.Time
+	pending []func(error)
+}
+
+// parquetOutput writes records to Parquet files under Dir/tenant=<tenant>/content_type=<type>/date=<creation date>/.
+// A record is only resolved once the file holding it is complete, flush completes every open file.
+type parquetOutput struct {
+	config    parquetConfig
+	lock      sync.Mutex
+	files     map[string]*parquetFile
+	sequence  int
+	quit      chan struct{}
+	closeOnce sync.Once
+	waitGroup sync.WaitGroup
+}
+
+func newParquetOutput(config parquetConfig) (*parquetOutput, error) {
+	if err := os.MkdirAll(config.Dir, 0750); err != nil {
+		return nil, err
+	}
+	p := &parquetOutput{config: config, files: map[string]*parquetFile{}, quit: make(chan struct{})}
+	if config.MaxAge > 0 {
+		p.waitGroup.Add(1)
+		go p.rollAged()
+	}
+	return p, nil
+}
+
+// write appends the record to the file of its partition
+func (p *parquetOutput) write(record auditRecord, line []byte, done func(error)) error {
+	row, date, err := newParquetRow(record, line)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(p.config.Dir, "tenant="+p.config.TenantId, "content_type="+record.contentType, "date="+date)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	file, ok := p.files[dir]
+	if !ok {
+		file, err = p.open(dir)
+		if err != nil {
+			return err
+		}
+		p.files[dir] = file
+	}
+	if err := file.writer.Write(row); err != nil {
+		// the file cannot be trusted anymore, fail what it holds
+		p.discard(dir, file, err)
+		return err
+	}
+	file.rows++
+	file.pending = append(file.pending, done)
+	if p.config.MaxRows > 0 && file.rows >= p.config.MaxRows {
+		p.complete(dir, file)
+	}
+	return nil
+}
+
+func (p *parquetOutput) open(dir string) (*parquetFile, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	p.sequence++
+	now := time.Now()
+	name := fmt.Sprintf("part-%s-%05d.parquet", now.UTC().Format("20060102T150405"), p.sequence)
+	path := filepath.Join(dir, name)
+	file, err := os.OpenFile(filepath.Join(dir, "."+name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return nil, err
+	}
+	buffer := bufio.NewWriterSize(file, 1024*1024)
+	pw, err := writer.NewParquetWriterFromWriter(buffer, new(parquetRow), parquetWriters)
+	if err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return nil, err
+	}
+	return &parquetFile{path: path, file: file, buffer: buffer, writer: pw, opened: now}, nil
+}
+
+// complete writes the footer, renames the file to its final name and resolves its records
+func (p *parquetOutput) complete(dir string, file *parquetFile) {
+	delete(p.files, dir)
+	err := file.writer.WriteStop()
+	if err == nil {
+		err = file.buffer.Flush()
+	}
+	if err == nil {
+		err = file.file.Sync()
+	}
+	if closeErr := file.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.file.Name(), file.path)
+	}
+	if err != nil {
+		sinkLog("parquet").Errorf("unable to complete %v: %v", file.path, err)
+		_ = os.Remove(file.file.Name())
+	}
+	for _, done := range file.pending {
+		done(err)
+	}
+}
+
+func (p *parquetOutput) discard(dir string, file *parquetFile, err error) {
+	delete(p.files, dir)
+	sinkLog("parquet").Errorf("discarding %v: %v", file.path, err)
+	_ = file.file.Close()
+	_ = os.Remove(file.file.Name())
+	for _, done := range file.pending {
+		done(err)
+	}
+}
+
+// rollAged completes the files older than MaxAge until close
+func (p *parquetOutput) rollAged() {
+	defer p.waitGroup.Done()
+	ticker := time.NewTicker(parquetRollTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.lock.Lock()
+			for dir, file := range p.files {
+				if time.Since(file.opened) >= p.config.MaxAge {
+					p.complete(dir, file)
+				}
+			}
+			p.lock.Unlock()
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+// flush completes every open file
+func (p *parquetOutput) flush(ctx context.Context) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for dir, file := range p.files {
+		p.complete(dir, file)
+	}
+	return nil
+}
+
+// close completes the open files and stops rolling
+func (p *parquetOutput) close(ctx context.Context) error {
+	p.closeOnce.Do(func() { close(p.quit) })
+	if err := promtail.WaitGroupContext(ctx, &p.waitGroup); err != nil {
+		return err
+	}
+	return p.flush(ctx)
+}
+
+// newParquetRow maps a record to a row, returning the date partition taken from its creation time
+func newParquetRow(record auditRecord, line []byte) (*parquetRow, string, error) {
+	common := newDatabaseRow(record, "", line)
+	extra := map[string]interface{}{}
+	for name, value := range record.content {
+		if !parquetPromoted[name] {
+			extra[name] = value
+		}
+	}
+	extraJson, err := json.Marshal(extra)
+	if err != nil {
+		return nil, "", err
+	}
+	row := &parquetRow{
+		Id:             common.Id,
+		RecordType:     parquetInt32(common.RecordType),
+		Operation:      common.Operation,
+		OrganizationId: common.OrganizationId,
+		UserType:       parquetInt32(common.UserType),
+		UserKey:        common.UserKey,
+		UserId:         common.UserId,
+		Workload:       common.Workload,
+		ResultStatus:   common.ResultStatus,
+		ObjectId:       common.ObjectId,
+		ClientIP:       common.ClientIP,
+		ContentId:      record.contentId,
+		Extra:          string(extraJson),
+	}
+	date := time.Now().UTC().Format("2006-01-02")
+	if common.CreationTime != nil {
+		millis := common.CreationTime.UnixNano() / int64(time.Millisecond)
+		row.CreationTime = &millis
+		date = common.CreationTime.UTC().Format("2006-01-02")
+	}
+	return row, date, nil
+}
+
+func parquetInt32(value *int64) *int32 {
+	if value == nil {
+		return nil
+	}
+	n := int32(*value)
+	return &n
+}
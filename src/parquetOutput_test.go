@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// readParquetFile reads every row of a completed file
+func readParquetFile(t *testing.T, path string) []parquetRow {
+	t.Helper()
+	source, err := local.NewLocalFileReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	pr, err := reader.NewParquetReader(source, new(parquetRow), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.ReadStop()
+	rows := make([]parquetRow, pr.GetNumRows())
+	if err := pr.Read(&rows); err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+// listParquetFiles returns the final and the hidden files below dir, relative to it
+func listParquetFiles(t *testing.T, dir string) (complete []string, hidden []string) {
+	t.Helper()
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		relative, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), ".") {
+			hidden = append(hidden, relative)
+		} else {
+			complete = append(complete, relative)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(complete)
+	return complete, hidden
+}
+
+func TestParquetOutputRollsAndPartitions(t *testing.T) {
+	dir := t.TempDir()
+	p, err := newParquetOutput(parquetConfig{Dir: dir, TenantId: "tenant1", MaxRows: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lock sync.Mutex
+	results := map[string]error{}
+	write := func(contentType string, content map[string]interface{}) {
+		t.Helper()
+		line, err := json.Marshal(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := content["Id"].(string)
+		err = p.write(auditRecord{content: content, contentType: contentType, contentId: "blob1"}, line, func(err error) {
+			lock.Lock()
+			results[id] = err
+			lock.Unlock()
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	resolved := func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		var ids []string
+		for id, err := range results {
+			if err != nil {
+				t.Errorf("record %v failed: %v", id, err)
+			}
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		return ids
+	}
+
+	write("Audit.General", map[string]interface{}{"Id": "1", "CreationTime": "2022-07-01T10:00:00", "Operation": "Send", "RecordType": float64(2), "Custom": "a"})
+	write("Audit.Exchange", map[string]interface{}{"Id": "2", "CreationTime": "2022-07-02T23:59:59"})
+	if got := resolved(); len(got) != 0 {
+		t.Errorf("records %v resolved before their file was complete", got)
+	}
+	if complete, hidden := listParquetFiles(t, dir); len(complete) != 0 || len(hidden) != 2 {
+		t.Errorf("files %v and hidden files %v, want two hidden files only", complete, hidden)
+	}
+
+	// the second row of the General partition rolls its file
+	write("Audit.General", map[string]interface{}{"Id": "3", "CreationTime": "2022-07-01T11:00:00"})
+	if got, want := resolved(), []string{"1", "3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("resolved %v after the roll, want %v", got, want)
+	}
+	write("Audit.General", map[string]interface{}{"Id": "4", "CreationTime": "2022-07-01T12:00:00"})
+
+	if err := p.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := resolved(), []string{"1", "2", "3", "4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("resolved %v after the flush, want %v", got, want)
+	}
+	complete, hidden := listParquetFiles(t, dir)
+	if len(hidden) != 0 {
+		t.Errorf("hidden files %v are left after the flush", hidden)
+	}
+	var partitions []string
+	for _, path := range complete {
+		partitions = append(partitions, filepath.Dir(path))
+	}
+	wantPartitions := []string{
+		filepath.Join("tenant=tenant1", "content_type=Audit.Exchange", "date=2022-07-02"),
+		filepath.Join("tenant=tenant1", "content_type=Audit.General", "date=2022-07-01"),
+		filepath.Join("tenant=tenant1", "content_type=Audit.General", "date=2022-07-01"),
+	}
+	if !reflect.DeepEqual(partitions, wantPartitions) {
+		t.Fatalf("files %v, want them in the partitions %v", complete, wantPartitions)
+	}
+
+	var ids [][]string
+	for _, path := range complete {
+		var fileIds []string
+		for _, row := range readParquetFile(t, filepath.Join(dir, path)) {
+			fileIds = append(fileIds, *row.Id)
+			if *row.Id != "1" {
+				continue
+			}
+			if row.Operation == nil || *row.Operation != "Send" || row.RecordType == nil || *row.RecordType != 2 {
+				t.Errorf("row 1 = %+v, want its promoted columns", row)
+			}
+			if row.CreationTime == nil || *row.CreationTime != 1656669600000 {
+				t.Errorf("row 1 creation time = %v, want 2022-07-01T10:00:00Z in milliseconds", row.CreationTime)
+			}
+			if row.Extra != `{"Custom":"a"}` || row.ContentId != "blob1" {
+				t.Errorf("row 1 extra %q and content id %q, want the remaining field and blob1", row.Extra, row.ContentId)
+			}
+		}
+		ids = append(ids, fileIds)
+	}
+	// the files of a partition are named in the order they were opened
+	if want := [][]string{{"2"}, {"1", "3"}, {"4"}}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("files hold %v, want %v", ids, want)
+	}
+}
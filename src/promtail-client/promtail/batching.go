@@ -0,0 +1,127 @@
+package promtail
+
+import (
+	"bytes"
+	"compress/gzip"
+)
+
+// entryOverhead approximates the encoding cost of an entry besides its line and metadata (timestamp, framing)
+const entryOverhead = 16
+
+// entrySize estimates the uncompressed size an entry adds to a push request, used for BatchSize
+func entrySize(line string, metadata map[string]string) int {
+	size := len(line) + entryOverhead
+	for name, value := range metadata {
+		size += len(name) + len(value) + entryOverhead/2
+	}
+	return size
+}
+
+func protoEntrySize(entry protoEntry) int {
+	size := len(entry.Line) + entryOverhead
+	for _, pair := range entry.Metadata {
+		size += len(pair.Name) + len(pair.Value) + entryOverhead/2
+	}
+	return size
+}
+
+// streamSpan is the entries [start, end) of a stream of a batch
+type streamSpan struct {
+	stream int
+	start  int
+	end    int
+}
+
+// splitStreams cuts a batch of streams into chunks of at most maxBytes each, splitting a stream across chunks if
+// needed. An entry larger than maxBytes gets a chunk of its own. maxBytes <= 0 returns a single chunk. The streams
+// are described by their number of entries and sizes, so that both push formats share it.
+func splitStreams(streams int, entries func(stream int) int, labelsSize func(stream int) int, entrySize func(stream, entry int) int, maxBytes int) [][]streamSpan {
+	if maxBytes <= 0 {
+		chunk := make([]streamSpan, streams)
+		for i := range chunk {
+			chunk[i] = streamSpan{stream: i, end: entries(i)}
+		}
+		return [][]streamSpan{chunk}
+	}
+	var chunks [][]streamSpan
+	var chunk []streamSpan
+	chunkSize := 0
+	for stream := 0; stream < streams; stream++ {
+		start := 0
+		streamSize := labelsSize(stream)
+		count := entries(stream)
+		for i := 0; i < count; i++ {
+			size := entrySize(stream, i)
+			if chunkSize > 0 && chunkSize+streamSize+size > maxBytes {
+				if i > start {
+					chunk = append(chunk, streamSpan{stream: stream, start: start, end: i})
+				}
+				chunks = append(chunks, chunk)
+				chunk, chunkSize, start = nil, 0, i
+			}
+			chunkSize += size
+		}
+		if start < count {
+			chunk = append(chunk, streamSpan{stream: stream, start: start, end: count})
+			chunkSize += streamSize
+		}
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+func splitProtoStreams(streams []protoStream, maxBytes int) [][]protoStream {
+	spans := splitStreams(len(streams),
+		func(stream int) int { return len(streams[stream].Entries) },
+		func(stream int) int { return len(streams[stream].Labels) },
+		func(stream, entry int) int { return protoEntrySize(streams[stream].Entries[entry]) },
+		maxBytes)
+	chunks := make([][]protoStream, len(spans))
+	for i, chunk := range spans {
+		for _, span := range chunk {
+			stream := streams[span.stream]
+			chunks[i] = append(chunks[i], protoStream{Labels: stream.Labels, Entries: stream.Entries[span.start:span.end]})
+		}
+	}
+	return chunks
+}
+
+func splitJsonStreams(streams []lokiStreamWithLabels, maxBytes int) [][]lokiStreamWithLabels {
+	spans := splitStreams(len(streams),
+		func(stream int) int { return len(streams[stream].Values) },
+		func(stream int) int {
+			size := 0
+			for name, value := range streams[stream].Labels {
+				size += len(name) + len(value) + entryOverhead/2
+			}
+			return size
+		},
+		func(stream, entry int) int {
+			value := streams[stream].Values[entry]
+			return entrySize(value.line, value.metadata)
+		},
+		maxBytes)
+	chunks := make([][]lokiStreamWithLabels, len(spans))
+	for i, chunk := range spans {
+		for _, span := range chunk {
+			stream := streams[span.stream]
+			chunks[i] = append(chunks[i], lokiStreamWithLabels{Labels: stream.Labels, Values: stream.Values[span.start:span.end]})
+		}
+	}
+	return chunks
+}
+
+// gzipBody compresses a JSON push request for Content-Encoding: gzip
+func gzipBody(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(body); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,190 @@
+package promtail
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitStreams(t *testing.T) {
+	tests := []struct {
+		name string
+		// labels and entries are the label and entry sizes of every stream
+		labels   []int
+		entries  [][]int
+		maxBytes int
+		want     [][]streamSpan
+	}{
+		{
+			name:     "no limit",
+			labels:   []int{10, 10},
+			entries:  [][]int{{1000, 1000}, {1000}},
+			maxBytes: 0,
+			want:     [][]streamSpan{{{0, 0, 2}, {1, 0, 1}}},
+		},
+		{
+			name:     "everything fits",
+			labels:   []int{10, 10},
+			entries:  [][]int{{20, 20}, {20}},
+			maxBytes: 100,
+			want:     [][]streamSpan{{{0, 0, 2}, {1, 0, 1}}},
+		},
+		{
+			name:     "a stream is split across chunks",
+			labels:   []int{10},
+			entries:  [][]int{{40, 40, 40}},
+			maxBytes: 100,
+			want:     [][]streamSpan{{{0, 0, 2}}, {{0, 2, 3}}},
+		},
+		{
+			name:     "the next stream starts a new chunk",
+			labels:   []int{10, 10},
+			entries:  [][]int{{40, 40}, {40}},
+			maxBytes: 100,
+			want:     [][]streamSpan{{{0, 0, 2}}, {{1, 0, 1}}},
+		},
+		{
+			name:     "an oversized entry gets a chunk of its own",
+			labels:   []int{10},
+			entries:  [][]int{{20, 500, 20}},
+			maxBytes: 100,
+			want:     [][]streamSpan{{{0, 0, 1}}, {{0, 1, 2}}, {{0, 2, 3}}},
+		},
+		{
+			name:     "labels count against the limit",
+			labels:   []int{50},
+			entries:  [][]int{{30, 30}},
+			maxBytes: 100,
+			want:     [][]streamSpan{{{0, 0, 1}}, {{0, 1, 2}}},
+		},
+		{
+			name:     "empty batch",
+			maxBytes: 100,
+			want:     nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitStreams(len(tt.entries),
+				func(stream int) int { return len(tt.entries[stream]) },
+				func(stream int) int { return tt.labels[stream] },
+				func(stream, entry int) int { return tt.entries[stream][entry] },
+				tt.maxBytes)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitStreams = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitProtoStreams(t *testing.T) {
+	streams := []protoStream{
+		{Labels: `{a="1"}`, Entries: []protoEntry{{Line: "1"}, {Line: strings.Repeat("x", 100)}, {Line: "3"}}},
+		{Labels: `{a="2"}`, Entries: []protoEntry{{Line: "4"}}},
+	}
+	chunks := splitProtoStreams(streams, 64)
+	var lines []string
+	for _, chunk := range chunks {
+		for _, stream := range chunk {
+			for _, entry := range stream.Entries {
+				lines = append(lines, stream.Labels+entry.Line[:1])
+			}
+		}
+	}
+	want := []string{`{a="1"}1`, `{a="1"}x`, `{a="1"}3`, `{a="2"}4`}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("entries = %v, want %v", lines, want)
+	}
+	if len(chunks) != 3 {
+		t.Errorf("got %d chunks, want 3", len(chunks))
+	}
+}
+
+func TestSplitJsonStreams(t *testing.T) {
+	streams := []lokiStreamWithLabels{
+		{Labels: map[string]string{"a": "1"}, Values: []lokiValue{{line: "1"}, {line: strings.Repeat("x", 100)}, {line: "3"}}},
+		{Labels: map[string]string{"a": "2"}, Values: []lokiValue{{line: "4", metadata: map[string]string{"m": "v"}}}},
+	}
+	chunks := splitJsonStreams(streams, 64)
+	var lines []string
+	for _, chunk := range chunks {
+		for _, stream := range chunk {
+			for _, value := range stream.Values {
+				lines = append(lines, stream.Labels["a"]+value.line[:1])
+			}
+		}
+	}
+	want := []string{"11", "1x", "13", "24"}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("entries = %v, want %v", lines, want)
+	}
+	if len(chunks) != 3 {
+		t.Errorf("got %d chunks, want 3", len(chunks))
+	}
+}
+
+// auditLines are lines from 500 bytes to 50KB, the range of the audit records
+func auditLines(n int) []string {
+	random := rand.New(rand.NewSource(1))
+	lines := make([]string, n)
+	for i := range lines {
+		lines[i] = fmt.Sprintf(`{"Id":"%d","Data":"%s"}`, i, strings.Repeat("a", 500+random.Intn(50*1024-500)))
+	}
+	return lines
+}
+
+func benchmarkClient(b *testing.B, newClient func(ClientConfig) (ClientV2, error), gzip bool) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	client, err := newClient(ClientConfig{
+		PushURL:            server.URL,
+		BatchWait:          time.Second,
+		BatchEntriesNumber: 1000,
+		BatchSize:          4 << 20,
+		Gzip:               gzip,
+		SendLevel:          INFO,
+		PrintLevel:         DISABLE,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.Shutdown(context.Background())
+	lines := auditLines(256)
+	labels := []string{"Exchange", "SharePoint", "AzureActiveDirectory", "General"}
+	size := 0
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		line := lines[i%len(lines)]
+		size += len(line)
+		err := client.Push(context.Background(), Entry{Line: line, Labels: map[string]string{"content_type": labels[i%len(labels)]}, Level: INFO})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	if _, err := client.Flush(context.Background()); err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(size / b.N))
+}
+
+func BenchmarkJsonClient(b *testing.B) {
+	benchmarkClient(b, NewClientJsonV2, false)
+}
+
+func BenchmarkJsonClientGzip(b *testing.B) {
+	benchmarkClient(b, NewClientJsonV2, true)
+}
+
+func BenchmarkProtoClient(b *testing.B) {
+	benchmarkClient(b, NewClientProtoV2, false)
+}
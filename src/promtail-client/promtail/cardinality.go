@@ -0,0 +1,224 @@
+package promtail
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OverflowLabelValue is the value a label is rewritten to when it is bucketed by the cardinality limiter
+const OverflowLabelValue = "__overflow__"
+
+// LabelOverflowAction decides what happens to a label once its cardinality limit is exceeded
+type LabelOverflowAction int
+
+const (
+	// LabelOverflowDrop removes the label from the entry
+	LabelOverflowDrop LabelOverflowAction = iota
+	// LabelOverflowBucket replaces the label value with OverflowLabelValue
+	LabelOverflowBucket LabelOverflowAction = iota
+	// LabelOverflowLine removes the label and carries its value in the log line instead
+	LabelOverflowLine LabelOverflowAction = iota
+	// LabelOverflowMetadata removes the label and carries its value as structured metadata instead
+	LabelOverflowMetadata LabelOverflowAction = iota
+)
+
+func (a LabelOverflowAction) String() string {
+	switch a {
+	case LabelOverflowDrop:
+		return "drop"
+	case LabelOverflowBucket:
+		return "bucket"
+	case LabelOverflowLine:
+		return "line"
+	case LabelOverflowMetadata:
+		return "metadata"
+	}
+	return fmt.Sprintf("LabelOverflowAction(%d)", int(a))
+}
+
+// ParseLabelOverflowAction is the inverse of LabelOverflowAction.String
+func ParseLabelOverflowAction(s string) (LabelOverflowAction, error) {
+	switch strings.ToLower(s) {
+	case "drop":
+		return LabelOverflowDrop, nil
+	case "bucket", "overflow":
+		return LabelOverflowBucket, nil
+	case "line":
+		return LabelOverflowLine, nil
+	case "metadata":
+		return LabelOverflowMetadata, nil
+	}
+	return 0, fmt.Errorf("unknown label overflow action %q", s)
+}
+
+// CardinalityLimit caps the number of distinct values a single label may take within Window.
+// A zero Window means values never expire for the lifetime of the client.
+type CardinalityLimit struct {
+	MaxValues int
+	Window    time.Duration
+	Action    LabelOverflowAction
+}
+
+var (
+	labelOverflowCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "promtail_client",
+		Name:      "label_overflow_total",
+		Help:      "Number of entries whose label exceeded its configured cardinality limit.",
+	}, []string{"label", "action"})
+	labelValuesGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "promtail_client",
+		Name:      "label_distinct_values",
+		Help:      "Distinct values currently tracked for a cardinality limited label.",
+	}, []string{"label"})
+)
+
+// labelValueTracker holds the distinct values seen for one label and when each was last seen
+type labelValueTracker struct {
+	limit     CardinalityLimit
+	logger    Logger
+	values    map[string]time.Time
+	lastSweep time.Time
+	// overflowing is set from the first overflow until the next sweep frees a slot, to only warn once per episode
+	overflowing bool
+}
+
+type cardinalityLimiter struct {
+	lock   sync.Mutex
+	labels map[string]*labelValueTracker
+}
+
+// newCardinalityLimiter returns nil when there is nothing to limit, apply is a no-op on a nil limiter
+func newCardinalityLimiter(limits map[string]CardinalityLimit, logger Logger) *cardinalityLimiter {
+	if len(limits) == 0 {
+		return nil
+	}
+	l := &cardinalityLimiter{labels: make(map[string]*labelValueTracker, len(limits))}
+	for name, limit := range limits {
+		if limit.MaxValues <= 0 {
+			continue
+		}
+		l.labels[name] = &labelValueTracker{
+			limit:  limit,
+			logger: logger,
+			values: make(map[string]time.Time, limit.MaxValues),
+		}
+	}
+	return l
+}
+
+// apply checks every limited label of the entry against its limit, moving or rewriting labels that overflow. The
+// label and metadata maps belong to the caller, they are copied before the first change.
+func (l *cardinalityLimiter) apply(e *Entry) {
+	if l == nil {
+		return
+	}
+	l.applyAt(e, time.Now())
+}
+
+func (l *cardinalityLimiter) applyAt(e *Entry, now time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	copied := false
+	for name, tracker := range l.labels {
+		value, ok := e.Labels[name]
+		if !ok || tracker.observe(name, value, now) {
+			continue
+		}
+		labelOverflowCounter.WithLabelValues(name, tracker.limit.Action.String()).Inc()
+		if !copied {
+			e.Labels = copyStringMap(e.Labels)
+			e.Metadata = copyStringMap(e.Metadata)
+			copied = true
+		}
+		switch tracker.limit.Action {
+		case LabelOverflowDrop:
+			delete(e.Labels, name)
+		case LabelOverflowBucket:
+			e.Labels[name] = OverflowLabelValue
+		case LabelOverflowLine:
+			delete(e.Labels, name)
+			e.Line = appendFieldToLine(e.Line, name, value)
+		case LabelOverflowMetadata:
+			delete(e.Labels, name)
+			if e.Metadata == nil {
+				e.Metadata = map[string]string{}
+			}
+			e.Metadata[name] = value
+		}
+	}
+}
+
+// observe records value for the label and reports whether it fits within the limit
+func (t *labelValueTracker) observe(name, value string, now time.Time) bool {
+	if _, ok := t.values[value]; ok {
+		t.values[value] = now
+		return true
+	}
+	if len(t.values) >= t.limit.MaxValues {
+		t.sweep(name, now)
+	}
+	if len(t.values) < t.limit.MaxValues {
+		t.values[value] = now
+		labelValuesGauge.WithLabelValues(name).Set(float64(len(t.values)))
+		return true
+	}
+	if !t.overflowing {
+		t.overflowing = true
+		t.logger.Warnf("promtail: label %q exceeded %d distinct values within %v, applying %v to new values", name, t.limit.MaxValues, t.limit.Window, t.limit.Action)
+	}
+	return false
+}
+
+// sweep forgets values that have not been seen within the window, at most once per second
+func (t *labelValueTracker) sweep(name string, now time.Time) {
+	if t.limit.Window <= 0 || now.Sub(t.lastSweep) < time.Second {
+		return
+	}
+	t.lastSweep = now
+	threshold := now.Add(-t.limit.Window)
+	for value, seen := range t.values {
+		if seen.Before(threshold) {
+			delete(t.values, value)
+		}
+	}
+	if len(t.values) < t.limit.MaxValues {
+		t.overflowing = false
+	}
+	labelValuesGauge.WithLabelValues(name).Set(float64(len(t.values)))
+}
+
+func copyStringMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// appendFieldToLine adds name=value to the line, as a JSON field if the line is a JSON object
+// that does not carry it already, otherwise as a trailing logfmt pair
+func appendFieldToLine(line, name, value string) string {
+	trimmed := strings.TrimSpace(line)
+	if strings.HasPrefix(trimmed, "{") && strings.HasSuffix(trimmed, "}") {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(trimmed), &fields); err == nil {
+			if _, ok := fields[name]; ok {
+				return line
+			}
+			field, _ := json.Marshal(map[string]string{name: value})
+			if len(fields) == 0 {
+				return string(field)
+			}
+			return string(field[:len(field)-1]) + "," + trimmed[1:]
+		}
+	}
+	return fmt.Sprintf("%s %s=%q", line, name, value)
+}
@@ -0,0 +1,128 @@
+package promtail
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCardinalityLimiterActions(t *testing.T) {
+	tests := []struct {
+		name         string
+		action       LabelOverflowAction
+		wantLabels   map[string]string
+		wantLine     string
+		wantMetadata map[string]string
+	}{
+		{
+			name:       "drop",
+			action:     LabelOverflowDrop,
+			wantLabels: map[string]string{"job": "o365"},
+			wantLine:   `{"a":1}`,
+		},
+		{
+			name:       "bucket",
+			action:     LabelOverflowBucket,
+			wantLabels: map[string]string{"job": "o365", "user": OverflowLabelValue},
+			wantLine:   `{"a":1}`,
+		},
+		{
+			name:       "line",
+			action:     LabelOverflowLine,
+			wantLabels: map[string]string{"job": "o365"},
+			wantLine:   `{"user":"c","a":1}`,
+		},
+		{
+			name:         "metadata",
+			action:       LabelOverflowMetadata,
+			wantLabels:   map[string]string{"job": "o365"},
+			wantLine:     `{"a":1}`,
+			wantMetadata: map[string]string{"user": "c"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newCardinalityLimiter(map[string]CardinalityLimit{"user": {MaxValues: 2, Action: tt.action}}, stdLogger{})
+			now := time.Now()
+			for _, user := range []string{"a", "b", "a"} {
+				e := Entry{Line: `{"a":1}`, Labels: map[string]string{"job": "o365", "user": user}}
+				l.applyAt(&e, now)
+				if e.Labels["user"] != user {
+					t.Fatalf("value %v within the limit was changed to %v", user, e.Labels["user"])
+				}
+			}
+
+			labels := map[string]string{"job": "o365", "user": "c"}
+			e := Entry{Line: `{"a":1}`, Labels: labels}
+			l.applyAt(&e, now)
+			if !reflect.DeepEqual(e.Labels, tt.wantLabels) {
+				t.Errorf("labels = %v, want %v", e.Labels, tt.wantLabels)
+			}
+			if e.Line != tt.wantLine {
+				t.Errorf("line = %v, want %v", e.Line, tt.wantLine)
+			}
+			if !reflect.DeepEqual(e.Metadata, tt.wantMetadata) {
+				t.Errorf("metadata = %v, want %v", e.Metadata, tt.wantMetadata)
+			}
+			if labels["user"] != "c" || len(labels) != 2 {
+				t.Errorf("the caller's labels were changed: %v", labels)
+			}
+		})
+	}
+}
+
+func TestCardinalityLimiterWindow(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name   string
+		window time.Duration
+		// seen is when each value was observed, in order
+		seen []time.Duration
+		// at is when the next new value is observed
+		at   time.Duration
+		want bool
+	}{
+		{name: "no window never expires", window: 0, seen: []time.Duration{0, 0}, at: 24 * time.Hour, want: false},
+		{name: "values within the window are kept", window: time.Hour, seen: []time.Duration{0, 30 * time.Minute}, at: 59 * time.Minute, want: false},
+		{name: "an expired value frees a slot", window: time.Hour, seen: []time.Duration{0, 30 * time.Minute}, at: 61 * time.Minute, want: true},
+		{name: "seeing a value again renews it", window: time.Hour, seen: []time.Duration{0, 30 * time.Minute, 50 * time.Minute}, at: 61 * time.Minute, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := &labelValueTracker{
+				limit:  CardinalityLimit{MaxValues: 2, Window: tt.window},
+				logger: stdLogger{},
+				values: map[string]time.Time{},
+			}
+			// the last value seen again is the first one, renewing it
+			values := []string{"a", "b", "a"}
+			for i, offset := range tt.seen {
+				if !tracker.observe("user", values[i], start.Add(offset)) {
+					t.Fatalf("value %v within the limit overflowed", values[i])
+				}
+			}
+			if got := tracker.observe("user", "c", start.Add(tt.at)); got != tt.want {
+				t.Errorf("observe = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCardinalityLimiterSweepRateLimited(t *testing.T) {
+	start := time.Now()
+	tracker := &labelValueTracker{limit: CardinalityLimit{MaxValues: 1, Window: time.Millisecond}, logger: stdLogger{}, values: map[string]time.Time{}}
+	tracker.observe("user", "a", start)
+	if tracker.observe("user", "b", start.Add(time.Millisecond/2)) {
+		t.Fatal("b fitted while a was within the window")
+	}
+	// a expired, but the last sweep was less than a second ago
+	if tracker.observe("user", "b", start.Add(500*time.Millisecond)) {
+		t.Fatal("a sweep ran within a second of the previous one")
+	}
+	if !tracker.observe("user", "b", start.Add(2*time.Second)) {
+		t.Fatal("the expired value was not swept")
+	}
+	if tracker.overflowing {
+		t.Error("overflowing is still set after a sweep freed a slot")
+	}
+}
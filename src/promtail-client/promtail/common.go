@@ -2,11 +2,14 @@ package promtail
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"net/url"
 	"sort"
 	"strings"
 	"time"
@@ -33,10 +36,83 @@ type ClientConfig struct {
 	Labels             map[string]string
 	BatchWait          time.Duration
 	BatchEntriesNumber int
+	// BatchSize is the approximate uncompressed size in bytes at which a batch is sent, larger batches are split
+	// into several pushes. Keep it below Loki's grpc_server_max_recv_msg_size. Zero disables the limit.
+	BatchSize int
+	// Gzip compresses JSON push requests with Content-Encoding: gzip. The protobuf client always uses the
+	// snappy block format Loki requires for application/x-protobuf.
+	Gzip bool
+	// PushWorkers is the number of batches the protobuf client pushes in parallel. Streams are sharded by
+	// label hash so entries of a stream are still sent in order. With more than one worker, shard n > 0
+	// buffers in BufferDir/shard-n and BufferMaxBytes is shared between shards. Batches buffered with a different
+	// number of workers are moved to the shards of their streams at startup. Zero means one worker.
+	PushWorkers int
 	// Logs are sent to Promtail if the entry level is >= SendLevel
 	SendLevel LogLevel
 	// Logs are printed to stdout if the entry level is >= PrintLevel
 	PrintLevel LogLevel
+	// CardinalityLimits caps the distinct values of dynamic labels, keyed on label name.
+	// Static Labels are never limited.
+	CardinalityLimits map[string]CardinalityLimit
+	// MaxRetries is the number of times a batch is retried on network errors, 429 and 5xx.
+	// Zero uses the default of 10, a negative value disables retries.
+	MaxRetries int
+	// MinBackoff and MaxBackoff bound the exponential backoff between retries, default 500ms and 5m
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// BufferDir enables an on-disk buffer holding batches that could not be delivered, replayed in order once Loki recovers
+	BufferDir string
+	// BufferMaxBytes is the disk budget of BufferDir, batches that do not fit are dropped with an error. Zero means unlimited.
+	BufferMaxBytes int64
+
+	// TenantID is sent as the X-Scope-OrgID header to multi-tenant Loki installations
+	TenantID string
+	// BasicAuth takes precedence over BearerToken when both are set
+	BasicAuth   *BasicAuth
+	BearerToken string
+	TLS         TLSConfig
+	// ProxyURL overrides the HTTP_PROXY/HTTPS_PROXY environment variables
+	ProxyURL string
+	// Timeout of a single push request, defaults to 20s
+	Timeout time.Duration
+
+	// SortEntries orders the entries of every stream by timestamp before a batch is pushed,
+	// for Loki installations that reject out-of-order writes
+	SortEntries bool
+	// MaxEntryAge clamps older entry timestamps to now-MaxEntryAge, set it to Loki's reject_old_samples_max_age
+	MaxEntryAge time.Duration
+
+	// Logger receives the logs of the client and the entries printed locally, the standard log package if unset
+	Logger Logger
+}
+
+type BasicAuth struct {
+	Username string
+	Password string
+}
+
+type TLSConfig struct {
+	// CAFile is a PEM bundle used instead of the system roots to verify the server
+	CAFile string
+	// CertFile and KeyFile are the PEM client certificate and key for mTLS
+	CertFile           string
+	KeyFile            string
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+// Entry is a single log line with the labels selecting its stream and per-entry structured metadata
+type Entry struct {
+	// Timestamp defaults to the current time when zero
+	Timestamp time.Time
+	Line      string
+	Labels    map[string]string
+	// Metadata is sent as Loki structured metadata, suited to high-cardinality values that should not be labels
+	Metadata map[string]string
+	Level    LogLevel
+	// OnDelivery is called once the batch holding the entry was accepted by Loki or persisted in BufferDir (nil),
+	// or was dropped (the reason). It is called from the client's goroutines and must not block.
+	OnDelivery func(err error)
 }
 
 type Client interface {
@@ -46,24 +122,96 @@ type Client interface {
 	Errorf(format string, labels *map[string]string, args ...interface{})
 	//Logf(format string, labels *map[string]string, args ...interface{})
 
-	// LogRaw Writes log entry with pre-formatted line and arbitrary labels
+	// LogRaw Writes log entry with pre-formatted line and arbitrary labels, timestamped from the
+	// TimestampLabel label if present, the current time otherwise
 	LogRaw(message string, labels map[string]string, level LogLevel)
+	// LogRawAt is LogRaw with an explicit timestamp, the zero time is replaced by the current time
+	LogRawAt(ts time.Time, message string, labels map[string]string, level LogLevel)
+	// LogEntry writes an entry including its structured metadata
+	LogEntry(entry Entry)
 	Shutdown()
 }
 
 // http.Client wrapper for adding new methods, particularly sendReq
 type httpClient struct {
 	parent http.Client
+	config *ClientConfig
+}
+
+// newHttpClient builds the transport for conf, including TLS and proxy settings
+func newHttpClient(conf *ClientConfig) (httpClient, error) {
+	tlsConfig, err := conf.TLS.build()
+	if err != nil {
+		return httpClient{}, err
+	}
+	proxy := http.ProxyFromEnvironment
+	if conf.ProxyURL != "" {
+		proxyURL, err := url.Parse(conf.ProxyURL)
+		if err != nil {
+			return httpClient{}, fmt.Errorf("invalid proxy url %v: %w", conf.ProxyURL, err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy
+	transport.TLSClientConfig = tlsConfig
+
+	timeout := conf.Timeout
+	if timeout == 0 {
+		timeout = time.Second * 20
+	}
+	return httpClient{
+		parent: http.Client{Transport: transport, Timeout: timeout},
+		config: conf,
+	}, nil
+}
+
+func (t TLSConfig) build() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+	if t.CAFile != "" {
+		caBundle, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA file: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caBundle) {
+			return nil, fmt.Errorf("no certificates found in CA file %v", t.CAFile)
+		}
+	}
+	if t.CertFile != "" || t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
 }
 
 // A bit more convenient method for sending requests to the HTTP server
-func (client *httpClient) sendReq(method, url string, ctype string, reqBody *[]byte) (resp *http.Response, resBody []byte, err error) {
-	req, err := http.NewRequest(method, url, bytes.NewBuffer(*reqBody))
+func (client *httpClient) sendReq(ctx context.Context, method, url string, ctype string, cencoding string, reqBody *[]byte) (resp *http.Response, resBody []byte, err error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewBuffer(*reqBody))
 	if err != nil {
 		return nil, nil, err
 	}
 
 	req.Header.Set("Content-Type", ctype)
+	if cencoding != "" {
+		req.Header.Set("Content-Encoding", cencoding)
+	}
+	if conf := client.config; conf != nil {
+		if conf.TenantID != "" {
+			req.Header.Set("X-Scope-OrgID", conf.TenantID)
+		}
+		if conf.BasicAuth != nil {
+			req.SetBasicAuth(conf.BasicAuth.Username, conf.BasicAuth.Password)
+		} else if conf.BearerToken != "" {
+			req.Header.Set("Authorization", "Bearer "+conf.BearerToken)
+		}
+	}
 	resp, err = client.parent.Do(req)
 	if err != nil {
 		return nil, nil, err
@@ -71,8 +219,7 @@ func (client *httpClient) sendReq(method, url string, ctype string, reqBody *[]b
 	defer func(Body io.ReadCloser) {
 		err := Body.Close()
 		if err != nil {
-			log.Println("error encountered closing response body: ")
-			log.Fatalln(err)
+			client.config.logger().Warnf("error encountered closing response body: %s", err)
 		}
 	}(resp.Body)
 
@@ -80,7 +227,7 @@ func (client *httpClient) sendReq(method, url string, ctype string, reqBody *[]b
 	if err != nil {
 		return nil, nil, err
 	}
-	log.Printf("got response with status: %v", resp.StatusCode)
+	client.config.logger().Debugf("got response with status: %v", resp.StatusCode)
 
 	return resp, resBody, nil
 }
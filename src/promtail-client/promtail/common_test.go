@@ -0,0 +1,160 @@
+package promtail
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeClientCert writes a self-signed client certificate and its key to dir, returning their paths and the certificate
+func writeClientCert(t *testing.T, dir string) (string, string, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "o365LogExporter"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert
+}
+
+func TestHttpClientTLSAndAuth(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, clientCert := writeClientCert(t, dir)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+
+	// the server requires the client certificate and answers with the auth headers it got
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Authorization", r.Header.Get("Authorization"))
+		w.Header().Set("X-Tenant", r.Header.Get("X-Scope-OrgID"))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		conf         ClientConfig
+		wantBuildErr bool
+		wantErr      bool
+		wantAuth     string
+		wantTenant   string
+	}{
+		{
+			name: "basic auth over mTLS",
+			conf: ClientConfig{
+				TLS:       TLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile},
+				BasicAuth: &BasicAuth{Username: "loki", Password: "secret"},
+				TenantID:  "tenant1",
+			},
+			wantAuth:   "Basic bG9raTpzZWNyZXQ=",
+			wantTenant: "tenant1",
+		},
+		{
+			name:     "bearer token",
+			conf:     ClientConfig{TLS: TLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile}, BearerToken: "token"},
+			wantAuth: "Bearer token",
+		},
+		{
+			name: "basic auth takes precedence",
+			conf: ClientConfig{
+				TLS:         TLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile},
+				BasicAuth:   &BasicAuth{Username: "loki", Password: "secret"},
+				BearerToken: "token",
+			},
+			wantAuth: "Basic bG9raTpzZWNyZXQ=",
+		},
+		{
+			name: "verification skipped",
+			conf: ClientConfig{TLS: TLSConfig{CertFile: certFile, KeyFile: keyFile, InsecureSkipVerify: true}},
+		},
+		{
+			name:    "server not verified without the CA",
+			conf:    ClientConfig{TLS: TLSConfig{CertFile: certFile, KeyFile: keyFile}},
+			wantErr: true,
+		},
+		{
+			name:    "server rejects a missing client certificate",
+			conf:    ClientConfig{TLS: TLSConfig{CAFile: caFile}},
+			wantErr: true,
+		},
+		{
+			name:         "certificate without key",
+			conf:         ClientConfig{TLS: TLSConfig{CAFile: caFile, CertFile: certFile}},
+			wantBuildErr: true,
+		},
+		{
+			name:         "CA file without certificates",
+			conf:         ClientConfig{TLS: TLSConfig{CAFile: keyFile}},
+			wantBuildErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.conf.Logger = stdLogger{}
+			client, err := newHttpClient(&tt.conf)
+			if (err != nil) != tt.wantBuildErr {
+				t.Fatalf("build err = %v, want an error: %v", err, tt.wantBuildErr)
+			}
+			if err != nil {
+				return
+			}
+			body := []byte("{}")
+			resp, _, err := client.sendReq(context.Background(), http.MethodPost, server.URL, "application/json", "", &body)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want an error: %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := resp.Header.Get("X-Authorization"); got != tt.wantAuth {
+				t.Errorf("Authorization = %q, want %q", got, tt.wantAuth)
+			}
+			if got := resp.Header.Get("X-Tenant"); got != tt.wantTenant {
+				t.Errorf("X-Scope-OrgID = %q, want %q", got, tt.wantTenant)
+			}
+		})
+	}
+}
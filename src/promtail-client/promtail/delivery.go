@@ -0,0 +1,80 @@
+package promtail
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrClientClosed is returned by Push and Flush once Shutdown was called
+var ErrClientClosed = errors.New("promtail: client is shut down")
+
+// ClientV2 is the context aware client API. Push blocks while the client is saturated, which lets callers
+// apply back-pressure, and the outcome of every entry is reported through Entry.OnDelivery and Flush.
+type ClientV2 interface {
+	// Push queues the entry, blocking until there is room for it or ctx is done
+	Push(ctx context.Context, entry Entry) error
+	// Flush sends everything pushed so far and waits for it to be resolved, reporting what happened
+	// to the entries resolved since the previous Flush
+	Flush(ctx context.Context) (DeliveryReport, error)
+	// Shutdown flushes the remaining entries and waits for in-flight batches until ctx is done
+	Shutdown(ctx context.Context) error
+}
+
+// DeliveryReport sums up the outcome of the entries resolved since the previous Flush
+type DeliveryReport struct {
+	// Delivered entries were accepted by Loki
+	Delivered int
+	// Buffered entries are persisted in BufferDir and will be replayed once Loki recovers
+	Buffered int
+	// Dropped entries are lost, Err holds the reason of the last drop
+	Dropped int
+	Err     error
+}
+
+type deliveryTracker struct {
+	lock   sync.Mutex
+	report DeliveryReport
+}
+
+// resolve records the outcome of a batch and notifies its entries, buffered entries count as landed
+func (d *deliveryTracker) resolve(callbacks []func(error), count int, buffered bool, err error) {
+	batchEntriesHistogram.Observe(float64(count))
+	d.lock.Lock()
+	switch {
+	case err != nil:
+		d.report.Dropped += count
+		d.report.Err = err
+	case buffered:
+		d.report.Buffered += count
+	default:
+		d.report.Delivered += count
+	}
+	d.lock.Unlock()
+	for _, callback := range callbacks {
+		callback(err)
+	}
+}
+
+func (d *deliveryTracker) take() DeliveryReport {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	report := d.report
+	d.report = DeliveryReport{}
+	return report
+}
+
+// WaitGroupContext waits for wg until ctx is done
+func WaitGroupContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
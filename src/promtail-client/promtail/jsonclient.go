@@ -1,38 +1,77 @@
 package promtail
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/cornelk/hashmap"
-	"log"
-	"net/http"
 	"strconv"
 	"sync"
 	"time"
 )
 
 type jsonLogEntry struct {
-	Ts      time.Time `json:"ts"`
-	Line    string    `json:"line"`
-	level   LogLevel  // not used in JSON
-	labels  *string
-	labels2 *map[string]string
+	Ts       time.Time `json:"ts"`
+	Line     string    `json:"line"`
+	level    LogLevel  // not used in JSON
+	labels   *string
+	labels2  *map[string]string
+	metadata map[string]string
+	done     func(error)
+	// flushed marks a Flush request instead of an entry, it is closed once everything before it was sent
+	flushed chan struct{}
+	// flushCtx is the context of the Flush, it bounds the pushes of the flush
+	flushCtx context.Context
 }
 
 type clientJson struct {
-	config    *ClientConfig
-	quit      chan struct{}
-	entries   chan *jsonLogEntry
-	waitGroup sync.WaitGroup
-	client    httpClient
+	config     *ClientConfig
+	quit       chan struct{}
+	closeOnce  sync.Once
+	entries    chan *jsonLogEntry
+	waitGroup  sync.WaitGroup
+	client     httpClient
+	sender     *batchSender
+	limiter    *cardinalityLimiter
+	deliveries deliveryTracker
+	batchSize  int
+	batchBytes int
 
 	hashMap *hashmap.HashMap
+
+	// abort cancels the pushes in flight when a shutdown runs out of time
+	abort context.CancelFunc
+}
+
+// clientJsonV2 exposes clientJson through the ClientV2 interface
+type clientJsonV2 struct {
+	*clientJson
+}
+
+func (c clientJsonV2) Shutdown(ctx context.Context) error {
+	return c.shutdown(ctx)
 }
 
 type lokiStreamWithLabels struct {
 	Labels map[string]string `json:"stream"`
-	Values [][]string        `json:"values"`
+	Values []lokiValue       `json:"values"`
+}
+
+// lokiValue is encoded as ["<unix nanos>", "<line>"], or with structured metadata as ["<unix nanos>", "<line>", {"name": "value"}]
+type lokiValue struct {
+	ts       string
+	line     string
+	metadata map[string]string
+	done     func(error)
+}
+
+func (v lokiValue) MarshalJSON() ([]byte, error) {
+	if len(v.metadata) == 0 {
+		return json.Marshal([]string{v.ts, v.line})
+	}
+	return json.Marshal([]interface{}{v.ts, v.line, v.metadata})
 }
+
 type lokiMsg struct {
 	Streams []lokiStreamWithLabels `json:"streams"`
 	//Streams []struct {
@@ -42,15 +81,41 @@ type lokiMsg struct {
 }
 
 func NewClientJson(conf ClientConfig) (Client, error) {
+	return newClientJson(conf)
+}
+
+func NewClientJsonV2(conf ClientConfig) (ClientV2, error) {
+	client, err := newClientJson(conf)
+	if err != nil {
+		return nil, err
+	}
+	return clientJsonV2{client}, nil
+}
+
+func newClientJson(conf ClientConfig) (*clientJson, error) {
 	client := clientJson{
 		config:  &conf,
 		quit:    make(chan struct{}),
 		entries: make(chan *jsonLogEntry, LOG_ENTRIES_CHAN_SIZE),
-		client: httpClient{
-			parent: http.Client{Timeout: time.Second * 20},
-		},
+		limiter: newCardinalityLimiter(conf.CardinalityLimits, conf.logger()),
 		hashMap: hashmap.New(HASHMAP_INIT_SIZE),
 	}
+	var err error
+	client.client, err = newHttpClient(client.config)
+	if err != nil {
+		return nil, err
+	}
+	var contentEncoding string
+	if conf.Gzip {
+		contentEncoding = "gzip"
+	}
+	var ctx context.Context
+	ctx, client.abort = context.WithCancel(context.Background())
+	client.sender, err = newBatchSender(ctx, client.config, &client.client, "application/json", contentEncoding)
+	if err != nil {
+		client.abort()
+		return nil, err
+	}
 
 	client.waitGroup.Add(1)
 
@@ -76,53 +141,111 @@ func (c *clientJson) Errorf(format string, labels *map[string]string, args ...in
 }
 
 func (c *clientJson) LogRaw(message string, labels map[string]string, level LogLevel) {
-	var ts time.Time
-	var err error
-	if k, ok := labels["_ts"]; ok {
-		ts, err = time.Parse("2006-01-02T15:04:05", k)
-		if err != nil {
-			log.Printf("Error parsing incoming time, using current time instead")
-			ts = time.Now().UTC()
-		}
-		delete(labels, "_ts")
+	c.LogRawAt(c.config.timestampFromLabels(labels), message, labels, level)
+}
+
+func (c *clientJson) LogRawAt(ts time.Time, message string, labels map[string]string, level LogLevel) {
+	c.LogEntry(Entry{Timestamp: ts, Line: message, Labels: labels, Level: level})
+}
+
+func (c *clientJson) LogEntry(e Entry) {
+	err := c.Push(context.Background(), e)
+	if err != nil {
+		c.config.logger().Errorf("promtail.ClientJson: %s", err)
+	}
+}
+
+func (c *clientJson) Push(ctx context.Context, e Entry) error {
+	e.Timestamp = c.config.entryTimestamp(e.Timestamp)
+	if e.Labels == nil {
+		e.Labels = map[string]string{}
+	}
+	c.limiter.apply(&e)
+	mergedKeys, _ := mergeKeys_string(e.Labels, c.config.Labels)
+	entry := &jsonLogEntry{
+		Ts:       e.Timestamp,
+		Line:     e.Line,
+		level:    e.Level,
+		labels:   makeLabelString2(&mergedKeys),
+		labels2:  &mergedKeys,
+		metadata: e.Metadata,
+		done:     e.OnDelivery,
+	}
+	select {
+	case <-c.quit:
+		return ErrClientClosed
+	default:
+	}
+	select {
+	case c.entries <- entry:
+		return nil
+	case <-c.quit:
+		return ErrClientClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *clientJson) Flush(ctx context.Context) (DeliveryReport, error) {
+	flushed := make(chan struct{})
+	select {
+	case c.entries <- &jsonLogEntry{flushed: flushed, flushCtx: ctx}:
+	case <-c.quit:
+		return c.deliveries.take(), ErrClientClosed
+	case <-ctx.Done():
+		return DeliveryReport{}, ctx.Err()
 	}
-	mergedKeys, _ := mergeKeys_string(labels, c.config.Labels)
-	c.entries <- &jsonLogEntry{
-		Ts:      ts,
-		Line:    message,
-		level:   level,
-		labels:  makeLabelString2(&mergedKeys),
-		labels2: &mergedKeys,
+	select {
+	case <-flushed:
+	case <-ctx.Done():
+		return DeliveryReport{}, ctx.Err()
 	}
+	report := c.deliveries.take()
+	return report, report.Err
 }
+
 func (c *clientJson) log(format string, level LogLevel, prefix string, labels *map[string]string, args ...interface{}) {
 
 	if (level >= c.config.SendLevel) || (level >= c.config.PrintLevel) {
 		//var strEntry = []*jsonLogEntry{{Ts: time.Now(), Line: fmt.Sprintf(prefix+format, args...), level: level}}
-		mergedKeys, _ := mergeKeys_string(*labels, c.config.Labels)
-		c.entries <- &jsonLogEntry{
-			Ts:     time.Now(),
-			Line:   fmt.Sprintf(prefix+format, args...),
-			level:  level,
-			labels: makeLabelString2(&mergedKeys),
-		}
+		c.LogEntry(Entry{Line: fmt.Sprintf(prefix+format, args...), Labels: *labels, Level: level})
 	}
 }
 
 func (c *clientJson) Shutdown() {
-	log.Println("Shutting down loki, waiting for waitGroup to complete")
-	close(c.quit)
+	c.config.logger().Infof("Shutting down loki, waiting for waitGroup to complete")
+	_ = c.shutdown(context.Background())
+}
 
-	// let the run2() defer func call Wait() on the waitgroup
-	//c.waitGroup.Wait()
+// shutdown waits for the remaining entries to be sent until ctx is done, then aborts the pushes in flight and
+// waits for the run goroutine to stop
+func (c *clientJson) shutdown(ctx context.Context) error {
+	c.closeOnce.Do(func() { close(c.quit) })
+	err := WaitGroupContext(ctx, &c.waitGroup)
+	c.abort()
+	if err != nil {
+		c.waitGroup.Wait()
+	}
+	return err
 }
+
 func (c *clientJson) run2() {
 	maxWait := time.NewTimer(c.config.BatchWait)
-	batchSize := 0
 	defer func() {
-		if c.hashMap.Len() > 0 {
-			c.flush()
+		// pick up whatever was pushed while shutting down
+		for {
+			select {
+			case entry := <-c.entries:
+				c.handle(entry)
+				continue
+			default:
+			}
+			break
+		}
+		if c.batchSize > 0 {
+			c.flush(context.Background())
 		}
+		c.sender.close()
 
 		c.waitGroup.Done()
 	}()
@@ -133,71 +256,117 @@ func (c *clientJson) run2() {
 			return
 
 		case entry := <-c.entries:
-			if entry.level >= c.config.PrintLevel {
-				log.Print(entry.Line)
-			}
-			if entry.level >= c.config.SendLevel {
-				line := []string{strconv.FormatInt(entry.Ts.UnixNano(), 10), entry.Line}
-				var strmWLbls = lokiStreamWithLabels{
-					Labels: *entry.labels2,
-					Values: [][]string{line},
-				}
-				//actual, loaded := c.hashMap.GetOrInsert(*entry.labels, strmWLbls)
-				if actual, loaded := c.hashMap.GetOrInsert(*entry.labels, &strmWLbls); loaded {
-					(*(actual.(*lokiStreamWithLabels))).Values = append((*(actual.(*lokiStreamWithLabels))).Values, line)
-					//c.hashMap.Set(entry.labels,append((actual).([]logproto.Entry), streamEntry...))
-				}
-				batchSize++
-				if batchSize >= c.config.BatchEntriesNumber {
-					c.waitGroup.Add(1)
-					go c.flush()
-					//c.flush()
-					batchSize = 0
-					maxWait.Reset(c.config.BatchWait)
-				}
+			if c.handle(entry) {
+				maxWait.Reset(c.config.BatchWait)
 			}
 		case <-maxWait.C:
-			if batchSize > 0 {
-				c.waitGroup.Add(1)
-				go c.flush()
-				//c.flush()
-				batchSize = 0
+			if c.batchSize > 0 {
+				c.flush(context.Background())
 			}
 			maxWait.Reset(c.config.BatchWait)
 		}
 	}
 }
 
-func (c *clientJson) flush() {
-	l := hashmap.NewList()
-	l.Head()
-	defer c.waitGroup.Done()
+// handle adds the entry to the current batch, flushing it when it is full or on a Flush request.
+// It reports whether a flush happened.
+func (c *clientJson) handle(entry *jsonLogEntry) bool {
+	if entry.flushed != nil {
+		if c.batchSize > 0 {
+			c.flush(entry.flushCtx)
+		}
+		close(entry.flushed)
+		return true
+	}
+	if entry.level >= c.config.PrintLevel {
+		c.config.printEntry(entry.level, entry.Line)
+	}
+	if entry.level < c.config.SendLevel {
+		if entry.done != nil {
+			entry.done(nil)
+		}
+		return false
+	}
+	flushed := false
+	size := entrySize(entry.Line, entry.metadata)
+	if c.config.BatchSize > 0 && c.batchSize > 0 && c.batchBytes+size > c.config.BatchSize {
+		c.flush(context.Background())
+		flushed = true
+	}
+	line := lokiValue{ts: strconv.FormatInt(entry.Ts.UnixNano(), 10), line: entry.Line, metadata: entry.metadata, done: entry.done}
+	var strmWLbls = lokiStreamWithLabels{
+		Labels: *entry.labels2,
+		Values: []lokiValue{line},
+	}
+	//actual, loaded := c.hashMap.GetOrInsert(*entry.labels, strmWLbls)
+	if actual, loaded := c.hashMap.GetOrInsert(*entry.labels, &strmWLbls); loaded {
+		(*(actual.(*lokiStreamWithLabels))).Values = append((*(actual.(*lokiStreamWithLabels))).Values, line)
+		//c.hashMap.Set(entry.labels,append((actual).([]logproto.Entry), streamEntry...))
+	} else {
+		c.batchBytes += len(*entry.labels)
+	}
+	c.batchSize++
+	c.batchBytes += size
+	if c.batchSize >= c.config.BatchEntriesNumber {
+		c.flush(context.Background())
+		return true
+	}
+	return flushed
+}
+
+// flush takes the current batch out of the hashMap and sends it within ctx, split into several pushes if it
+// exceeds BatchSize. It runs on the run goroutine so that the batches of a stream reach Loki or the WAL in order.
+func (c *clientJson) flush(ctx context.Context) {
 	var streams []lokiStreamWithLabels
 	for entry := range c.hashMap.Iter() {
-		streams = append(
-			streams,
-			*((entry.Value).(*lokiStreamWithLabels)),
-		)
+		stream := (entry.Value).(*lokiStreamWithLabels)
+		if c.config.SortEntries {
+			sortJsonValues(stream.Values)
+		}
+		streams = append(streams, *stream)
 		c.hashMap.Del(entry.Key)
 	}
+	c.batchSize = 0
+	c.batchBytes = 0
+
+	for _, chunk := range splitJsonStreams(streams, c.config.BatchSize) {
+		var callbacks []func(error)
+		count := 0
+		for _, stream := range chunk {
+			count += len(stream.Values)
+			for _, value := range stream.Values {
+				if value.done != nil {
+					callbacks = append(callbacks, value.done)
+				}
+			}
+		}
+		buffered, err := c.send(ctx, chunk)
+		c.deliveries.resolve(callbacks, count, buffered, err)
+	}
+}
+
+func (c *clientJson) send(ctx context.Context, streams []lokiStreamWithLabels) (bool, error) {
 	jsonMsg, err := json.Marshal(&lokiMsg{
 		Streams: streams,
 	})
 	if err != nil {
-		log.Printf("promtail.ClientJson: unable to marshal a JSON document: %s\n", err)
-		return
+		c.config.logger().Errorf("promtail.ClientJson: unable to marshal a JSON document: %s", err)
+		return false, err
 	}
-
-	resp, body, err := c.client.sendReq("POST", c.config.PushURL, "application/json", &jsonMsg)
-	if err != nil {
-		log.Printf("promtail.ClientJson: unable to send an HTTP request: %s\n", err)
-		return
+	if c.config.Gzip {
+		jsonMsg, err = gzipBody(jsonMsg)
+		if err != nil {
+			c.config.logger().Errorf("promtail.ClientJson: unable to compress a JSON document: %s", err)
+			return false, err
+		}
 	}
 
-	if resp.StatusCode != 204 {
-		log.Printf("promtail.ClientJson: Unexpected HTTP status code: %d, message: %s\n", resp.StatusCode, body)
-		return
+	buffered, err := c.sender.send(ctx, jsonMsg)
+	if err != nil {
+		c.config.logger().Errorf("promtail.ClientJson: %s", err)
+		return false, err
 	}
+	return buffered, nil
 }
 
 /// OLD IMPLEMENTATION
@@ -221,7 +390,7 @@ func (c *clientJson) flush() {
 //			return
 //		case entry := <-c.entries:
 //			if entry.level >= c.config.PrintLevel {
-//				log.Print(entry.Line)
+//				c.config.printEntry(entry.level, entry.Line)
 //			}
 //
 //			if entry.level >= c.config.SendLevel {
@@ -255,7 +424,7 @@ func (c *clientJson) flush() {
 //	msg := promtailMsg{Streams: streams}
 //	jsonMsg, err := json.Marshal(msg)
 //	if err != nil {
-//		log.Printf("promtail.ClientJson: unable to marshal a JSON document: %s\n", err)
+//		c.config.logger().Errorf("promtail.ClientJson: unable to marshal a JSON document: %s", err)
 //		return
 //	}
 //
@@ -0,0 +1,86 @@
+package promtail
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestJsonClientKeepsStreamOrder(t *testing.T) {
+	var lock sync.Mutex
+	received := map[string][]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg struct {
+			Streams []struct {
+				Stream map[string]string `json:"stream"`
+				Values [][]string        `json:"values"`
+			} `json:"streams"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// slow pushes down unevenly, a push overtaking an earlier one would show up as a reordering
+		time.Sleep(time.Duration(rand.Intn(3)) * time.Millisecond)
+		lock.Lock()
+		defer lock.Unlock()
+		for _, stream := range msg.Streams {
+			for _, value := range stream.Values {
+				seq, _ := strconv.Atoi(value[1])
+				received[stream.Stream["stream"]] = append(received[stream.Stream["stream"]], seq)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	client, err := NewClientJsonV2(ClientConfig{
+		PushURL:            server.URL,
+		BatchWait:          time.Hour,
+		BatchEntriesNumber: 7,
+		SendLevel:          INFO,
+		PrintLevel:         DISABLE,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const perStream = 300
+	streams := []string{"a", "b", "c"}
+	for i := 0; i < perStream; i++ {
+		for _, stream := range streams {
+			err := client.Push(context.Background(), Entry{Line: fmt.Sprint(i), Labels: map[string]string{"stream": stream}, Level: INFO})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	report, err := client.Flush(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Delivered != perStream*len(streams) {
+		t.Errorf("delivered %d entries, want %d", report.Delivered, perStream*len(streams))
+	}
+	if err := client.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, stream := range streams {
+		seqs := received[stream]
+		if len(seqs) != perStream {
+			t.Fatalf("stream %v: received %d entries, want %d", stream, len(seqs), perStream)
+		}
+		for i, seq := range seqs {
+			if seq != i {
+				t.Fatalf("stream %v: entry %d arrived at position %d", stream, seq, i)
+			}
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package promtail
+
+import "log"
+
+// Logger is what the client logs through, a *logrus.Logger or *logrus.Entry satisfies it
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// stdLogger logs every level through the standard log package, it is used when ClientConfig.Logger is not set
+type stdLogger struct{}
+
+func (stdLogger) Debugf(format string, args ...interface{}) { log.Printf(format, args...) }
+func (stdLogger) Infof(format string, args ...interface{})  { log.Printf(format, args...) }
+func (stdLogger) Warnf(format string, args ...interface{})  { log.Printf(format, args...) }
+func (stdLogger) Errorf(format string, args ...interface{}) { log.Printf(format, args...) }
+
+// logger is the Logger of the config, the standard log package if none is set
+func (conf *ClientConfig) logger() Logger {
+	if conf == nil || conf.Logger == nil {
+		return stdLogger{}
+	}
+	return conf.Logger
+}
+
+// printEntry logs the line of an entry printed locally at the level of the entry
+func (conf *ClientConfig) printEntry(level LogLevel, line string) {
+	logger := conf.logger()
+	switch level {
+	case DEBUG:
+		logger.Debugf("%s", line)
+	case INFO:
+		logger.Infof("%s", line)
+	case WARN:
+		logger.Warnf("%s", line)
+	default:
+		logger.Errorf("%s", line)
+	}
+}
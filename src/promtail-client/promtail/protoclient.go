@@ -1,65 +1,171 @@
 package promtail
 
 import (
+	"context"
 	"fmt"
-	"github.com/cornelk/hashmap"
-	"github.com/golang/snappy"
-	"github.com/grafana/loki/pkg/logproto"
-	"log"
-	"net/http"
 	"sync"
 	"time"
 )
 
 type protoLogEntry struct {
-	entry  logproto.Entry
+	entry  protoEntry
 	level  LogLevel
 	labels string
+	// flushed marks a Flush request instead of an entry, it is closed once everything before it was sent
+	flushed chan struct{}
+	// flushCtx is the context of the Flush, it bounds the pushes of the flush
+	flushCtx context.Context
 }
 
 type clientProto struct {
-	config    *ClientConfig
-	quit      chan struct{}
-	entries   chan protoLogEntry
-	waitGroup sync.WaitGroup
-	client    httpClient
-	hashMap   *hashmap.HashMap
+	config     *ClientConfig
+	quit       chan struct{}
+	closeOnce  sync.Once
+	waitGroup  sync.WaitGroup
+	client     httpClient
+	limiter    *cardinalityLimiter
+	deliveries deliveryTracker
+	shards     []*protoShard
+
+	// ctx is the parent of the shard senders' contexts, abort cancels the pushes in flight when a shutdown runs
+	// out of time
+	ctx   context.Context
+	abort context.CancelFunc
+}
+
+// clientProtoV2 exposes clientProto through the ClientV2 interface
+type clientProtoV2 struct {
+	*clientProto
+}
+
+func (c clientProtoV2) Shutdown(ctx context.Context) error {
+	return c.shutdown(ctx)
 }
 
 func (c *clientProto) LogRaw(message string, labels map[string]string, level LogLevel) {
-	var ts time.Time
-	var err error
-	if k, ok := labels["_ts"]; ok {
-		ts, err = time.Parse("2006-01-02T15:04:05", k)
-		if err != nil {
-			log.Printf("Error parsing incoming time, using current time instead")
-			ts = time.Now().UTC()
-		}
-		delete(labels, "_ts")
+	c.LogRawAt(c.config.timestampFromLabels(labels), message, labels, level)
+}
+
+func (c *clientProto) LogRawAt(ts time.Time, message string, labels map[string]string, level LogLevel) {
+	c.LogEntry(Entry{Timestamp: ts, Line: message, Labels: labels, Level: level})
+}
+
+func (c *clientProto) LogEntry(e Entry) {
+	err := c.Push(context.Background(), e)
+	if err != nil {
+		c.config.logger().Errorf("promtail.ClientProto: %s", err)
 	}
-	mergedKeys, _ := mergeKeys_string(labels, c.config.Labels)
-	c.entries <- protoLogEntry{
-		entry: logproto.Entry{
-			Timestamp: ts,
-			Line:      message,
+}
+
+func (c *clientProto) Push(ctx context.Context, e Entry) error {
+	e.Timestamp = c.config.entryTimestamp(e.Timestamp)
+	if e.Labels == nil {
+		e.Labels = map[string]string{}
+	}
+	c.limiter.apply(&e)
+	mergedKeys, _ := mergeKeys_string(e.Labels, c.config.Labels)
+	entry := protoLogEntry{
+		entry: protoEntry{
+			Timestamp: e.Timestamp,
+			Line:      e.Line,
+			Metadata:  metadataPairs(e.Metadata),
+			done:      e.OnDelivery,
 		},
-		level:  level,
+		level:  e.Level,
 		labels: makeLabelString(mergedKeys, nil),
 	}
+	select {
+	case <-c.quit:
+		return ErrClientClosed
+	default:
+	}
+	shard := c.shards[shardIndex(entry.labels, len(c.shards))]
+	select {
+	case shard.entries <- entry:
+		shard.queueLength.Set(float64(len(shard.entries)))
+		return nil
+	case <-c.quit:
+		return ErrClientClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Flush asks every shard to send its batch and waits until all of them did
+func (c *clientProto) Flush(ctx context.Context) (DeliveryReport, error) {
+	markers := make([]chan struct{}, len(c.shards))
+	for i, shard := range c.shards {
+		markers[i] = make(chan struct{})
+		select {
+		case shard.entries <- protoLogEntry{flushed: markers[i], flushCtx: ctx}:
+		case <-c.quit:
+			return c.deliveries.take(), ErrClientClosed
+		case <-ctx.Done():
+			return DeliveryReport{}, ctx.Err()
+		}
+	}
+	for _, flushed := range markers {
+		select {
+		case <-flushed:
+		case <-ctx.Done():
+			return DeliveryReport{}, ctx.Err()
+		}
+	}
+	report := c.deliveries.take()
+	return report, report.Err
 }
 
 func NewClientProto(conf ClientConfig) (Client, error) {
+	return newClientProto(conf)
+}
+
+func NewClientProtoV2(conf ClientConfig) (ClientV2, error) {
+	client, err := newClientProto(conf)
+	if err != nil {
+		return nil, err
+	}
+	return clientProtoV2{client}, nil
+}
+
+func newClientProto(conf ClientConfig) (*clientProto, error) {
 	client := clientProto{
 		config:  &conf,
 		quit:    make(chan struct{}),
-		entries: make(chan protoLogEntry, LOG_ENTRIES_CHAN_SIZE),
-		client:  httpClient{},
-		hashMap: hashmap.New(HASHMAP_INIT_SIZE),
+		limiter: newCardinalityLimiter(conf.CardinalityLimits, conf.logger()),
+	}
+	client.ctx, client.abort = context.WithCancel(context.Background())
+	var err error
+	client.client, err = newHttpClient(client.config)
+	if err != nil {
+		client.abort()
+		return nil, err
+	}
+	workers := conf.PushWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	if conf.BufferDir != "" {
+		if err := reshardBuffers(conf.BufferDir, workers, conf.logger()); err != nil {
+			client.abort()
+			return nil, fmt.Errorf("unable to reshard %v: %w", conf.BufferDir, err)
+		}
+	}
+	for i := 0; i < workers; i++ {
+		shard, err := newProtoShard(&client, i, workers)
+		if err != nil {
+			for _, started := range client.shards {
+				started.sender.close()
+			}
+			client.abort()
+			return nil, err
+		}
+		client.shards = append(client.shards, shard)
 	}
 
-	client.waitGroup.Add(1)
-
-	go client.run2()
+	for _, shard := range client.shards {
+		client.waitGroup.Add(1)
+		go shard.run()
+	}
 
 	return &client, nil
 }
@@ -84,111 +190,24 @@ func (c *clientProto) log(format string, level LogLevel, prefix string, labels *
 	//hashmap implementatation
 
 	if (level >= c.config.SendLevel) || (level >= c.config.PrintLevel) {
-		labelString := makeLabelString(*labels, c.config.Labels)
-		c.entries <- protoLogEntry{
-			entry: logproto.Entry{
-				Timestamp: time.Now(),
-				Line:      fmt.Sprintf(prefix+format, args...),
-			},
-			level:  level,
-			labels: labelString,
-		}
+		c.LogEntry(Entry{Line: fmt.Sprintf(prefix+format, args...), Labels: *labels, Level: level})
 	}
 }
 
 func (c *clientProto) Shutdown() {
-	close(c.quit)
-	c.waitGroup.Wait()
-}
-func (c *clientProto) run2() {
-	maxWait := time.NewTimer(c.config.BatchWait)
-	batchSize := 0
-	defer func() {
-		if c.hashMap.Len() > 0 {
-			err := c.flush()
-			if err != nil {
-				log.Printf("Error encountered during flush operation: %s", err)
-			}
-		}
-
-		c.waitGroup.Done()
-	}()
-	for {
-		if batchSize > c.config.BatchEntriesNumber {
-			log.Println("batch full")
-		}
-		select {
-
-		case <-c.quit:
-			return
-
-		case entry := <-c.entries:
-			if entry.level >= c.config.PrintLevel {
-				log.Print(entry.entry.Line)
-			}
-			if entry.level >= c.config.SendLevel {
-				var streamEntry = []logproto.Entry{
-					{Timestamp: entry.entry.Timestamp, Line: entry.entry.Line},
-				}
-				if actual, loaded := c.hashMap.GetOrInsert(entry.labels, streamEntry); loaded {
-					c.hashMap.Set(entry.labels, append((actual).([]logproto.Entry), streamEntry...))
-				}
-				batchSize++
-				if batchSize >= c.config.BatchEntriesNumber {
-					err := c.flush()
-					if err != nil {
-						log.Printf("Error encountered during flush operation: %s", err)
-					}
-					batchSize = 0
-					maxWait.Reset(c.config.BatchWait)
-				}
-			}
-		case <-maxWait.C:
-			if batchSize > 0 {
-				err := c.flush()
-				if err != nil {
-					log.Printf("Error encountered during flush operation: %s", err)
-				}
-				batchSize = 0
-			}
-			maxWait.Reset(c.config.BatchWait)
-		}
-	}
-}
-func (c *clientProto) flush() error {
-	log.Printf("starting flush operation on protoclient, hashmap has %v entries", c.hashMap.Len())
-	var streams []logproto.Stream
-	for entry := range c.hashMap.Iter() {
-		streams = append(streams, logproto.Stream{Labels: (entry.Key).(string), Entries: (entry.Value).([]logproto.Entry)})
-		c.hashMap.Del(entry.Key)
-	}
-
-	req := logproto.PushRequest{
-		Streams: streams,
-	}
-	err := c.handlePushRequest(&req)
-	if err != nil {
-		_ = fmt.Errorf("error during shit %w", err)
-		return err
-	}
-	return nil
+	_ = c.shutdown(context.Background())
 }
 
-func (c *clientProto) handlePushRequest(pRequest *logproto.PushRequest) error {
-	buf, err := pRequest.Marshal()
-	buf = snappy.Encode(nil, buf)
-	resp, body, err := c.client.sendReq(http.MethodPost, c.config.PushURL, "application/x-protobuf", &buf)
+// shutdown waits for the remaining entries to be sent until ctx is done, then aborts the pushes in flight and
+// waits for the shards to stop
+func (c *clientProto) shutdown(ctx context.Context) error {
+	c.closeOnce.Do(func() { close(c.quit) })
+	err := WaitGroupContext(ctx, &c.waitGroup)
+	c.abort()
 	if err != nil {
-		log.Printf("promtail.ClientProto: unable to send an HTTP request: %s\n", err)
-		return err
-	}
-
-	if resp.StatusCode != 204 {
-		err := fmt.Errorf("promtail.ClientProto: Unexpected HTTP status code: %d, message: %s\n", resp.StatusCode, body)
-		log.Println(err)
-		return err
+		c.waitGroup.Wait()
 	}
-	return nil
+	return err
 }
 
 /// OLD IMPLEMENTATION
@@ -0,0 +1,119 @@
+package promtail
+
+import (
+	"fmt"
+	"google.golang.org/protobuf/encoding/protowire"
+	"sort"
+	"time"
+)
+
+// The logproto package of the pinned Loki version predates structured metadata, so push requests are encoded here following
+// Loki's push.proto:
+//
+//	PushRequest { repeated Stream streams = 1; }
+//	Stream      { string labels = 1; repeated Entry entries = 2; }
+//	Entry       { google.protobuf.Timestamp timestamp = 1; string line = 2; repeated LabelPair structuredMetadata = 3; }
+//	LabelPair   { string name = 1; string value = 2; }
+
+type labelPair struct {
+	Name  string
+	Value string
+}
+
+type protoEntry struct {
+	Timestamp time.Time
+	Line      string
+	Metadata  []labelPair
+	// done is Entry.OnDelivery, it is not encoded
+	done func(error)
+}
+
+type protoStream struct {
+	Labels  string
+	Entries []protoEntry
+}
+
+// metadataPairs turns a metadata map into name-sorted pairs so identical entries encode identically
+func metadataPairs(metadata map[string]string) []labelPair {
+	if len(metadata) == 0 {
+		return nil
+	}
+	pairs := make([]labelPair, 0, len(metadata))
+	for name, value := range metadata {
+		pairs = append(pairs, labelPair{Name: name, Value: value})
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Name < pairs[j].Name })
+	return pairs
+}
+
+func encodePushRequest(streams []protoStream) []byte {
+	var buf []byte
+	for _, stream := range streams {
+		buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, encodeStream(stream))
+	}
+	return buf
+}
+
+func encodeStream(stream protoStream) []byte {
+	var buf []byte
+	buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+	buf = protowire.AppendString(buf, stream.Labels)
+	for _, entry := range stream.Entries {
+		buf = protowire.AppendTag(buf, 2, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, encodeEntry(entry))
+	}
+	return buf
+}
+
+func encodeEntry(entry protoEntry) []byte {
+	var ts []byte
+	if seconds := entry.Timestamp.Unix(); seconds != 0 {
+		ts = protowire.AppendTag(ts, 1, protowire.VarintType)
+		ts = protowire.AppendVarint(ts, uint64(seconds))
+	}
+	if nanos := entry.Timestamp.Nanosecond(); nanos != 0 {
+		ts = protowire.AppendTag(ts, 2, protowire.VarintType)
+		ts = protowire.AppendVarint(ts, uint64(nanos))
+	}
+
+	var buf []byte
+	buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+	buf = protowire.AppendBytes(buf, ts)
+	buf = protowire.AppendTag(buf, 2, protowire.BytesType)
+	buf = protowire.AppendString(buf, entry.Line)
+	for _, pair := range entry.Metadata {
+		var p []byte
+		p = protowire.AppendTag(p, 1, protowire.BytesType)
+		p = protowire.AppendString(p, pair.Name)
+		p = protowire.AppendTag(p, 2, protowire.BytesType)
+		p = protowire.AppendString(p, pair.Value)
+		buf = protowire.AppendTag(buf, 3, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, p)
+	}
+	return buf
+}
+
+// decodeStreamLabels returns the labels of an encoded Stream
+func decodeStreamLabels(stream []byte) (string, error) {
+	for len(stream) > 0 {
+		num, typ, n := protowire.ConsumeTag(stream)
+		if n < 0 {
+			return "", protowire.ParseError(n)
+		}
+		stream = stream[n:]
+		if num == 1 && typ == protowire.BytesType {
+			labels, n := protowire.ConsumeString(stream)
+			if n < 0 {
+				return "", protowire.ParseError(n)
+			}
+			return labels, nil
+		}
+		n = protowire.ConsumeFieldValue(num, typ, stream)
+		if n < 0 {
+			return "", protowire.ParseError(n)
+		}
+		stream = stream[n:]
+	}
+	return "", fmt.Errorf("stream without labels")
+}
@@ -0,0 +1,103 @@
+package promtail
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var v2Clients = map[string]func(ClientConfig) (ClientV2, error){
+	"json":  NewClientJsonV2,
+	"proto": NewClientProtoV2,
+}
+
+// hangingLoki accepts push requests and never answers them, cancelled reports every request aborted by the client
+func hangingLoki(t *testing.T) (*httptest.Server, chan struct{}) {
+	cancelled := make(chan struct{}, 100)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the server only watches the connection for a client going away once the body was read
+		_, _ = io.Copy(io.Discard, r.Body)
+		select {
+		case <-r.Context().Done():
+			cancelled <- struct{}{}
+		case <-release:
+		}
+	}))
+	t.Cleanup(func() {
+		close(release)
+		server.Close()
+	})
+	return server, cancelled
+}
+
+func TestDeadlinesCancelPushesInFlight(t *testing.T) {
+	for name, newClient := range v2Clients {
+		t.Run(name+"/flush", func(t *testing.T) {
+			server, cancelled := hangingLoki(t)
+			client, err := newClient(ClientConfig{PushURL: server.URL, BatchWait: time.Hour, BatchEntriesNumber: 100, SendLevel: INFO, PrintLevel: DISABLE, Timeout: time.Minute})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := client.Push(context.Background(), Entry{Line: "a", Level: INFO}); err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			if _, err := client.Flush(ctx); !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("Flush err = %v, want %v", err, context.DeadlineExceeded)
+			}
+			select {
+			case <-cancelled:
+			case <-time.After(5 * time.Second):
+				t.Fatal("the push of the flush was not cancelled")
+			}
+			if err := client.Shutdown(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		})
+		t.Run(name+"/shutdown", func(t *testing.T) {
+			server, cancelled := hangingLoki(t)
+			client, err := newClient(ClientConfig{PushURL: server.URL, BatchWait: time.Hour, BatchEntriesNumber: 100, SendLevel: INFO, PrintLevel: DISABLE, Timeout: time.Minute})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var delivery error
+			delivered := make(chan struct{})
+			err = client.Push(context.Background(), Entry{Line: "a", Level: INFO, OnDelivery: func(err error) {
+				delivery = err
+				close(delivered)
+			}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			if err := client.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("Shutdown err = %v, want %v", err, context.DeadlineExceeded)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("Shutdown took %v", elapsed)
+			}
+			// the senders stopped before Shutdown returned, the entry was resolved already
+			select {
+			case <-delivered:
+			default:
+				t.Fatal("Shutdown returned before the push in flight was resolved")
+			}
+			if delivery == nil {
+				t.Error("the aborted entry was reported delivered")
+			}
+			select {
+			case <-cancelled:
+			case <-time.After(5 * time.Second):
+				t.Fatal("the push in flight was not cancelled")
+			}
+		})
+	}
+}
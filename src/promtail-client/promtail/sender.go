@@ -0,0 +1,311 @@
+package promtail
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxRetries = 10
+	defaultMinBackoff = 500 * time.Millisecond
+	defaultMaxBackoff = 5 * time.Minute
+)
+
+var (
+	pushRetriesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "promtail_client",
+		Name:      "push_retries_total",
+		Help:      "Number of push requests to Loki that were retried.",
+	}, []string{"status"})
+	droppedBatchesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "promtail_client",
+		Name:      "dropped_batches_total",
+		Help:      "Number of batches that were given up on.",
+	}, []string{"reason"})
+	bufferedBatchesGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "promtail_client",
+		Name:      "buffered_batches",
+		Help:      "Batches waiting in the on-disk buffer.",
+	}, []string{"dir"})
+	bufferedBytesGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "promtail_client",
+		Name:      "buffered_bytes",
+		Help:      "Bytes used by the on-disk buffer.",
+	}, []string{"dir"})
+	pushFailuresCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "promtail_client",
+		Name:      "push_failures_total",
+		Help:      "Number of push attempts to Loki that failed, by status code, 0 when no response was received.",
+	}, []string{"status"})
+	batchBytesHistogram = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "promtail_client",
+		Name:      "batch_bytes",
+		Help:      "Encoded size of the batches handed to the sender.",
+		Buckets:   prometheus.ExponentialBuckets(1024, 4, 8),
+	})
+	batchEntriesHistogram = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "promtail_client",
+		Name:      "batch_entries",
+		Help:      "Number of entries in the pushed batches.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 8),
+	})
+)
+
+// pushError describes a push attempt that did not end with 204 No Content
+type pushError struct {
+	status int // 0 when no response was received
+	err    error
+	body   []byte
+}
+
+func (e *pushError) Error() string {
+	if e.err != nil {
+		return fmt.Sprintf("unable to send an HTTP request: %s", e.err)
+	}
+	return fmt.Sprintf("unexpected HTTP status code: %d, message: %s", e.status, e.body)
+}
+
+// retryable is true for network errors, 429 and 5xx, anything else will be rejected again
+func (e *pushError) retryable() bool {
+	return e.status == 0 || e.status == http.StatusTooManyRequests || e.status >= 500
+}
+
+// batchSender pushes encoded batches to Loki, retrying with backoff and spilling to a diskQueue
+// when Loki stays unavailable. Batches are delivered in the order they were handed to send.
+type batchSender struct {
+	config      *ClientConfig
+	client      *httpClient
+	contentType string
+	// contentEncoding is set as Content-Encoding, buffered batches are stored already encoded
+	contentEncoding string
+	queue           *diskQueue
+
+	// sendLock serializes deliveries so direct sends never overtake buffered batches
+	sendLock sync.Mutex
+	kick     chan struct{}
+	quit     chan struct{}
+	wg       sync.WaitGroup
+	// ctx is cancelled when the client gives up on a shutdown or when the sender is closed, it aborts the push
+	// in flight
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newBatchSender(ctx context.Context, conf *ClientConfig, client *httpClient, contentType string, contentEncoding string) (*batchSender, error) {
+	s := &batchSender{
+		config:          conf,
+		client:          client,
+		contentType:     contentType,
+		contentEncoding: contentEncoding,
+		kick:            make(chan struct{}, 1),
+		quit:            make(chan struct{}),
+	}
+	if conf.BufferDir != "" {
+		var err error
+		s.queue, err = openDiskQueue(conf.BufferDir, conf.BufferMaxBytes, conf.logger())
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	if s.queue != nil {
+		s.wg.Add(1)
+		go s.replay()
+	}
+	return s, nil
+}
+
+// send delivers body, reporting whether it ended up in the disk buffer instead of Loki. ctx bounds the push
+// along with the sender's own context. An error is only returned if the batch is lost.
+func (s *batchSender) send(ctx context.Context, body []byte) (bool, error) {
+	batchBytesHistogram.Observe(float64(len(body)))
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+	if s.queue != nil && s.queue.len() > 0 {
+		err := s.spill(body)
+		return err == nil, err
+	}
+	ctx, cancel := s.requestContext(ctx)
+	defer cancel()
+	err := s.sendWithRetries(ctx, body)
+	if err == nil {
+		return false, nil
+	}
+	if pErr, ok := err.(*pushError); ok && !pErr.retryable() {
+		droppedBatchesCounter.WithLabelValues("rejected").Inc()
+		return false, err
+	}
+	if s.queue == nil {
+		droppedBatchesCounter.WithLabelValues("retries_exhausted").Inc()
+		return false, err
+	}
+	s.config.logger().Warnf("promtail: push failed after retries, buffering batch on disk: %s", err)
+	if err := s.spill(body); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *batchSender) spill(body []byte) error {
+	if err := s.queue.push(body); err != nil {
+		return err
+	}
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// requestContext is ctx, also cancelled with the sender's context
+func (s *batchSender) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+func (s *batchSender) sendWithRetries(ctx context.Context, body []byte) error {
+	maxRetries := s.config.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = defaultMaxRetries
+	}
+	backoff := s.minBackoff()
+	for attempt := 0; ; attempt++ {
+		err := s.sendOnce(ctx, body)
+		if err == nil {
+			return nil
+		}
+		if !err.retryable() || attempt >= maxRetries {
+			return err
+		}
+		pushRetriesCounter.WithLabelValues(fmt.Sprint(err.status)).Inc()
+		s.config.logger().Warnf("promtail: push attempt %d failed, retrying in %v: %s", attempt+1, backoff, err)
+		select {
+		case <-time.After(jitter(backoff)):
+		case <-s.quit:
+			return err
+		case <-ctx.Done():
+			return err
+		}
+		backoff = s.nextBackoff(backoff)
+	}
+}
+
+func (s *batchSender) sendOnce(ctx context.Context, body []byte) *pushError {
+	resp, resBody, err := s.client.sendReq(ctx, http.MethodPost, s.config.PushURL, s.contentType, s.contentEncoding, &body)
+	if err != nil {
+		pushFailuresCounter.WithLabelValues("0").Inc()
+		return &pushError{err: err}
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		pushFailuresCounter.WithLabelValues(fmt.Sprint(resp.StatusCode)).Inc()
+		return &pushError{status: resp.StatusCode, body: resBody}
+	}
+	return nil
+}
+
+// replay drains the disk queue in order whenever something is buffered, backing off while Loki is down
+func (s *batchSender) replay() {
+	defer s.wg.Done()
+	backoff := s.minBackoff()
+	wait := time.NewTimer(0)
+	defer wait.Stop()
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-s.kick:
+		case <-wait.C:
+		}
+		for {
+			if s.drainOne() {
+				backoff = s.minBackoff()
+				continue
+			}
+			break
+		}
+		if s.queue.len() > 0 {
+			wait.Reset(jitter(backoff))
+			backoff = s.nextBackoff(backoff)
+		}
+	}
+}
+
+// drainOne sends the oldest buffered batch and reports whether the queue advanced
+func (s *batchSender) drainOne() bool {
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+	seq, body, ok, err := s.queue.peek()
+	if !ok {
+		return false
+	}
+	if err == nil {
+		if pErr := s.sendOnce(s.ctx, body); pErr != nil {
+			if pErr.retryable() {
+				return false
+			}
+			s.config.logger().Errorf("promtail: buffered batch %d rejected by Loki, dropping it: %s", seq, pErr)
+			droppedBatchesCounter.WithLabelValues("rejected").Inc()
+		}
+	} else {
+		s.config.logger().Errorf("promtail: unable to read buffered batch %d, dropping it: %s", seq, err)
+		droppedBatchesCounter.WithLabelValues("corrupt").Inc()
+	}
+	if err := s.queue.remove(seq); err != nil {
+		s.config.logger().Errorf("promtail: unable to remove buffered batch %d: %s", seq, err)
+		return false
+	}
+	return true
+}
+
+// close stops the replay loop, aborting a replayed push in flight. Whatever is still buffered is picked up by the
+// next client using the same BufferDir.
+func (s *batchSender) close() {
+	close(s.quit)
+	s.cancel()
+	s.wg.Wait()
+	if s.queue != nil {
+		if n := s.queue.len(); n > 0 {
+			s.config.logger().Warnf("promtail: %d batches left in %v for the next run", n, s.queue.dir)
+		}
+	}
+}
+
+func (s *batchSender) minBackoff() time.Duration {
+	if s.config.MinBackoff > 0 {
+		return s.config.MinBackoff
+	}
+	return defaultMinBackoff
+}
+
+func (s *batchSender) nextBackoff(backoff time.Duration) time.Duration {
+	maxBackoff := s.config.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = defaultMaxBackoff
+	}
+	backoff *= 2
+	if backoff > maxBackoff {
+		return maxBackoff
+	}
+	return backoff
+}
+
+// jitter spreads retries of several clients by up to a quarter of the backoff
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return d
+	}
+	return d - time.Duration(rand.Int63n(int64(d)/4+1))
+}
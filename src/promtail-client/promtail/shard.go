@@ -0,0 +1,359 @@
+package promtail
+
+import (
+	"context"
+	"fmt"
+	"github.com/cornelk/hashmap"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/protobuf/encoding/protowire"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	shardQueueLengthGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "promtail_client",
+		Name:      "shard_queue_length",
+		Help:      "Entries waiting in the queue of a push worker.",
+	}, []string{"shard"})
+	shardBatchesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "promtail_client",
+		Name:      "shard_batches_total",
+		Help:      "Number of batches pushed by a push worker.",
+	}, []string{"shard"})
+	shardPushDurationHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "promtail_client",
+		Name:      "shard_push_duration_seconds",
+		Help:      "Time a push worker spent delivering a batch, retries included.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"shard"})
+)
+
+// shardIndex maps a label string to one of n shards, so that a stream always goes through the same worker
+func shardIndex(labels string, n int) int {
+	if n <= 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(labels))
+	return int(h.Sum32() % uint32(n))
+}
+
+// protoShard batches and pushes the streams hashed to it on its own goroutine. Each shard has its own
+// batchSender, so a shard stuck in retries does not hold back the others.
+type protoShard struct {
+	parent     *clientProto
+	id         string
+	entries    chan protoLogEntry
+	sender     *batchSender
+	hashMap    *hashmap.HashMap
+	batchSize  int
+	batchBytes int
+
+	queueLength  prometheus.Gauge
+	batches      prometheus.Counter
+	pushDuration prometheus.Observer
+}
+
+func newProtoShard(parent *clientProto, index int, count int) (*protoShard, error) {
+	shard := protoShard{
+		parent:  parent,
+		id:      strconv.Itoa(index),
+		entries: make(chan protoLogEntry, LOG_ENTRIES_CHAN_SIZE),
+		hashMap: hashmap.New(HASHMAP_INIT_SIZE),
+	}
+	shard.queueLength = shardQueueLengthGauge.WithLabelValues(shard.id)
+	shard.batches = shardBatchesCounter.WithLabelValues(shard.id)
+	shard.pushDuration = shardPushDurationHistogram.WithLabelValues(shard.id)
+
+	conf := parent.config
+	if count > 1 && conf.BufferDir != "" {
+		// shard 0 keeps the top level directory so batches buffered by a single worker are still replayed
+		shardConf := *conf
+		shardConf.BufferDir = shardBufferDir(conf.BufferDir, index)
+		shardConf.BufferMaxBytes = conf.BufferMaxBytes / int64(count)
+		conf = &shardConf
+	}
+	var err error
+	shard.sender, err = newBatchSender(parent.ctx, conf, &parent.client, "application/x-protobuf", "")
+	if err != nil {
+		return nil, err
+	}
+	return &shard, nil
+}
+
+func (s *protoShard) run() {
+	maxWait := time.NewTimer(s.parent.config.BatchWait)
+	defer func() {
+		// pick up whatever was pushed while shutting down
+		for {
+			select {
+			case entry := <-s.entries:
+				s.handle(entry)
+				continue
+			default:
+			}
+			break
+		}
+		if s.hashMap.Len() > 0 {
+			err := s.flush(context.Background())
+			if err != nil {
+				s.parent.config.logger().Errorf("Error encountered during flush operation: %s", err)
+			}
+		}
+		s.sender.close()
+		s.queueLength.Set(0)
+
+		s.parent.waitGroup.Done()
+	}()
+	for {
+		select {
+
+		case <-s.parent.quit:
+			return
+
+		case entry := <-s.entries:
+			s.queueLength.Set(float64(len(s.entries)))
+			if s.handle(entry) {
+				maxWait.Reset(s.parent.config.BatchWait)
+			}
+		case <-maxWait.C:
+			if s.batchSize > 0 {
+				err := s.flush(context.Background())
+				if err != nil {
+					s.parent.config.logger().Errorf("Error encountered during flush operation: %s", err)
+				}
+			}
+			maxWait.Reset(s.parent.config.BatchWait)
+		}
+	}
+}
+
+// handle adds the entry to the current batch, flushing it when it is full or on a Flush request.
+// It reports whether a flush happened.
+func (s *protoShard) handle(entry protoLogEntry) bool {
+	config := s.parent.config
+	if entry.flushed != nil {
+		if s.batchSize > 0 {
+			err := s.flush(entry.flushCtx)
+			if err != nil {
+				s.parent.config.logger().Errorf("Error encountered during flush operation: %s", err)
+			}
+		}
+		close(entry.flushed)
+		return true
+	}
+	if entry.level >= config.PrintLevel {
+		config.printEntry(entry.level, entry.entry.Line)
+	}
+	if entry.level < config.SendLevel {
+		if entry.entry.done != nil {
+			entry.entry.done(nil)
+		}
+		return false
+	}
+	flushed := false
+	size := protoEntrySize(entry.entry)
+	if config.BatchSize > 0 && s.batchSize > 0 && s.batchBytes+size > config.BatchSize {
+		err := s.flush(context.Background())
+		if err != nil {
+			s.parent.config.logger().Errorf("Error encountered during flush operation: %s", err)
+		}
+		flushed = true
+	}
+	var streamEntry = []protoEntry{entry.entry}
+	if actual, loaded := s.hashMap.GetOrInsert(entry.labels, streamEntry); loaded {
+		s.hashMap.Set(entry.labels, append((actual).([]protoEntry), streamEntry...))
+	} else {
+		s.batchBytes += len(entry.labels)
+	}
+	s.batchSize++
+	s.batchBytes += size
+	if s.batchSize >= config.BatchEntriesNumber {
+		err := s.flush(context.Background())
+		if err != nil {
+			s.parent.config.logger().Errorf("Error encountered during flush operation: %s", err)
+		}
+		return true
+	}
+	return flushed
+}
+
+// flush sends the current batch within ctx, split into several pushes if it exceeds BatchSize
+func (s *protoShard) flush(ctx context.Context) error {
+	s.parent.config.logger().Debugf("starting flush operation on protoclient shard %v, hashmap has %v entries", s.id, s.hashMap.Len())
+	var streams []protoStream
+	for entry := range s.hashMap.Iter() {
+		entries := (entry.Value).([]protoEntry)
+		if s.parent.config.SortEntries {
+			sortProtoEntries(entries)
+		}
+		streams = append(streams, protoStream{Labels: (entry.Key).(string), Entries: entries})
+		s.hashMap.Del(entry.Key)
+	}
+	s.batchSize = 0
+	s.batchBytes = 0
+
+	var lastErr error
+	for _, chunk := range splitProtoStreams(streams, s.parent.config.BatchSize) {
+		var callbacks []func(error)
+		count := 0
+		for _, stream := range chunk {
+			count += len(stream.Entries)
+			for _, e := range stream.Entries {
+				if e.done != nil {
+					callbacks = append(callbacks, e.done)
+				}
+			}
+		}
+		buffered, err := s.handlePushRequest(ctx, chunk)
+		s.parent.deliveries.resolve(callbacks, count, buffered, err)
+		if err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func (s *protoShard) handlePushRequest(ctx context.Context, streams []protoStream) (bool, error) {
+	// Loki expects the snappy block format (not the framed stream format) for protobuf pushes, which is
+	// what snappy.Encode produces
+	buf := snappy.Encode(nil, encodePushRequest(streams))
+	start := time.Now()
+	buffered, err := s.sender.send(ctx, buf)
+	s.pushDuration.Observe(time.Since(start).Seconds())
+	s.batches.Inc()
+	if err != nil {
+		err = fmt.Errorf("promtail.ClientProto: %w", err)
+		s.parent.config.logger().Errorf("%s", err)
+		return false, err
+	}
+	return buffered, nil
+}
+
+const shardDirPrefix = "shard-"
+
+// shardBufferDir is the buffer directory of a shard, shard 0 keeps the top level directory so batches buffered by a
+// single worker are still replayed
+func shardBufferDir(dir string, index int) string {
+	if index == 0 {
+		return dir
+	}
+	return filepath.Join(dir, shardDirPrefix+strconv.Itoa(index))
+}
+
+// reshardBuffers moves the batches buffered with a different number of push workers to the shards their streams
+// hash to now. A stream was buffered by a single shard, moving its batches in order puts them ahead of anything its
+// new shard pushes, which spills behind them. The directories of the shards above workers are removed.
+func reshardBuffers(dir string, workers int, logger Logger) error {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	previous := 1
+	for _, file := range files {
+		if !file.IsDir() || !strings.HasPrefix(file.Name(), shardDirPrefix) {
+			continue
+		}
+		if index, err := strconv.Atoi(strings.TrimPrefix(file.Name(), shardDirPrefix)); err == nil && index >= previous {
+			previous = index + 1
+		}
+	}
+	if previous == workers {
+		return nil
+	}
+
+	// the batches are moved without a budget, the shards apply it to the batches they buffer next
+	count := previous
+	if workers > count {
+		count = workers
+	}
+	queues := make([]*diskQueue, count)
+	for i := range queues {
+		queues[i], err = openDiskQueue(shardBufferDir(dir, i), 0, logger)
+		if err != nil {
+			return err
+		}
+	}
+	moved := 0
+	for i := 0; i < previous; i++ {
+		queue := queues[i]
+		// batches moved to the shard's own queue are appended, only the ones present before are moved
+		for n := queue.len(); n > 0; n-- {
+			seq, body, _, err := queue.peek()
+			if err != nil {
+				return err
+			}
+			parts, err := splitPushRequest(body, workers)
+			if err != nil {
+				// Loki rejects it as well, the shard drops it once it is replayed
+				logger.Warnf("promtail: unable to reshard buffered batch %d of %v, moving it as is: %s", seq, queue.dir, err)
+				parts = map[int][]byte{0: body}
+			}
+			for shard := 0; shard < workers; shard++ {
+				if part, ok := parts[shard]; ok {
+					if err := queues[shard].push(part); err != nil {
+						return err
+					}
+				}
+			}
+			if err := queue.remove(seq); err != nil {
+				return err
+			}
+			moved++
+		}
+	}
+	for i := workers; i < previous; i++ {
+		if err := os.RemoveAll(queues[i].dir); err != nil {
+			return err
+		}
+		bufferedBatchesGauge.DeleteLabelValues(queues[i].dir)
+		bufferedBytesGauge.DeleteLabelValues(queues[i].dir)
+	}
+	logger.Infof("promtail: moved %d batches buffered by %d push workers to %d", moved, previous, workers)
+	return nil
+}
+
+// splitPushRequest splits a buffered protobuf push request by the shard every stream hashes to
+func splitPushRequest(body []byte, workers int) (map[int][]byte, error) {
+	request, err := snappy.Decode(nil, body)
+	if err != nil {
+		return nil, err
+	}
+	parts := map[int][]byte{}
+	for len(request) > 0 {
+		num, typ, n := protowire.ConsumeTag(request)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		request = request[n:]
+		if num != 1 || typ != protowire.BytesType {
+			return nil, fmt.Errorf("unexpected field %d in push request", num)
+		}
+		stream, n := protowire.ConsumeBytes(request)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		request = request[n:]
+		labels, err := decodeStreamLabels(stream)
+		if err != nil {
+			return nil, err
+		}
+		shard := shardIndex(labels, workers)
+		parts[shard] = protowire.AppendBytes(protowire.AppendTag(parts[shard], 1, protowire.BytesType), stream)
+	}
+	for shard, part := range parts {
+		parts[shard] = snappy.Encode(nil, part)
+	}
+	return parts, nil
+}
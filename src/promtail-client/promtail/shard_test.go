@@ -0,0 +1,276 @@
+package promtail
+
+import (
+	"context"
+	"fmt"
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLoki decodes the snappy protobuf pushes it receives and keeps the lines of every stream in arrival order
+type fakeLoki struct {
+	*httptest.Server
+	lock    sync.Mutex
+	streams map[string][]string
+}
+
+func newFakeLoki(t *testing.T) *fakeLoki {
+	loki := &fakeLoki{streams: map[string][]string{}}
+	loki.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/x-protobuf" {
+			http.Error(w, "unexpected content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err == nil {
+			body, err = snappy.Decode(nil, body)
+		}
+		var streams []protoStream
+		if err == nil {
+			streams, err = decodePushRequest(body)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// slow pushes down unevenly, a push overtaking an earlier one would show up as a reordering
+		time.Sleep(time.Duration(rand.Intn(3)) * time.Millisecond)
+		loki.lock.Lock()
+		defer loki.lock.Unlock()
+		for _, stream := range streams {
+			for _, entry := range stream.Entries {
+				loki.streams[stream.Labels] = append(loki.streams[stream.Labels], entry.Line)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(loki.Close)
+	return loki
+}
+
+func (l *fakeLoki) received() map[string][]string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	received := make(map[string][]string, len(l.streams))
+	for labels, lines := range l.streams {
+		received[labels] = append([]string(nil), lines...)
+	}
+	return received
+}
+
+func decodePushRequest(buf []byte) ([]protoStream, error) {
+	var streams []protoStream
+	err := decodeMessage(buf, func(num protowire.Number, value []byte) error {
+		if num != 1 {
+			return nil
+		}
+		var stream protoStream
+		err := decodeMessage(value, func(num protowire.Number, value []byte) error {
+			switch num {
+			case 1:
+				stream.Labels = string(value)
+			case 2:
+				return decodeMessage(value, func(num protowire.Number, value []byte) error {
+					if num == 2 {
+						stream.Entries = append(stream.Entries, protoEntry{Line: string(value)})
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+		streams = append(streams, stream)
+		return err
+	})
+	return streams, err
+}
+
+// decodeMessage calls field for every length delimited field of buf
+func decodeMessage(buf []byte, field func(num protowire.Number, value []byte) error) error {
+	for len(buf) > 0 {
+		num, typ, n := protowire.ConsumeTag(buf)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		buf = buf[n:]
+		if typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, buf)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			buf = buf[n:]
+			continue
+		}
+		value, n := protowire.ConsumeBytes(buf)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		buf = buf[n:]
+		if err := field(num, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkOrder fails unless every stream received the lines 0 to count-1 in order
+func checkOrder(t *testing.T, received map[string][]string, streams []string, count int) {
+	t.Helper()
+	for _, stream := range streams {
+		lines := received[stream]
+		if len(lines) != count {
+			t.Fatalf("stream %v: received %d entries, want %d", stream, len(lines), count)
+		}
+		for i, line := range lines {
+			if line != strconv.Itoa(i) {
+				t.Fatalf("stream %v: entry %v arrived at position %d", stream, line, i)
+			}
+		}
+	}
+}
+
+func streamLabels(n int) ([]map[string]string, []string) {
+	labels := make([]map[string]string, n)
+	names := make([]string, n)
+	for i := range labels {
+		labels[i] = map[string]string{"stream": fmt.Sprint(i)}
+		names[i] = makeLabelString(labels[i], nil)
+	}
+	return labels, names
+}
+
+func TestProtoClientKeepsStreamOrderAcrossWorkers(t *testing.T) {
+	loki := newFakeLoki(t)
+	client, err := NewClientProtoV2(ClientConfig{
+		PushURL:            loki.URL,
+		BatchWait:          time.Hour,
+		BatchEntriesNumber: 7,
+		PushWorkers:        4,
+		SendLevel:          INFO,
+		PrintLevel:         DISABLE,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const perStream = 300
+	labels, streams := streamLabels(8)
+	for i := 0; i < perStream; i++ {
+		for _, stream := range labels {
+			if err := client.Push(context.Background(), Entry{Line: strconv.Itoa(i), Labels: stream, Level: INFO}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	report, err := client.Flush(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Delivered != perStream*len(labels) {
+		t.Errorf("delivered %d entries, want %d", report.Delivered, perStream*len(labels))
+	}
+	if err := client.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	checkOrder(t, loki.received(), streams, perStream)
+}
+
+func TestProtoClientReshardsBufferedBatches(t *testing.T) {
+	for _, tt := range []struct{ previous, workers int }{{3, 2}, {4, 1}, {1, 3}, {2, 5}} {
+		t.Run(fmt.Sprintf("%d to %d workers", tt.previous, tt.workers), func(t *testing.T) {
+			dir := t.TempDir()
+			labels, streams := streamLabels(6)
+			// what a client with the previous number of workers left behind while Loki was down: batches of two
+			// entries per stream in the shard of the stream
+			const buffered = 10
+			queues := make([]*diskQueue, tt.previous)
+			for i := range queues {
+				var err error
+				if queues[i], err = openDiskQueue(shardBufferDir(dir, i), 0, stdLogger{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 0; i < buffered; i += 2 {
+				batches := map[int][]protoStream{}
+				for _, stream := range streams {
+					shard := shardIndex(stream, tt.previous)
+					batches[shard] = append(batches[shard], protoStream{Labels: stream, Entries: []protoEntry{
+						{Timestamp: time.Now(), Line: strconv.Itoa(i)},
+						{Timestamp: time.Now(), Line: strconv.Itoa(i + 1)},
+					}})
+				}
+				for shard, batch := range batches {
+					if err := queues[shard].push(snappy.Encode(nil, encodePushRequest(batch))); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			loki := newFakeLoki(t)
+			client, err := NewClientProtoV2(ClientConfig{
+				PushURL:            loki.URL,
+				BatchWait:          time.Hour,
+				BatchEntriesNumber: 5,
+				PushWorkers:        tt.workers,
+				BufferDir:          dir,
+				MinBackoff:         10 * time.Millisecond,
+				SendLevel:          INFO,
+				PrintLevel:         DISABLE,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			const fresh = 20
+			for i := buffered; i < buffered+fresh; i++ {
+				for _, stream := range labels {
+					if err := client.Push(context.Background(), Entry{Line: strconv.Itoa(i), Labels: stream, Level: INFO}); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if _, err := client.Flush(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			// Loki gets a replayed batch before the sender removes it, shutting down in between keeps it for the
+			// next run, so the buffer is waited for as well
+			var leftovers []string
+			deadline := time.Now().Add(10 * time.Second)
+			for {
+				received := loki.received()
+				complete := true
+				for _, stream := range streams {
+					complete = complete && len(received[stream]) >= buffered+fresh
+				}
+				nested, _ := filepath.Glob(filepath.Join(dir, "*", "*"+walSegmentSuffix))
+				top, _ := filepath.Glob(filepath.Join(dir, "*"+walSegmentSuffix))
+				leftovers = append(nested, top...)
+				if (complete && len(leftovers) == 0) || time.Now().After(deadline) {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if err := client.Shutdown(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			checkOrder(t, loki.received(), streams, buffered+fresh)
+
+			for i := tt.workers; i < tt.previous; i++ {
+				if _, err := os.Stat(shardBufferDir(dir, i)); !os.IsNotExist(err) {
+					t.Errorf("the directory of shard %d is left: %v", i, err)
+				}
+			}
+			if len(leftovers) > 0 {
+				t.Errorf("batches left in the buffer: %v", leftovers)
+			}
+		})
+	}
+}
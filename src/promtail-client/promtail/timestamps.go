@@ -0,0 +1,97 @@
+package promtail
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimestampLabel can be set on LogRaw labels to carry the entry timestamp, it is removed before the labels are sent
+const TimestampLabel = "_ts"
+
+// timestampLayouts are tried in order by ParseTimestamp, layouts without a zone are read as UTC
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	time.RFC1123Z,
+	time.RFC1123,
+}
+
+var clampedEntriesCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "promtail_client",
+	Name:      "clamped_entries_total",
+	Help:      "Number of entries whose timestamp was older than MaxEntryAge and was clamped.",
+})
+
+// ParseTimestamp accepts the timestamp formats found in O365 audit records (with or without fractional
+// seconds and zone) as well as unix seconds, milliseconds or nanoseconds
+func ParseTimestamp(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range timestampLayouts {
+		if ts, err := time.ParseInLocation(layout, value, time.UTC); err == nil {
+			return ts.UTC(), nil
+		}
+	}
+	if unix, err := strconv.ParseInt(value, 10, 64); err == nil {
+		switch {
+		case unix > 1e17:
+			return time.Unix(0, unix).UTC(), nil
+		case unix > 1e11:
+			return time.UnixMilli(unix).UTC(), nil
+		default:
+			return time.Unix(unix, 0).UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized timestamp format: %q", value)
+}
+
+// timestampFromLabels pops TimestampLabel from labels, returning the zero time if it is absent or unparsable
+func (conf *ClientConfig) timestampFromLabels(labels map[string]string) time.Time {
+	value, ok := labels[TimestampLabel]
+	if !ok {
+		return time.Time{}
+	}
+	delete(labels, TimestampLabel)
+	ts, err := ParseTimestamp(value)
+	if err != nil {
+		conf.logger().Warnf("Error parsing incoming time, using current time instead: %s", err)
+	}
+	return ts
+}
+
+// entryTimestamp fills in the current time for missing timestamps and clamps entries older than MaxEntryAge,
+// which Loki would otherwise reject
+func (conf *ClientConfig) entryTimestamp(ts time.Time) time.Time {
+	now := time.Now()
+	if ts.IsZero() {
+		return now
+	}
+	if conf.MaxEntryAge > 0 {
+		if oldest := now.Add(-conf.MaxEntryAge); ts.Before(oldest) {
+			clampedEntriesCounter.Inc()
+			return oldest
+		}
+	}
+	return ts
+}
+
+// sortProtoEntries orders the entries of a stream by timestamp, keeping the arrival order of equal timestamps
+func sortProtoEntries(entries []protoEntry) {
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Timestamp.Before(entries[j].Timestamp) })
+}
+
+// sortJsonValues orders values by their nanosecond timestamp
+func sortJsonValues(values []lokiValue) {
+	sort.SliceStable(values, func(i, j int) bool {
+		if len(values[i].ts) != len(values[j].ts) {
+			return len(values[i].ts) < len(values[j].ts)
+		}
+		return values[i].ts < values[j].ts
+	})
+}
@@ -0,0 +1,95 @@
+package promtail
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		// the CreationTime of O365 audit records has no zone, it is UTC
+		{value: "2022-07-01T10:00:00", want: time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)},
+		{value: "2022-07-01T10:00:00.1234567", want: time.Date(2022, 7, 1, 10, 0, 0, 123456700, time.UTC)},
+		{value: "2022-07-01T10:00:00Z", want: time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)},
+		{value: "2022-07-01T12:00:00.5+02:00", want: time.Date(2022, 7, 1, 10, 0, 0, 500000000, time.UTC)},
+		{value: "2022-07-01 10:00:00", want: time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)},
+		{value: "2022-07-01 12:00:00+02:00", want: time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)},
+		{value: "Fri, 01 Jul 2022 12:00:00 +0200", want: time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)},
+		{value: "Fri, 01 Jul 2022 10:00:00 UTC", want: time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)},
+		{value: " 2022-07-01T10:00:00 ", want: time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)},
+		// unix seconds up to 1e11, milliseconds up to 1e17 and nanoseconds beyond
+		{value: "1656669600", want: time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)},
+		{value: "100000000000", want: time.Unix(100000000000, 0).UTC()},
+		{value: "100000000001", want: time.UnixMilli(100000000001).UTC()},
+		{value: "1656669600123", want: time.Date(2022, 7, 1, 10, 0, 0, 123000000, time.UTC)},
+		{value: "100000000000000000", want: time.UnixMilli(100000000000000000).UTC()},
+		{value: "100000000000000001", want: time.Unix(0, 100000000000000001).UTC()},
+		{value: "1656669600123456789", want: time.Date(2022, 7, 1, 10, 0, 0, 123456789, time.UTC)},
+		{value: "07/01/2022 10:00", wantErr: true},
+		{value: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseTimestamp(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseTimestamp(%q) err = %v, want an error: %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !got.Equal(tt.want) || got.Location() != time.UTC {
+			t.Errorf("ParseTimestamp(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestEntryTimestamp(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name        string
+		maxEntryAge time.Duration
+		ts          time.Time
+		// want is the timestamp relative to now, wantExact the timestamp itself
+		want      time.Duration
+		wantExact time.Time
+	}{
+		{name: "missing is now", maxEntryAge: time.Hour, want: 0},
+		{name: "recent is kept", maxEntryAge: time.Hour, ts: now.Add(-30 * time.Minute), wantExact: now.Add(-30 * time.Minute)},
+		{name: "old is clamped", maxEntryAge: time.Hour, ts: now.Add(-3 * time.Hour), want: -time.Hour},
+		{name: "old is kept without a maximum age", ts: now.Add(-3 * time.Hour), wantExact: now.Add(-3 * time.Hour)},
+		{name: "future is kept", maxEntryAge: time.Hour, ts: now.Add(time.Minute), wantExact: now.Add(time.Minute)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := &ClientConfig{MaxEntryAge: tt.maxEntryAge}
+			before := time.Now()
+			got := conf.entryTimestamp(tt.ts)
+			after := time.Now()
+			if !tt.wantExact.IsZero() {
+				if !got.Equal(tt.wantExact) {
+					t.Errorf("entryTimestamp = %v, want %v", got, tt.wantExact)
+				}
+				return
+			}
+			if got.Before(before.Add(tt.want)) || got.After(after.Add(tt.want)) {
+				t.Errorf("entryTimestamp = %v, want now%+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimestampFromLabels(t *testing.T) {
+	conf := &ClientConfig{}
+	labels := map[string]string{"job": "o365", TimestampLabel: "2022-07-01T10:00:00"}
+	if got := conf.timestampFromLabels(labels); !got.Equal(time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("timestamp = %v, want the O365 CreationTime as UTC", got)
+	}
+	if _, ok := labels[TimestampLabel]; ok {
+		t.Error("the timestamp label is sent to Loki")
+	}
+	labels[TimestampLabel] = "yesterday"
+	if got := conf.timestampFromLabels(labels); !got.IsZero() {
+		t.Errorf("unparsable timestamp = %v, want the zero time", got)
+	}
+}
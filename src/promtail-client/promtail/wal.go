@@ -0,0 +1,143 @@
+package promtail
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const walSegmentSuffix = ".batch"
+
+type walSegment struct {
+	seq  uint64
+	size int64
+}
+
+// diskQueue is a FIFO of encoded push bodies, one file per batch, used to hold batches while Loki is unavailable.
+// Files are named after a monotonically increasing sequence number so the order survives restarts.
+type diskQueue struct {
+	dir      string
+	maxBytes int64
+	logger   Logger
+
+	lock     sync.Mutex
+	segments []walSegment
+	size     int64
+	nextSeq  uint64
+}
+
+// openDiskQueue creates dir if needed and picks up any batches left behind by a previous run
+func openDiskQueue(dir string, maxBytes int64, logger Logger) (*diskQueue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("unable to create buffer directory %v: %w", dir, err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	q := &diskQueue{dir: dir, maxBytes: maxBytes, logger: logger}
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasSuffix(name, walSegmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, walSegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		q.segments = append(q.segments, walSegment{seq: seq, size: file.Size()})
+		q.size += file.Size()
+	}
+	sort.Slice(q.segments, func(i, j int) bool { return q.segments[i].seq < q.segments[j].seq })
+	if n := len(q.segments); n > 0 {
+		q.nextSeq = q.segments[n-1].seq + 1
+		logger.Infof("promtail: found %d buffered batches (%d bytes) in %v, replaying", n, q.size, dir)
+	}
+	q.updateMetrics()
+	return q, nil
+}
+
+func (q *diskQueue) path(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", seq, walSegmentSuffix))
+}
+
+// push appends a batch. A batch beyond the disk budget is rejected, the buffered ones were reported delivered and
+// cannot be given up for it.
+func (q *diskQueue) push(body []byte) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	size := int64(len(body))
+	if q.maxBytes > 0 && q.size+size > q.maxBytes {
+		droppedBatchesCounter.WithLabelValues("buffer_full").Inc()
+		return fmt.Errorf("batch of %d bytes exceeds the buffer budget of %d bytes, %d in use", size, q.maxBytes, q.size)
+	}
+
+	seq := q.nextSeq
+	tmpPath := q.path(seq) + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(body); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, q.path(seq))
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("unable to write buffered batch: %w", err)
+	}
+	q.nextSeq++
+	q.segments = append(q.segments, walSegment{seq: seq, size: size})
+	q.size += size
+	q.updateMetrics()
+	return nil
+}
+
+// peek returns the oldest batch without removing it
+func (q *diskQueue) peek() (uint64, []byte, bool, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if len(q.segments) == 0 {
+		return 0, nil, false, nil
+	}
+	seq := q.segments[0].seq
+	body, err := ioutil.ReadFile(q.path(seq))
+	return seq, body, true, err
+}
+
+// remove deletes the batch with the given sequence number, which must be the oldest one
+func (q *diskQueue) remove(seq uint64) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if len(q.segments) == 0 || q.segments[0].seq != seq {
+		return fmt.Errorf("batch %d is not at the head of the buffer", seq)
+	}
+	if err := os.Remove(q.path(seq)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	q.size -= q.segments[0].size
+	q.segments = q.segments[1:]
+	q.updateMetrics()
+	return nil
+}
+
+func (q *diskQueue) len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.segments)
+}
+
+func (q *diskQueue) updateMetrics() {
+	bufferedBatchesGauge.WithLabelValues(q.dir).Set(float64(len(q.segments)))
+	bufferedBytesGauge.WithLabelValues(q.dir).Set(float64(q.size))
+}
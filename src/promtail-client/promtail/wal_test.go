@@ -0,0 +1,41 @@
+package promtail
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDiskQueueRejectsBatchesOverBudget(t *testing.T) {
+	dir := t.TempDir()
+	queue, err := openDiskQueue(dir, 100, stdLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := bytes.Repeat([]byte("a"), 60)
+	if err := queue.push(first); err != nil {
+		t.Fatal(err)
+	}
+	// the buffered batch was reported delivered, the new one is refused instead of evicting it
+	if err := queue.push(bytes.Repeat([]byte("b"), 60)); err == nil {
+		t.Fatal("a batch over the budget was buffered")
+	}
+	if err := queue.push(bytes.Repeat([]byte("c"), 40)); err != nil {
+		t.Fatalf("a batch within the budget was refused: %v", err)
+	}
+	if queue.len() != 2 {
+		t.Errorf("%d batches buffered, want 2", queue.len())
+	}
+	_, body, ok, err := queue.peek()
+	if !ok || err != nil || !bytes.Equal(body, first) {
+		t.Errorf("oldest batch = %q, %v, %v, want the first one", body, ok, err)
+	}
+
+	// the budget holds across restarts
+	reopened, err := openDiskQueue(dir, 100, stdLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.push([]byte("d")); err == nil {
+		t.Error("the reopened queue took a batch over its budget")
+	}
+}
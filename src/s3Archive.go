@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"io"
+	"path"
+	"sync"
+	"time"
+)
+
+const (
+	// s3PartSize is the multipart chunk size, larger blobs are uploaded in parts
+	s3PartSize    = 16 * 1024 * 1024
+	s3Timeout     = 5 * time.Minute
+	s3ManifestDir = "manifests"
+	// s3ManifestInterval is how often the manifest of a running run is rewritten, it is written once more at its end
+	s3ManifestInterval = time.Minute
+)
+
+type s3Config struct {
+	// Endpoint is host:port of the S3 compatible service, e.g. s3.amazonaws.com or minio:9000
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	Insecure  bool
+	// Prefix is prepended to every key
+	Prefix      string
+	Compression string
+	TenantId    string
+	// Required fails a blob that could not be archived, so it is fetched again on the next run
+	Required bool
+}
+
+// s3ManifestEntry describes one blob of a run, the manifest of a run lists every blob archived by it and the ones that
+// failed to be, with the error
+type s3ManifestEntry struct {
+	ContentId      string `json:"contentId"`
+	ContentType    string `json:"contentType"`
+	ContentCreated string `json:"contentCreated"`
+	Key            string `json:"key"`
+	Records        int    `json:"records"`
+	Bytes          int64  `json:"bytes"`
+	Error          string `json:"error,omitempty"`
+}
+
+// s3Archive uploads every content blob as one compressed JSON lines object, keyed
+// tenant=<tenant>/contentType=<type>/date=<contentCreated date>/<contentId>.jsonl.gz. The manifest of a run, listing
+// its blobs, is written under manifests/ every s3ManifestInterval and at the end of the run, which is enough to replay
+// the archive without the Management API.
+type s3Archive struct {
+	config s3Config
+	client *minio.Client
+
+	manifestLock sync.Mutex
+	manifestKey  string
+	manifest     []s3ManifestEntry
+	// manifestWrite serializes the manifest uploads, written is the number of entries of the last one
+	manifestWrite sync.Mutex
+	written       int
+	quit          chan struct{}
+	stopped       chan struct{}
+}
+
+// s3BlobWriter streams the records of one blob to S3 while they are fetched, the object only appears once upload
+// completes it
+type s3BlobWriter struct {
+	archive    *s3Archive
+	content    ListAvailableContentResponse
+	key        string
+	pipe       *io.PipeWriter
+	compressor io.WriteCloser
+	uploaded   chan error
+	records    int
+	size       int64
+}
+
+func newS3Archive(config s3Config) (*s3Archive, error) {
+	switch config.Compression {
+	case "gzip", "zstd":
+	default:
+		return nil, fmt.Errorf("unknown archive compression %q, expected gzip or zstd", config.Compression)
+	}
+	client, err := minio.New(config.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(config.AccessKey, config.SecretKey, ""),
+		Secure: !config.Insecure,
+		Region: config.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to create S3 client: %w", err)
+	}
+	return &s3Archive{config: config, client: client}, nil
+}
+
+// startRun starts the manifest of a run, written every s3ManifestInterval until endRun
+func (a *s3Archive) startRun() {
+	a.manifestWrite.Lock()
+	a.manifestLock.Lock()
+	a.manifestKey = path.Join(a.config.Prefix, s3ManifestDir, "tenant="+a.config.TenantId, time.Now().UTC().Format("20060102T150405.000Z")+".jsonl")
+	a.manifest = nil
+	a.written = 0
+	a.manifestLock.Unlock()
+	a.manifestWrite.Unlock()
+	a.quit = make(chan struct{})
+	a.stopped = make(chan struct{})
+	go a.writeManifests(a.quit, a.stopped)
+}
+
+func (a *s3Archive) writeManifests(quit, stopped chan struct{}) {
+	defer close(stopped)
+	ticker := time.NewTicker(s3ManifestInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+			// the end of the run writes it again
+			if err := a.writeManifest(context.Background()); err != nil {
+				stageLog(stageArchive).Warn(err)
+			}
+		}
+	}
+}
+
+// endRun stops the periodic manifest writes and writes the complete manifest of the run
+func (a *s3Archive) endRun(ctx context.Context) error {
+	close(a.quit)
+	<-a.stopped
+	return a.writeManifest(ctx)
+}
+
+// key builds the object key of a blob, partitioned by tenant, content type and the day the content was created
+func (a *s3Archive) key(content ListAvailableContentResponse) string {
+	date := time.Now().UTC().Format("2006-01-02")
+	if created, err := time.Parse(time.RFC3339, content.ContentCreated); err == nil {
+		date = created.UTC().Format("2006-01-02")
+	} else if len(content.ContentCreated) >= 10 {
+		date = content.ContentCreated[:10]
+	}
+	name := content.ContentId + ".jsonl" + compressionSuffix(a.config.Compression)
+	return path.Join(a.config.Prefix, "tenant="+a.config.TenantId, "contentType="+content.ContentType, "date="+date, name)
+}
+
+// blob starts the upload of a content blob, parts of s3PartSize are sent while the records are written
+func (a *s3Archive) blob(ctx context.Context, content ListAvailableContentResponse) (*s3BlobWriter, error) {
+	reader, pipe := io.Pipe()
+	w := &s3BlobWriter{archive: a, content: content, key: a.key(content), pipe: pipe, uploaded: make(chan error, 1)}
+	var err error
+	w.compressor, err = newCompressor(w, a.config.Compression)
+	if err != nil {
+		return nil, err
+	}
+	contentEncoding := "gzip"
+	if a.config.Compression == "zstd" {
+		contentEncoding = "zstd"
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(ctx, s3Timeout)
+		defer cancel()
+		// the size is unknown, minio buffers one part at a time and completes the multipart upload at EOF
+		_, err := a.client.PutObject(ctx, a.config.Bucket, w.key, reader, -1, minio.PutObjectOptions{
+			ContentType:     "application/x-ndjson",
+			ContentEncoding: contentEncoding,
+			PartSize:        s3PartSize,
+			UserMetadata: map[string]string{
+				"audit-content-id":      content.ContentId,
+				"audit-content-type":    content.ContentType,
+				"audit-content-created": content.ContentCreated,
+			},
+		})
+		if err != nil {
+			err = fmt.Errorf("unable to archive %v: %w", w.key, err)
+		}
+		// unblock the writer when the upload stopped early
+		_ = reader.CloseWithError(err)
+		w.uploaded <- err
+	}()
+	return w, nil
+}
+
+// Write passes the compressed records to the upload
+func (w *s3BlobWriter) Write(p []byte) (int, error) {
+	n, err := w.pipe.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// write adds a page of records to the blob
+func (w *s3BlobWriter) write(records []map[string]interface{}) error {
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		if _, err := w.compressor.Write(append(line, '\n')); err != nil {
+			return err
+		}
+		w.records++
+	}
+	return nil
+}
+
+// upload completes the object and adds the blob to the manifest
+func (w *s3BlobWriter) upload() error {
+	if err := w.compressor.Close(); err != nil {
+		w.abort(err)
+		return err
+	}
+	_ = w.pipe.Close()
+	if err := <-w.uploaded; err != nil {
+		return err
+	}
+	w.archive.addManifestEntry(s3ManifestEntry{
+		ContentId:      w.content.ContentId,
+		ContentType:    w.content.ContentType,
+		ContentCreated: w.content.ContentCreated,
+		Key:            w.key,
+		Records:        w.records,
+		Bytes:          w.size,
+	})
+	return nil
+}
+
+// failed lists a blob that could not be archived in the manifest, with the key it was meant to have
+func (a *s3Archive) failed(content ListAvailableContentResponse, err error) {
+	a.addManifestEntry(s3ManifestEntry{
+		ContentId:      content.ContentId,
+		ContentType:    content.ContentType,
+		ContentCreated: content.ContentCreated,
+		Key:            a.key(content),
+		Error:          err.Error(),
+	})
+}
+
+func (a *s3Archive) addManifestEntry(entry s3ManifestEntry) {
+	a.manifestLock.Lock()
+	defer a.manifestLock.Unlock()
+	a.manifest = append(a.manifest, entry)
+}
+
+// abort cancels the upload, the incomplete multipart upload is discarded
+func (w *s3BlobWriter) abort(err error) {
+	_ = w.pipe.CloseWithError(err)
+	<-w.uploaded
+}
+
+// writeManifest uploads the manifest of the blobs archived so far in the run, one JSON line per blob
+func (a *s3Archive) writeManifest(ctx context.Context) error {
+	a.manifestWrite.Lock()
+	defer a.manifestWrite.Unlock()
+	a.manifestLock.Lock()
+	manifest, manifestKey := a.manifest, a.manifestKey
+	a.manifestLock.Unlock()
+	if len(manifest) == a.written {
+		return nil
+	}
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, entry := range manifest {
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, s3Timeout)
+	defer cancel()
+	_, err := a.client.PutObject(ctx, a.config.Bucket, manifestKey, &body, int64(body.Len()), minio.PutObjectOptions{ContentType: "application/x-ndjson"})
+	if err != nil {
+		return fmt.Errorf("unable to write archive manifest %v: %w", manifestKey, err)
+	}
+	a.written = len(manifest)
+	stageLog(stageArchive).Debugf("%d blobs in the run, manifest written to %v", len(manifest), manifestKey)
+	return nil
+}
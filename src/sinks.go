@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jmespath/go-jmespath"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"sync"
+	"time"
+)
+
+// sinkEnqueueTimeout is how long routing waits on the full buffer of a sink before failing the record for that sink
+const sinkEnqueueTimeout = 30 * time.Second
+
+var (
+	errSinkBufferFull = errors.New("sink buffer is full")
+	errSinkShutdown   = errors.New("sink shut down before the record was written")
+)
+
+var (
+	sinkRecordsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "o365_exporter",
+		Subsystem: "sink",
+		Name:      "records_total",
+		Help:      "Records seen by a sink, by result: routed, filtered, delivered, failed or dropped on a full buffer.",
+	}, []string{"sink", "result"})
+	sinkQueueLengthGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "o365_exporter",
+		Subsystem: "sink",
+		Name:      "queue_length",
+		Help:      "Records waiting in the buffer of a sink.",
+	}, []string{"sink"})
+	sinkDeliveryHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "o365_exporter",
+		Subsystem: "sink",
+		Name:      "delivery_duration_seconds",
+		Help:      "Time from routing a record to the sink reporting its outcome.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 4, 9),
+	}, []string{"sink"})
+)
+
+// Sink is an output records are routed to
+type Sink interface {
+	// Write hands a record to the sink. done is called once the sink delivered it or gave up on it, unless
+	// Write returns an error.
+	Write(ctx context.Context, entry sinkEntry, done func(error)) error
+	// Flush delivers the records written so far
+	Flush(ctx context.Context) error
+	Close(ctx context.Context) error
+}
+
+// sinkEntry is a record ready to be written, with what processRetrievedObject extracted from it
+type sinkEntry struct {
+	record   auditRecord
+	line     []byte
+	ts       time.Time
+	labels   map[string]string
+	metadata map[string]string
+}
+
+// sinkFuncs adapts an output to Sink, flush and close may be nil
+type sinkFuncs struct {
+	write func(ctx context.Context, entry sinkEntry, done func(error)) error
+	flush func(ctx context.Context) error
+	close func(ctx context.Context) error
+}
+
+func (s sinkFuncs) Write(ctx context.Context, entry sinkEntry, done func(error)) error {
+	return s.write(ctx, entry, done)
+}
+
+func (s sinkFuncs) Flush(ctx context.Context) error {
+	if s.flush == nil {
+		return nil
+	}
+	return s.flush(ctx)
+}
+
+func (s sinkFuncs) Close(ctx context.Context) error {
+	if s.close == nil {
+		return nil
+	}
+	return s.close(ctx)
+}
+
+// sinkRoute is a sink with its filter and buffer. A single worker writes the buffered records to the sink, so a
+// slow sink only fills its own buffer.
+type sinkRoute struct {
+	name    string
+	sink    Sink
+	filter  *jmespath.JMESPath
+	queue   chan routedEntry
+	stopped chan struct{}
+	router  *sinkRouter
+	// aborted makes the worker fail the buffered records instead of writing them, undelivered counts them
+	aborted     chan struct{}
+	undelivered int
+	// closeLock keeps late dead letters from writing to the closed queue
+	closeLock sync.RWMutex
+	closed    bool
+
+	queueLength prometheus.Gauge
+	delivery    prometheus.Observer
+}
+
+type routedEntry struct {
+	entry  sinkEntry
+	routed time.Time
+	// done replaces the resolver of the route, for the dead letters written to it
+	done func(error)
+}
+
+// sinkRouter fans records out to the sinks whose filter matches them. Every routed record holds its blob until the
+// sink resolves it, so a blob is only committed once all the sinks it was routed to delivered it, or the dead
+// letter queue took the records that failed.
+type sinkRouter struct {
+	routes     []*sinkRoute
+	filters    map[string]*jmespath.JMESPath
+	bufferSize int
+	// drainTimeout bounds the draining of a buffer on close, and then the flush and close of its sink
+	drainTimeout time.Duration
+
+	// deadLetters receives the failed records, without it a failure fails the blob
+	deadLetters deadLetterQueue
+	// deadLetterSink is the sink the dead letters are written to, if any. It is closed last and its own failures
+	// are not dead lettered.
+	deadLetterSink string
+	tenantId       string
+}
+
+// newSinkRouter parses the sink=JMESPath filters, a sink without filter receives every record
+func newSinkRouter(bufferSize int, filterSpecs []string) (*sinkRouter, error) {
+	if bufferSize < 1 {
+		bufferSize = 1
+	}
+	r := &sinkRouter{filters: map[string]*jmespath.JMESPath{}, bufferSize: bufferSize, drainTimeout: outputShutdownTimeout}
+	for _, spec := range filterSpecs {
+		name, expression, err := splitStringOnChar(spec, '=')
+		if err != nil {
+			return nil, err
+		}
+		r.filters[name], err = jmespath.Compile(expression)
+		if err != nil {
+			return nil, fmt.Errorf("unable to compile filter of sink %v: %w", name, err)
+		}
+	}
+	return r, nil
+}
+
+// add starts routing to sink
+func (r *sinkRouter) add(name string, sink Sink) {
+	route := &sinkRoute{
+		name:        name,
+		sink:        sink,
+		filter:      r.filters[name],
+		queue:       make(chan routedEntry, r.bufferSize),
+		stopped:     make(chan struct{}),
+		router:      r,
+		aborted:     make(chan struct{}),
+		queueLength: sinkQueueLengthGauge.WithLabelValues(name),
+		delivery:    sinkDeliveryHistogram.WithLabelValues(name),
+	}
+	r.routes = append(r.routes, route)
+	go route.run()
+}
+
+func (r *sinkRouter) hasSink(name string) bool {
+	for _, route := range r.routes {
+		if route.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkFilters reports filters naming a sink that is not configured, most likely a typo
+func (r *sinkRouter) checkFilters() error {
+	for name := range r.filters {
+		if !r.hasSink(name) {
+			return fmt.Errorf("a filter is set for sink %v, which is not configured", name)
+		}
+	}
+	return nil
+}
+
+// setDeadLetters sends the failed records to the dir, or else to the named sink
+func (r *sinkRouter) setDeadLetters(dir, sink, tenantId string) error {
+	r.tenantId = tenantId
+	switch {
+	case dir != "" && sink != "":
+		return fmt.Errorf("a dead letter dir and sink are mutually exclusive")
+	case dir != "":
+		queue, err := newDeadLetterDir(dir)
+		if err != nil {
+			return err
+		}
+		r.deadLetters = queue
+	case sink != "":
+		for _, route := range r.routes {
+			if route.name == sink {
+				r.deadLetters = deadLetterSink{route: route}
+				r.deadLetterSink = sink
+			}
+		}
+		if r.deadLetters == nil {
+			return fmt.Errorf("dead letter sink %v is not configured", sink)
+		}
+	}
+	return nil
+}
+
+// deadLetter hands a failed record to the dead letter queue, done gets the outcome of storing it. Without a queue
+// done gets err.
+func (r *sinkRouter) deadLetter(record auditRecord, line []byte, stage, sink string, err error, done func(error)) {
+	if r.deadLetters == nil || sink != "" && sink == r.deadLetterSink {
+		done(err)
+		return
+	}
+	deadLettersCounter.WithLabelValues(stage).Inc()
+	r.deadLetters.write(newDeadLetter(record, line, stage, sink, r.tenantId, err), done)
+}
+
+// route hands the entry to every sink whose filter matches, or only to the sink of the record if it has one,
+// blocking up to sinkEnqueueTimeout on a full buffer
+func (r *sinkRouter) route(entry sinkEntry) {
+	for _, route := range r.routes {
+		if entry.record.sink != "" && entry.record.sink != route.name {
+			continue
+		}
+		if !route.matches(entry) {
+			sinkRecordsCounter.WithLabelValues(route.name, "filtered").Inc()
+			continue
+		}
+		entry.record.blob.add()
+		if err := route.enqueue(routedEntry{entry: entry, routed: time.Now()}); err != nil {
+			r.deadLetter(entry.record, entry.line, deadLetterStageRoute, route.name, err, entry.record.blob.done)
+			continue
+		}
+		sinkRecordsCounter.WithLabelValues(route.name, "routed").Inc()
+	}
+}
+
+// close drains the buffers, then flushes and closes every sink, each within drainTimeout. The dead letter
+// sink and queue are closed last, the failures of the other sinks go there until they are closed.
+func (r *sinkRouter) close(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, route := range r.routes {
+		if route.name == r.deadLetterSink {
+			continue
+		}
+		wg.Add(1)
+		go func(route *sinkRoute) {
+			defer wg.Done()
+			route.close(ctx)
+		}(route)
+	}
+	wg.Wait()
+	for _, route := range r.routes {
+		if route.name == r.deadLetterSink {
+			route.close(ctx)
+		}
+	}
+	if r.deadLetters != nil {
+		if err := r.deadLetters.close(ctx); err != nil {
+			stageLog(stageDLQ).Errorf("error encountered closing the dead letter queue: %v", err)
+		}
+	}
+}
+
+func (route *sinkRoute) matches(entry sinkEntry) bool {
+	if route.filter == nil {
+		return true
+	}
+	result, err := route.filter.Search(entry.record.content)
+	if err != nil {
+		recordLog(entry.record, stageRoute).WithField(logFieldSink, route.name).Warnf("unable to evaluate filter: %v", err)
+		return false
+	}
+	return jmespathTruthy(result)
+}
+
+// enqueue buffers the entry for the worker, it gives up after sinkEnqueueTimeout on a full buffer
+func (route *sinkRoute) enqueue(routed routedEntry) error {
+	route.closeLock.RLock()
+	defer route.closeLock.RUnlock()
+	if route.closed {
+		return errSinkShutdown
+	}
+	select {
+	case route.queue <- routed:
+	default:
+		timer := time.NewTimer(sinkEnqueueTimeout)
+		select {
+		case route.queue <- routed:
+			timer.Stop()
+		case <-timer.C:
+			recordLog(routed.entry.record, stageRoute).WithField(logFieldSink, route.name).Errorf("buffer full for %v, failing record", sinkEnqueueTimeout)
+			sinkRecordsCounter.WithLabelValues(route.name, "dropped").Inc()
+			return errSinkBufferFull
+		}
+	}
+	route.queueLength.Inc()
+	return nil
+}
+
+func (route *sinkRoute) run() {
+	defer close(route.stopped)
+	for routed := range route.queue {
+		route.queueLength.Dec()
+		done := routed.done
+		if done == nil {
+			done = route.resolver(routed)
+		}
+		select {
+		case <-route.aborted:
+			route.undelivered++
+			done(errSinkShutdown)
+			continue
+		default:
+		}
+		if err := route.sink.Write(context.Background(), routed.entry, done); err != nil {
+			recordLog(routed.entry.record, stageDeliver).WithField(logFieldSink, route.name).Errorf("unable to write record: %v", err)
+			done(err)
+		}
+	}
+}
+
+// resolver returns the done callback of a routed record
+func (route *sinkRoute) resolver(routed routedEntry) func(error) {
+	return func(err error) {
+		route.delivery.Observe(time.Since(routed.routed).Seconds())
+		readiness.sinkResolved(route.name, err)
+		if err != nil {
+			sinkRecordsCounter.WithLabelValues(route.name, "failed").Inc()
+			record := routed.entry.record
+			route.router.deadLetter(record, routed.entry.line, deadLetterStageDeliver, route.name, err, record.blob.done)
+			return
+		}
+		sinkRecordsCounter.WithLabelValues(route.name, "delivered").Inc()
+		ingestionLag.observe(routed.entry.record, route.name, time.Now())
+		routed.entry.record.blob.done(nil)
+	}
+}
+
+// close drains the buffer within drainTimeout, failing what is left of it after that, then flushes and closes the
+// sink within drainTimeout of its own
+func (route *sinkRoute) close(ctx context.Context) {
+	drainCtx, cancelDrain := context.WithTimeout(ctx, route.router.drainTimeout)
+	defer cancelDrain()
+	route.closeLock.Lock()
+	route.closed = true
+	close(route.queue)
+	route.closeLock.Unlock()
+	select {
+	case <-route.stopped:
+	case <-drainCtx.Done():
+		sinkLog(route.name).Error("buffer not drained before shutdown, failing the remaining records")
+		close(route.aborted)
+	}
+	closeCtx, cancelClose := context.WithTimeout(ctx, route.router.drainTimeout)
+	defer cancelClose()
+	if err := route.sink.Flush(closeCtx); err != nil {
+		sinkLog(route.name).Errorf("error encountered flushing sink: %v", err)
+	}
+	if err := route.sink.Close(closeCtx); err != nil {
+		sinkLog(route.name).Errorf("sink did not shut down cleanly: %v", err)
+	}
+	select {
+	case <-route.stopped:
+	case <-closeCtx.Done():
+		sinkLog(route.name).Error("a write was still running when the sink was closed")
+		return
+	}
+	if route.undelivered > 0 {
+		sinkLog(route.name).Errorf("%d records were not written before shutdown", route.undelivered)
+	}
+}
+
+// jmespathTruthy follows the JMESPath notion of truth: false, null and empty strings, arrays and objects are false
+func jmespathTruthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != ""
+	case []interface{}:
+		return len(v) > 0
+	case map[string]interface{}:
+		return len(v) > 0
+	}
+	return true
+}
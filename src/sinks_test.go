@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/cornelk/hashmap"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeSink resolves its records asynchronously with err and reports overlapping Write calls
+type fakeSink struct {
+	err     error
+	writing int32
+	overlap int32
+	lock    sync.Mutex
+	lines   []string
+	// block holds the first Write until the sink is closed
+	block   chan struct{}
+	flushed bool
+	closed  bool
+}
+
+func (s *fakeSink) Write(ctx context.Context, entry sinkEntry, done func(error)) error {
+	if atomic.AddInt32(&s.writing, 1) > 1 {
+		atomic.StoreInt32(&s.overlap, 1)
+	}
+	defer atomic.AddInt32(&s.writing, -1)
+	if s.block != nil {
+		<-s.block
+	}
+	time.Sleep(100 * time.Microsecond)
+	s.lock.Lock()
+	s.lines = append(s.lines, string(entry.line))
+	s.lock.Unlock()
+	go done(s.err)
+	return nil
+}
+
+func (s *fakeSink) Flush(ctx context.Context) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.flushed = true
+	return nil
+}
+
+func (s *fakeSink) Close(ctx context.Context) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	if s.block != nil {
+		close(s.block)
+	}
+	return nil
+}
+
+func routeRecords(router *sinkRouter, blob *blobDelivery, count int) {
+	for i := 0; i < count; i++ {
+		router.route(sinkEntry{
+			record: auditRecord{content: map[string]interface{}{"Id": fmt.Sprint(i)}, contentType: "Audit.General", contentId: "blob1", blob: blob},
+			line:   []byte(fmt.Sprintf(`{"Id":"%d"}`, i)),
+		})
+	}
+}
+
+func TestDeadLetterSinkIsWrittenByItsRoute(t *testing.T) {
+	router, err := newSinkRouter(16, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failing := &fakeSink{err: errors.New("rejected")}
+	deadLetters := &fakeSink{}
+	router.add("failing", failing)
+	router.add("dlq", deadLetters)
+	if err := router.setDeadLetters("", "dlq", "tenant1"); err != nil {
+		t.Fatal(err)
+	}
+	tracker := &Tracker{hashSet: hashmap.HashMap{}}
+	blob := tracker.track("blob1")
+	const count = 200
+	routeRecords(router, blob, count)
+	blob.done(nil)
+	router.close(context.Background())
+
+	if atomic.LoadInt32(&deadLetters.overlap) != 0 {
+		t.Error("the dead letter sink was written concurrently")
+	}
+	// every record reached the dead letter sink, once routed to it and once as the dead letter of the failing sink
+	if len(deadLetters.lines) != 2*count {
+		t.Errorf("the dead letter sink got %d records, want %d", len(deadLetters.lines), 2*count)
+	}
+	if blob.hasFailed() {
+		t.Error("the blob failed although the dead letter sink took the failed records")
+	}
+}
+
+func TestRouteCloseFailsUndeliveredRecords(t *testing.T) {
+	router, err := newSinkRouter(16, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router.drainTimeout = 100 * time.Millisecond
+	stuck := &fakeSink{block: make(chan struct{})}
+	router.add("stuck", stuck)
+	tracker := &Tracker{hashSet: hashmap.HashMap{}}
+	blob := tracker.track("blob1")
+	routeRecords(router, blob, 5)
+	blob.done(nil)
+
+	router.close(context.Background())
+
+	route := router.routes[0]
+	if !stuck.flushed || !stuck.closed {
+		t.Errorf("flushed %v, closed %v, want the sink flushed and closed although the drain timed out", stuck.flushed, stuck.closed)
+	}
+	// the first record was being written when the drain timed out, the others were failed without being written
+	if route.undelivered != 4 || len(stuck.lines) != 1 {
+		t.Errorf("%d records written and %d undelivered, want 1 and 4", len(stuck.lines), route.undelivered)
+	}
+	if !blob.hasFailed() {
+		t.Error("the undelivered records did not fail the blob")
+	}
+	// a late dead letter finds the route closed instead of panicking
+	if err := route.enqueue(routedEntry{}); !errors.Is(err, errSinkShutdown) {
+		t.Errorf("enqueue on a closed route: err = %v, want %v", err, errSinkShutdown)
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	splunkBatchSize   = 500
+	splunkBatchWait   = 5 * time.Second
+	splunkTimeout     = 20 * time.Second
+	splunkAckInterval = 2 * time.Second
+	// splunkDefaultSourcetype is the sourcetype of the Splunk Add-on for Microsoft Office 365
+	splunkDefaultSourcetype = "o365:management:activity"
+)
+
+type splunkConfig struct {
+	// URL of the HTTP Event Collector, e.g. https://splunk:8088
+	URL   string
+	Token string
+	Index string
+	// Sourcetypes overrides the sourcetype per content type, splunkDefaultSourcetype is used for the others
+	Sourcetypes map[string]string
+	TenantId    string
+	TLS         *tls.Config
+	MaxRetries  int
+	// AckTimeout enables indexer acknowledgement: records are only resolved once Splunk acknowledged them,
+	// batches not acknowledged within AckTimeout fail their records
+	AckTimeout time.Duration
+}
+
+// splunkEvent is the HEC JSON event envelope
+type splunkEvent struct {
+	Time       float64           `json:"time"`
+	Source     string            `json:"source,omitempty"`
+	Sourcetype string            `json:"sourcetype"`
+	Index      string            `json:"index,omitempty"`
+	Event      json.RawMessage   `json:"event"`
+	Fields     map[string]string `json:"fields,omitempty"`
+}
+
+type splunkResponse struct {
+	Text  string `json:"text"`
+	Code  int    `json:"code"`
+	AckId *int64 `json:"ackId"`
+}
+
+// splunkPendingAck is a batch accepted by HEC that waits for the indexer acknowledgement
+type splunkPendingAck struct {
+	batch    []batchItem
+	deadline time.Time
+}
+
+// splunkOutput sends records to a Splunk HTTP Event Collector. With indexer acknowledgement the records of a
+// batch are only resolved once Splunk reports them indexed, so the Tracker never commits a blob Splunk could lose.
+type splunkOutput struct {
+	*outputBatcher
+	config  splunkConfig
+	client  http.Client
+	channel string
+
+	ackLock sync.Mutex
+	acks    map[int64]splunkPendingAck
+	// ackQuit hands pollAcks the context of close, it drains the pending acknowledgements until it is done
+	ackQuit chan context.Context
+	ackDone chan struct{}
+	// acksClosed is set once pollAcks stopped, batches sent afterwards can no longer be acknowledged
+	acksClosed bool
+	ackErr     error
+}
+
+func newSplunkOutput(config splunkConfig) (*splunkOutput, error) {
+	if config.Token == "" {
+		return nil, fmt.Errorf("a HEC token is required for the Splunk output")
+	}
+	channel, err := newChannelId()
+	if err != nil {
+		return nil, err
+	}
+	s := &splunkOutput{
+		config:  config,
+		client:  http.Client{Timeout: splunkTimeout, Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: config.TLS}},
+		channel: channel,
+		acks:    map[int64]splunkPendingAck{},
+		ackQuit: make(chan context.Context, 1),
+		ackDone: make(chan struct{}),
+	}
+	s.outputBatcher = newOutputBatcher(splunkBatchSize, splunkBatchWait, s.send)
+	if config.AckTimeout > 0 {
+		go s.pollAcks()
+	} else {
+		close(s.ackDone)
+	}
+	return s, nil
+}
+
+// newChannelId returns a random UUID identifying this client to HEC, required for indexer acknowledgement
+func newChannelId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// parseSplunkSourcetypes parses contentType=sourcetype pairs
+func parseSplunkSourcetypes(specs []string) (map[string]string, error) {
+	sourcetypes := map[string]string{}
+	for _, spec := range specs {
+		contentType, sourcetype, err := splitStringOnChar(spec, '=')
+		if err != nil {
+			return nil, err
+		}
+		sourcetypes[contentType] = sourcetype
+	}
+	return sourcetypes, nil
+}
+
+// write queues the record as an HEC event with its time taken from ts
+func (s *splunkOutput) write(ctx context.Context, record auditRecord, line []byte, ts time.Time, done func(error)) error {
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	sourcetype, ok := s.config.Sourcetypes[record.contentType]
+	if !ok {
+		sourcetype = splunkDefaultSourcetype
+	}
+	event, err := json.Marshal(splunkEvent{
+		Time:       float64(ts.UnixNano()/int64(time.Millisecond)) / 1000,
+		Source:     record.contentType,
+		Sourcetype: sourcetype,
+		Index:      s.config.Index,
+		Event:      line,
+		Fields: map[string]string{
+			"tenant":    s.config.TenantId,
+			"contentId": record.contentId,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return s.add(ctx, event, done)
+}
+
+// close sends the remaining records and waits for their acknowledgement until ctx is done
+func (s *splunkOutput) close(ctx context.Context) error {
+	err := s.outputBatcher.close(ctx)
+	if s.config.AckTimeout > 0 {
+		s.ackQuit <- ctx
+	}
+	// pollAcks gives up on the pending acknowledgements once ctx is done
+	<-s.ackDone
+	if err == nil {
+		err = s.ackErr
+	}
+	return err
+}
+
+func (s *splunkOutput) send(batch []batchItem) {
+	var body []byte
+	for _, item := range batch {
+		body = append(body, item.payload...)
+	}
+	var ackId *int64
+	err := retryWithBackoff(s.quit, s.config.MaxRetries, "splunk", func() (bool, error) {
+		response, retryable, err := s.post("/services/collector/event", body)
+		if err == nil {
+			ackId = response.AckId
+		}
+		return retryable, err
+	})
+	if err != nil {
+		sinkLog("splunk").Errorf("dropping %d events: %v", len(batch), err)
+		resolveBatch(batch, err)
+		return
+	}
+	if s.config.AckTimeout <= 0 {
+		resolveBatch(batch, nil)
+		return
+	}
+	if ackId == nil {
+		resolveBatch(batch, fmt.Errorf("splunk did not return an ackId, is indexer acknowledgement enabled on the token?"))
+		return
+	}
+	s.ackLock.Lock()
+	if s.acksClosed {
+		s.ackLock.Unlock()
+		resolveBatch(batch, errOutputClosed)
+		return
+	}
+	s.acks[*ackId] = splunkPendingAck{batch: batch, deadline: time.Now().Add(s.config.AckTimeout)}
+	s.ackLock.Unlock()
+}
+
+// post sends body to HEC, reporting whether a failure is worth retrying
+func (s *splunkOutput) post(path string, body []byte) (splunkResponse, bool, error) {
+	var response splunkResponse
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(s.config.URL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return response, false, err
+	}
+	req.Header.Set("Authorization", "Splunk "+s.config.Token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Splunk-Request-Channel", s.channel)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return response, true, err
+	}
+	defer resp.Body.Close()
+	resBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return response, true, err
+	}
+	_ = json.Unmarshal(resBody, &response)
+	if resp.StatusCode != http.StatusOK {
+		retryable := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return response, retryable, fmt.Errorf("unexpected HTTP status code: %d, message: %s", resp.StatusCode, resBody)
+	}
+	return response, false, nil
+}
+
+// pollAcks queries the acknowledgement of the pending batches until close, resolving acknowledged and expired ones
+func (s *splunkOutput) pollAcks() {
+	defer close(s.ackDone)
+	ticker := time.NewTicker(splunkAckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.checkAcks(context.Background())
+		case ctx := <-s.ackQuit:
+			// keep polling until the last batches are acknowledged or expire, or close gives up
+			for s.checkAcks(ctx) > 0 {
+				select {
+				case <-time.After(splunkAckInterval):
+				case <-ctx.Done():
+					s.failPendingAcks(ctx.Err())
+					return
+				}
+			}
+			s.failPendingAcks(nil)
+			return
+		}
+	}
+}
+
+// failPendingAcks stops accepting acknowledgements and fails the batches still waiting for one with err
+func (s *splunkOutput) failPendingAcks(err error) {
+	s.ackLock.Lock()
+	pending := s.acks
+	s.acks = map[int64]splunkPendingAck{}
+	s.acksClosed = true
+	s.ackErr = err
+	s.ackLock.Unlock()
+	for _, ack := range pending {
+		sinkLog("splunk").Errorf("%d events were not acknowledged before shutdown", len(ack.batch))
+		resolveBatch(ack.batch, err)
+	}
+}
+
+// checkAcks polls the pending acknowledgements once and returns how many are still pending
+func (s *splunkOutput) checkAcks(ctx context.Context) int {
+	s.ackLock.Lock()
+	ids := make([]int64, 0, len(s.acks))
+	for id := range s.acks {
+		ids = append(ids, id)
+	}
+	s.ackLock.Unlock()
+	if len(ids) == 0 {
+		return 0
+	}
+	query, _ := json.Marshal(map[string][]int64{"acks": ids})
+	acked := map[int64]bool{}
+	var status struct {
+		Acks map[string]bool `json:"acks"`
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(s.config.URL, "/")+"/services/collector/ack", bytes.NewReader(query))
+	if err == nil {
+		req.Header.Set("Authorization", "Splunk "+s.config.Token)
+		req.Header.Set("X-Splunk-Request-Channel", s.channel)
+		var resp *http.Response
+		resp, err = s.client.Do(req)
+		if err == nil {
+			err = json.NewDecoder(resp.Body).Decode(&status)
+			_ = resp.Body.Close()
+		}
+	}
+	if err != nil {
+		sinkLog("splunk").Warnf("unable to query indexer acknowledgements: %v", err)
+	}
+	for id, ok := range status.Acks {
+		if n, parseErr := strconv.ParseInt(id, 10, 64); parseErr == nil && ok {
+			acked[n] = true
+		}
+	}
+
+	now := time.Now()
+	s.ackLock.Lock()
+	var resolved []splunkPendingAck
+	var expired []splunkPendingAck
+	for id, pending := range s.acks {
+		switch {
+		case acked[id]:
+			resolved = append(resolved, pending)
+			delete(s.acks, id)
+		case now.After(pending.deadline):
+			expired = append(expired, pending)
+			delete(s.acks, id)
+		}
+	}
+	remaining := len(s.acks)
+	s.ackLock.Unlock()
+
+	for _, pending := range resolved {
+		resolveBatch(pending.batch, nil)
+	}
+	for _, pending := range expired {
+		sinkLog("splunk").Errorf("%d events were not acknowledged in time", len(pending.batch))
+		resolveBatch(pending.batch, fmt.Errorf("splunk did not acknowledge the batch within %v", s.config.AckTimeout))
+	}
+	return remaining
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeHEC is an HTTP Event Collector answering the event posts with the statuses of failures before accepting
+// them, and acknowledging the accepted batches when ack is set
+type fakeHEC struct {
+	*httptest.Server
+	lock     sync.Mutex
+	failures []int
+	ack      bool
+	nextId   int64
+	posts    int
+	events   []splunkEvent
+}
+
+func newFakeHEC(t *testing.T, ack bool, failures ...int) *fakeHEC {
+	hec := &fakeHEC{failures: failures, ack: ack}
+	hec.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Splunk token" || r.Header.Get("X-Splunk-Request-Channel") == "" {
+			http.Error(w, `{"text":"Invalid token","code":4}`, http.StatusForbidden)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		hec.lock.Lock()
+		defer hec.lock.Unlock()
+		switch r.URL.Path {
+		case "/services/collector/event":
+			hec.posts++
+			if len(hec.failures) > 0 {
+				status := hec.failures[0]
+				hec.failures = hec.failures[1:]
+				http.Error(w, `{"text":"Server is busy","code":9}`, status)
+				return
+			}
+			decoder := json.NewDecoder(strings.NewReader(string(body)))
+			for decoder.More() {
+				var event splunkEvent
+				if err := decoder.Decode(&event); err != nil {
+					http.Error(w, `{"text":"Invalid data format","code":6}`, http.StatusBadRequest)
+					return
+				}
+				hec.events = append(hec.events, event)
+			}
+			_, _ = fmt.Fprintf(w, `{"text":"Success","code":0,"ackId":%d}`, hec.nextId)
+			hec.nextId++
+		case "/services/collector/ack":
+			var query struct {
+				Acks []int64 `json:"acks"`
+			}
+			_ = json.Unmarshal(body, &query)
+			acks := map[string]bool{}
+			for _, id := range query.Acks {
+				acks[fmt.Sprint(id)] = hec.ack
+			}
+			_ = json.NewEncoder(w).Encode(map[string]map[string]bool{"acks": acks})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(hec.Close)
+	return hec
+}
+
+// writeSplunk writes count records and returns the channel their delivery results arrive on
+func writeSplunk(t *testing.T, output *splunkOutput, count int) chan error {
+	t.Helper()
+	results := make(chan error, count)
+	for i := 0; i < count; i++ {
+		record := auditRecord{contentType: "Audit.Exchange", contentId: "blob1"}
+		err := output.write(context.Background(), record, []byte(fmt.Sprintf(`{"Id":"%d"}`, i)), time.Now(), func(err error) { results <- err })
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return results
+}
+
+func TestSplunkIndexerAck(t *testing.T) {
+	hec := newFakeHEC(t, true)
+	output, err := newSplunkOutput(splunkConfig{URL: hec.URL, Token: "token", Index: "o365", TenantId: "tenant1", AckTimeout: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := writeSplunk(t, output, 3)
+	if err := output.close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := <-results; err != nil {
+			t.Errorf("acknowledged record failed: %v", err)
+		}
+	}
+	if len(hec.events) != 3 {
+		t.Fatalf("HEC received %d events, want 3", len(hec.events))
+	}
+	event := hec.events[0]
+	if event.Sourcetype != splunkDefaultSourcetype || event.Source != "Audit.Exchange" || event.Index != "o365" || event.Fields["tenant"] != "tenant1" {
+		t.Errorf("unexpected event envelope: %+v", event)
+	}
+}
+
+func TestSplunkAckTimeout(t *testing.T) {
+	hec := newFakeHEC(t, false)
+	output, err := newSplunkOutput(splunkConfig{URL: hec.URL, Token: "token", AckTimeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := writeSplunk(t, output, 2)
+	if err := output.close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-results; err == nil {
+			t.Error("a record that was never acknowledged was reported delivered")
+		}
+	}
+}
+
+func TestSplunkCloseGivesUpOnPendingAcks(t *testing.T) {
+	hec := newFakeHEC(t, false)
+	output, err := newSplunkOutput(splunkConfig{URL: hec.URL, Token: "token", AckTimeout: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := writeSplunk(t, output, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := output.close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("close err = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("close took %v", elapsed)
+	}
+	select {
+	case err := <-results:
+		if err == nil {
+			t.Error("the unacknowledged record was reported delivered")
+		}
+	default:
+		t.Error("close returned before the pending record was resolved")
+	}
+}
+
+func TestSplunkRetriesServerErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		failures   []int
+		maxRetries int
+		wantPosts  int
+		wantErr    bool
+	}{
+		{name: "5xx is retried", failures: []int{http.StatusServiceUnavailable, http.StatusInternalServerError}, maxRetries: 2, wantPosts: 3},
+		{name: "429 is retried", failures: []int{http.StatusTooManyRequests}, maxRetries: 2, wantPosts: 2},
+		{name: "4xx is permanent", failures: []int{http.StatusBadRequest}, maxRetries: 2, wantPosts: 1, wantErr: true},
+		{name: "retries run out", failures: []int{http.StatusBadGateway, http.StatusBadGateway}, maxRetries: 1, wantPosts: 2, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hec := newFakeHEC(t, true, tt.failures...)
+			output, err := newSplunkOutput(splunkConfig{URL: hec.URL, Token: "token", MaxRetries: tt.maxRetries})
+			if err != nil {
+				t.Fatal(err)
+			}
+			results := writeSplunk(t, output, 1)
+			// flush rather than close, closing cuts the retries short
+			if err := output.flush(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if err := output.close(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-results; (err != nil) != tt.wantErr {
+				t.Errorf("delivery err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if hec.posts != tt.wantPosts {
+				t.Errorf("HEC received %d posts, want %d", hec.posts, tt.wantPosts)
+			}
+		})
+	}
+}
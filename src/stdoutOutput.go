@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+)
+
+// stdoutOutput writes one record per line to stdout for a log shipper running next to the exporter.
+// Operational logs go to stderr so the stream only ever holds records.
+type stdoutOutput struct {
+	writer    io.Writer
+	writeLock sync.Mutex
+	// envelope wraps each record with the tenant, content type and contentId it came from
+	envelope bool
+	tenantId string
+}
+
+// recordEnvelope is the line written in envelope mode
+type recordEnvelope struct {
+	Tenant      string          `json:"tenant"`
+	ContentType string          `json:"contentType"`
+	ContentId   string          `json:"contentId"`
+	Record      json.RawMessage `json:"record"`
+}
+
+func newStdoutOutput(envelope bool, tenantId string) *stdoutOutput {
+	return &stdoutOutput{writer: os.Stdout, envelope: envelope, tenantId: tenantId}
+}
+
+// write emits line, which must be a single line of JSON, followed by a newline in one write call
+func (s *stdoutOutput) write(record auditRecord, line []byte) error {
+	if s.envelope {
+		var err error
+		line, err = json.Marshal(recordEnvelope{
+			Tenant:      s.tenantId,
+			ContentType: record.contentType,
+			ContentId:   record.contentId,
+			Record:      line,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	buf := make([]byte, 0, len(line)+1)
+	buf = append(append(buf, line...), '\n')
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	_, err := s.writer.Write(buf)
+	return err
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	syslogBatchSize = 500
+	syslogBatchWait = 5 * time.Second
+	syslogTimeout   = 20 * time.Second
+	// syslogEnterpriseId tags the structured data element, 32473 is the example number reserved by RFC 5612
+	syslogEnterpriseId = "o365@32473"
+	// syslogMaxUDPMessage is the largest UDP payload over IPv4, longer messages are truncated to fit a datagram
+	syslogMaxUDPMessage = 65507
+)
+
+// syslog severities of RFC 5424
+const (
+	severityWarning       = 4
+	severityNotice        = 5
+	severityInformational = 6
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11, "ntp": 12, "security": 13, "console": 14, "solaris-cron": 15,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// authOperations are sent with the authpriv facility instead of the configured one
+var authOperations = map[string]bool{
+	"UserLoggedIn":          true,
+	"UserLoginFailed":       true,
+	"Reset user password.":  true,
+	"Change user password.": true,
+}
+
+// noticeOperations change permissions or mail flow and are raised to notice
+var noticeOperations = map[string]bool{
+	"Add member to role.":      true,
+	"Remove member from role.": true,
+	"Add-MailboxPermission":    true,
+	"New-InboxRule":            true,
+	"Set-InboxRule":            true,
+	"Set-Mailbox":              true,
+	"Add service principal.":   true,
+	"Consent to application.":  true,
+}
+
+type syslogConfig struct {
+	// Network is udp, tcp or tls, stream transports use octet counting framing
+	Network string
+	Address string
+	// Format of the message part, rfc5424 sends the record JSON, cef and leef map the common audit fields
+	Format   string
+	Facility int
+	TenantId string
+	TLS      *tls.Config
+	// MaxRetries of a batch before its records are failed, negative disables retries
+	MaxRetries int
+}
+
+// syslogOutput sends records to a syslog receiver. Like the Loki client, messages are batched, a failed batch is
+// retried with backoff on a fresh connection, and every record reports its outcome through its done callback.
+// Retried batches may duplicate messages already written to a stream connection.
+type syslogOutput struct {
+	*outputBatcher
+	config   syslogConfig
+	hostname string
+	procId   string
+	// conn is only used by the batcher goroutine
+	conn net.Conn
+}
+
+func newSyslogOutput(config syslogConfig) (*syslogOutput, error) {
+	switch config.Network {
+	case "udp", "tcp", "tls":
+	default:
+		return nil, fmt.Errorf("unknown syslog network %q, expected udp, tcp or tls", config.Network)
+	}
+	switch config.Format {
+	case "rfc5424", "cef", "leef":
+	default:
+		return nil, fmt.Errorf("unknown syslog format %q, expected rfc5424, cef or leef", config.Format)
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "-"
+	}
+	s := &syslogOutput{
+		config:   config,
+		hostname: hostname,
+		procId:   strconv.Itoa(os.Getpid()),
+	}
+	s.outputBatcher = newOutputBatcher(syslogBatchSize, syslogBatchWait, s.send)
+	return s, nil
+}
+
+// parseSyslogFacility accepts a facility name such as local0 or its number
+func parseSyslogFacility(value string) (int, error) {
+	if facility, ok := syslogFacilities[strings.ToLower(value)]; ok {
+		return facility, nil
+	}
+	facility, err := strconv.Atoi(value)
+	if err != nil || facility < 0 || facility > 23 {
+		return 0, fmt.Errorf("unknown syslog facility %q", value)
+	}
+	return facility, nil
+}
+
+// write queues the record, blocking while the output is saturated. done is called once the record was sent or given up on.
+func (s *syslogOutput) write(ctx context.Context, record auditRecord, line []byte, ts time.Time, done func(error)) error {
+	return s.add(ctx, s.frame(record, line, ts), done)
+}
+
+// close sends the remaining messages and closes the connection
+func (s *syslogOutput) close(ctx context.Context) error {
+	err := s.outputBatcher.close(ctx)
+	if err == nil && s.conn != nil {
+		_ = s.conn.Close()
+	}
+	return err
+}
+
+// send writes a batch, reconnecting with backoff on failure, and resolves its messages
+func (s *syslogOutput) send(batch []batchItem) {
+	err := retryWithBackoff(s.quit, s.config.MaxRetries, "syslog", func() (bool, error) {
+		return true, s.sendOnce(batch)
+	})
+	if err != nil {
+		sinkLog("syslog").Errorf("dropping %d messages: %v", len(batch), err)
+	}
+	resolveBatch(batch, err)
+}
+
+func (s *syslogOutput) sendOnce(batch []batchItem) error {
+	if s.conn == nil {
+		conn, err := s.dial()
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	err := s.conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+	if err == nil {
+		if s.config.Network == "udp" {
+			// one message per datagram
+			for _, item := range batch {
+				if _, err = s.conn.Write(item.payload); err != nil {
+					break
+				}
+			}
+		} else {
+			var buf []byte
+			for _, item := range batch {
+				buf = append(buf, item.payload...)
+			}
+			_, err = s.conn.Write(buf)
+		}
+	}
+	if err != nil {
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+func (s *syslogOutput) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: syslogTimeout}
+	if s.config.Network == "tls" {
+		return tls.DialWithDialer(dialer, "tcp", s.config.Address, s.config.TLS)
+	}
+	return dialer.Dial(s.config.Network, s.config.Address)
+}
+
+// frame builds the RFC 5424 message of a record, with octet counting framing on stream transports
+func (s *syslogOutput) frame(record auditRecord, line []byte, ts time.Time) []byte {
+	operation := recordField(record.content, "Operation")
+	facility, severity := s.priority(record)
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+
+	var msg string
+	switch s.config.Format {
+	case "cef":
+		msg = formatCEF(record, ts, severity)
+	case "leef":
+		msg = formatLEEF(record, ts)
+	default:
+		msg = string(line)
+	}
+	message := fmt.Sprintf("<%d>1 %s %s %s %s %s [%s tenant=\"%s\" contentType=\"%s\" contentId=\"%s\" workload=\"%s\"] %s",
+		facility*8+severity,
+		ts.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		syslogHeaderField(s.hostname, 255),
+		"o365LogExporter",
+		s.procId,
+		syslogHeaderField(operation, 32),
+		syslogEnterpriseId,
+		syslogParamValue(s.config.TenantId),
+		syslogParamValue(record.contentType),
+		syslogParamValue(record.contentId),
+		syslogParamValue(recordField(record.content, "Workload")),
+		msg,
+	)
+	if s.config.Network == "udp" {
+		if len(message) > syslogMaxUDPMessage {
+			recordLog(record, stageDeliver).WithField(logFieldSink, "syslog").Warnf("truncating message of %d bytes to %d bytes", len(message), syslogMaxUDPMessage)
+			message = truncateUTF8(message, syslogMaxUDPMessage)
+		}
+		return []byte(message)
+	}
+	return []byte(strconv.Itoa(len(message)) + " " + message)
+}
+
+// priority derives facility and severity from the operation and its ResultStatus
+func (s *syslogOutput) priority(record auditRecord) (int, int) {
+	operation := recordField(record.content, "Operation")
+	facility := s.config.Facility
+	if authOperations[operation] {
+		facility = syslogFacilities["authpriv"]
+	}
+	severity := severityInformational
+	if noticeOperations[operation] {
+		severity = severityNotice
+	}
+	switch strings.ToLower(recordField(record.content, "ResultStatus")) {
+	case "failed", "failure", "false":
+		severity = severityWarning
+	case "partiallysucceeded":
+		if severity > severityNotice {
+			severity = severityNotice
+		}
+	}
+	if operation == "UserLoginFailed" {
+		severity = severityWarning
+	}
+	return facility, severity
+}
+
+// recordField returns a top level field of a record as a string, or "" when it is absent
+func recordField(content map[string]interface{}, name string) string {
+	value, ok := content[name]
+	if !ok || value == nil {
+		return ""
+	}
+	if str, ok := value.(string); ok {
+		return str
+	}
+	return fmt.Sprint(value)
+}
+
+// syslogHeaderField replaces a header field by NILVALUE when empty and keeps it to printable ASCII without spaces
+func syslogHeaderField(value string, maxLen int) string {
+	if value == "" {
+		return "-"
+	}
+	var b strings.Builder
+	for _, r := range value {
+		if b.Len() >= maxLen {
+			break
+		}
+		if r > 32 && r < 127 {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// truncateUTF8 cuts value to at most maxLen bytes without splitting a character
+func truncateUTF8(value string, maxLen int) string {
+	if len(value) <= maxLen {
+		return value
+	}
+	for maxLen > 0 && !utf8.RuneStart(value[maxLen]) {
+		maxLen--
+	}
+	return value[:maxLen]
+}
+
+func syslogParamValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+}
+
+// formatCEF maps the common audit fields to an ArcSight CEF event
+func formatCEF(record auditRecord, ts time.Time, severity int) string {
+	operation := recordField(record.content, "Operation")
+	// CEF severity runs from 0 to 10, the higher the worse
+	cefSeverity := map[int]int{severityWarning: 7, severityNotice: 5}[severity]
+	if cefSeverity == 0 {
+		cefSeverity = 3
+	}
+	header := strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+	extension := strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+	fields := []string{
+		"rt=" + strconv.FormatInt(ts.UnixNano()/int64(time.Millisecond), 10),
+		"externalId=" + extension.Replace(recordField(record.content, "Id")),
+		"act=" + extension.Replace(operation),
+		"suser=" + extension.Replace(recordField(record.content, "UserId")),
+		"src=" + extension.Replace(recordField(record.content, "ClientIP")),
+		"outcome=" + extension.Replace(recordField(record.content, "ResultStatus")),
+		"cat=" + extension.Replace(record.contentType),
+		"cs1Label=Workload",
+		"cs1=" + extension.Replace(recordField(record.content, "Workload")),
+		"cs2Label=OrganizationId",
+		"cs2=" + extension.Replace(recordField(record.content, "OrganizationId")),
+	}
+	return fmt.Sprintf("CEF:0|Microsoft|Office 365|1.0|%s|%s|%d|%s",
+		header.Replace(operation), header.Replace(operation), cefSeverity, strings.Join(fields, " "))
+}
+
+// formatLEEF maps the common audit fields to a QRadar LEEF 1.0 event with tab separated attributes
+func formatLEEF(record auditRecord, ts time.Time) string {
+	value := strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+	fields := []string{
+		"devTime=" + ts.UTC().Format("Jan 02 2006 15:04:05.000 UTC"),
+		"devTimeFormat=MMM dd yyyy HH:mm:ss.SSS z",
+		"externalId=" + value.Replace(recordField(record.content, "Id")),
+		"usrName=" + value.Replace(recordField(record.content, "UserId")),
+		"src=" + value.Replace(recordField(record.content, "ClientIP")),
+		"outcome=" + value.Replace(recordField(record.content, "ResultStatus")),
+		"cat=" + value.Replace(record.contentType),
+		"workload=" + value.Replace(recordField(record.content, "Workload")),
+	}
+	return fmt.Sprintf("LEEF:1.0|Microsoft|Office 365|1.0|%s|%s",
+		strings.NewReplacer(`|`, `\|`).Replace(recordField(record.content, "Operation")), strings.Join(fields, "\t"))
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+var syslogRecord = auditRecord{
+	contentType: "Audit.AzureActiveDirectory",
+	contentId:   "blob1",
+	content: map[string]interface{}{
+		"Id":           "11111111-1111-1111-1111-111111111111",
+		"Operation":    "UserLoginFailed",
+		"UserId":       "user@contoso.com",
+		"ClientIP":     "192.0.2.1",
+		"ResultStatus": "Failed",
+		"Workload":     "AzureActiveDirectory",
+	},
+}
+
+// syslogHeader matches the RFC 5424 header and structured data of the messages of syslogRecord
+var syslogHeader = regexp.MustCompile(`^<(\d+)>1 \S+ \S+ o365LogExporter \d+ UserLoginFailed \[o365@32473 tenant="tenant1" contentType="Audit.AzureActiveDirectory" contentId="blob1" workload="AzureActiveDirectory"\] `)
+
+// writeSyslog sends the records through a syslog output and waits for their delivery
+func writeSyslog(t *testing.T, config syslogConfig, lines ...string) {
+	t.Helper()
+	config.TenantId = "tenant1"
+	config.Facility = syslogFacilities["local0"]
+	config.MaxRetries = -1
+	output, err := newSyslogOutput(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := make(chan error, len(lines))
+	for _, line := range lines {
+		err := output.write(context.Background(), syslogRecord, []byte(line), time.Now(), func(err error) { results <- err })
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := output.close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for range lines {
+		if err := <-results; err != nil {
+			t.Fatalf("record not delivered: %v", err)
+		}
+	}
+}
+
+// readOctetCounted reads count messages framed with octet counting
+func readOctetCounted(t *testing.T, conn net.Conn, count int) []string {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(conn)
+	var messages []string
+	for i := 0; i < count; i++ {
+		length, err := reader.ReadString(' ')
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+		if err != nil {
+			t.Fatalf("invalid frame length %q", length)
+		}
+		message := make([]byte, n)
+		if _, err := io.ReadFull(reader, message); err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, string(message))
+	}
+	return messages
+}
+
+// checkSyslogHeader checks the header of a message and returns its message part
+func checkSyslogHeader(t *testing.T, message string) string {
+	t.Helper()
+	match := syslogHeader.FindStringSubmatch(message)
+	if match == nil {
+		t.Fatalf("unexpected message header: %.200q", message)
+	}
+	// a failed login is sent to authpriv with warning severity
+	if want := strconv.Itoa(syslogFacilities["authpriv"]*8 + severityWarning); match[1] != want {
+		t.Errorf("priority = %v, want %v", match[1], want)
+	}
+	return message[len(match[0]):]
+}
+
+func TestSyslogUDP(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	oversized := `{"Data":"` + strings.Repeat("é", syslogMaxUDPMessage/2) + `"}`
+	writeSyslog(t, syslogConfig{Network: "udp", Address: listener.LocalAddr().String(), Format: "rfc5424"}, `{"Id":"1"}`, oversized)
+
+	buf := make([]byte, 128*1024)
+	_ = listener.SetReadDeadline(time.Now().Add(10 * time.Second))
+	n, _, err := listener.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := checkSyslogHeader(t, string(buf[:n])); msg != `{"Id":"1"}` {
+		t.Errorf("message = %q, want the record", msg)
+	}
+	n, _, err = listener.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n > syslogMaxUDPMessage {
+		t.Errorf("datagram of %d bytes, want at most %d", n, syslogMaxUDPMessage)
+	}
+	msg := checkSyslogHeader(t, string(buf[:n]))
+	if !strings.HasPrefix(oversized, msg) || !utf8.ValidString(msg) {
+		t.Errorf("the oversized record was not truncated on a character boundary")
+	}
+}
+
+func TestSyslogTCPCEF(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	writeSyslog(t, syslogConfig{Network: "tcp", Address: listener.Addr().String(), Format: "cef"}, `{}`, `{}`)
+
+	conn := <-accepted
+	defer conn.Close()
+	for _, message := range readOctetCounted(t, conn, 2) {
+		msg := checkSyslogHeader(t, message)
+		for _, want := range []string{
+			"CEF:0|Microsoft|Office 365|1.0|UserLoginFailed|UserLoginFailed|7|",
+			" externalId=11111111-1111-1111-1111-111111111111 ",
+			" suser=user@contoso.com ",
+			" src=192.0.2.1 ",
+			" outcome=Failed ",
+			" cs1Label=Workload cs1=AzureActiveDirectory ",
+		} {
+			if !strings.Contains(msg, want) {
+				t.Errorf("CEF event %q does not contain %q", msg, want)
+			}
+		}
+	}
+}
+
+func TestSyslogTLSLEEF(t *testing.T) {
+	serverConfig, roots := selfSignedTLS(t)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		// the client waits for the handshake, which the server only runs on a first read otherwise
+		if err := conn.(*tls.Conn).Handshake(); err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+	writeSyslog(t, syslogConfig{Network: "tls", Address: listener.Addr().String(), Format: "leef", TLS: &tls.Config{RootCAs: roots, ServerName: "localhost"}}, `{}`)
+
+	conn := <-accepted
+	defer conn.Close()
+	msg := checkSyslogHeader(t, readOctetCounted(t, conn, 1)[0])
+	if !strings.HasPrefix(msg, "LEEF:1.0|Microsoft|Office 365|1.0|UserLoginFailed|") {
+		t.Fatalf("unexpected LEEF header: %q", msg)
+	}
+	attributes := strings.Split(msg[strings.LastIndex(msg, "|")+1:], "\t")
+	for _, want := range []string{"usrName=user@contoso.com", "src=192.0.2.1", "outcome=Failed", "cat=Audit.AzureActiveDirectory"} {
+		found := false
+		for _, attribute := range attributes {
+			found = found || attribute == want
+		}
+		if !found {
+			t.Errorf("LEEF attributes %q do not contain %q", attributes, want)
+		}
+	}
+}
+
+// selfSignedTLS returns a server configuration with a certificate for localhost and the pool trusting it
+func selfSignedTLS(t *testing.T) (*tls.Config, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}, roots
+}
@@ -1,11 +1,17 @@
 package main
 
 import (
-	"encoding/json"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"github.com/jmespath/go-jmespath"
-	"log"
+	"io/ioutil"
+	"math/rand"
+	"net/url"
+	"o365logexporter/promtail-client/promtail"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func splitStringOnChar(str string, char byte) (string, string, error) {
@@ -17,24 +23,71 @@ func splitStringOnChar(str string, char byte) (string, string, error) {
 	return "", "", fmt.Errorf("no match for split char %v found for string: %v", char, str)
 }
 
+// parseHeaderPairs parses name=value header pairs
+func parseHeaderPairs(specs []string) (map[string]string, error) {
+	headers := map[string]string{}
+	for _, spec := range specs {
+		name, value, err := splitStringOnChar(spec, '=')
+		if err != nil {
+			return nil, err
+		}
+		headers[name] = value
+	}
+	return headers, nil
+}
+
+// parseCardinalityLimit parses a label=maxValues[:window[:action]] spec, window defaults to 1h and action to bucket
+func parseCardinalityLimit(spec string) (string, promtail.CardinalityLimit, error) {
+	limit := promtail.CardinalityLimit{Window: time.Hour, Action: promtail.LabelOverflowBucket}
+	label, value, err := splitStringOnChar(spec, '=')
+	if err != nil {
+		return "", limit, err
+	}
+	parts := strings.SplitN(value, ":", 3)
+	limit.MaxValues, err = strconv.Atoi(parts[0])
+	if err != nil || limit.MaxValues <= 0 {
+		return "", limit, fmt.Errorf("invalid max values in cardinality limit %v", spec)
+	}
+	if len(parts) > 1 && parts[1] != "" {
+		limit.Window, err = time.ParseDuration(parts[1])
+		if err != nil {
+			return "", limit, fmt.Errorf("invalid window in cardinality limit %v: %w", spec, err)
+		}
+	}
+	if len(parts) > 2 {
+		limit.Action, err = promtail.ParseLabelOverflowAction(parts[2])
+		if err != nil {
+			return "", limit, err
+		}
+	}
+	return label, limit, nil
+}
+
 func logStringSani(inputStr string) string {
 	escapedStr := strings.Replace(inputStr, "\n", "", -1)
 	escapedStr = strings.Replace(escapedStr, "\r", "", -1)
 	return escapedStr
 }
 
-func extractJMESLabels(jsonData []byte, JMESLabels *map[string]string, labelMap *map[string]string) error {
-	var data interface{}
+// extractJMESLabels evaluates every expression against the record. A field missing from the record's schema is
+// skipped, a result that is not a string is an error.
+func extractJMESLabels(data interface{}, JMESLabels *map[string]string, labelMap *map[string]string) error {
 	var result interface{}
-	err := json.Unmarshal(jsonData, &data)
+	var err error
 
 	for i, s := range *JMESLabels {
 		result, err = jmespath.Search(s, data)
 		if err != nil {
-			log.Print(err)
 			return err
 		}
-		(*labelMap)[i] = result.(string)
+		if result == nil {
+			continue
+		}
+		value, ok := result.(string)
+		if !ok {
+			return fmt.Errorf("%v: %q returned %T, expected a string", i, s, result)
+		}
+		(*labelMap)[i] = value
 	}
 	return nil
 	//result, err := jmespath.Search("Operation", data)
@@ -47,3 +100,85 @@ func extractJMESLabels(jsonData []byte, JMESLabels *map[string]string, labelMap
 	//(*labelMap)["_ts"] = result.(string)
 	//return nil
 }
+
+// extractTimestamp evaluates the JMESPath expression against the record and parses the result as a timestamp
+func extractTimestamp(data interface{}, expression string) (time.Time, error) {
+	if expression == "" {
+		return time.Time{}, nil
+	}
+	result, err := jmespath.Search(expression, data)
+	if err != nil {
+		return time.Time{}, err
+	}
+	switch value := result.(type) {
+	case string:
+		return promtail.ParseTimestamp(value)
+	case float64:
+		return promtail.ParseTimestamp(strconv.FormatFloat(value, 'f', 0, 64))
+	case nil:
+		return time.Time{}, fmt.Errorf("no value found for %v", expression)
+	}
+	return time.Time{}, fmt.Errorf("unexpected timestamp value %v", result)
+}
+
+const (
+	outputMinBackoff = 500 * time.Millisecond
+	outputMaxBackoff = 5 * time.Minute
+	// outputMaxRetries is used by outputs configured with zero retries, like the Loki client
+	outputMaxRetries = 10
+)
+
+// retryWithBackoff calls attempt until it succeeds, reports a non-retryable error or maxRetries is reached, waiting an
+// exponential backoff with jitter in between. Once quit is closed a single last attempt is made.
+func retryWithBackoff(quit <-chan struct{}, maxRetries int, name string, attempt func() (bool, error)) error {
+	if maxRetries == 0 {
+		maxRetries = outputMaxRetries
+	}
+	backoff := outputMinBackoff
+	for try := 0; ; try++ {
+		retryable, err := attempt()
+		if err == nil || !retryable || try >= maxRetries {
+			return err
+		}
+		sinkLog(name).Warnf("attempt %d failed, retrying in %v: %v", try+1, backoff, err)
+		select {
+		case <-time.After(backoff - time.Duration(rand.Int63n(int64(backoff)/4+1))):
+		case <-quit:
+			// shutting down, give it one last try
+			maxRetries = try + 1
+		}
+		backoff *= 2
+		if backoff > outputMaxBackoff {
+			backoff = outputMaxBackoff
+		}
+	}
+}
+
+// loadTLSConfig verifies servers against caFile, or the system roots when it is empty
+func loadTLSConfig(caFile string, insecureSkipVerify bool) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: insecureSkipVerify}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %v", caFile)
+		}
+	}
+	return config, nil
+}
+
+// redactURL keeps the scheme, host and path of a URL, dropping the credentials its userinfo and query may hold
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "<invalid URL>"
+	}
+	redacted := url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path}
+	if u.Opaque != "" {
+		redacted.Opaque = "<redacted>"
+	}
+	return redacted.String()
+}
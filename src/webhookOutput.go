@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jmespath/go-jmespath"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	webhookBatchWait = 5 * time.Second
+	webhookTimeout   = 30 * time.Second
+	// webhookQueueSize is the batch size of the batcher when records are posted one by one
+	webhookQueueSize = 100
+)
+
+type webhookConfig struct {
+	URL     string
+	Method  string
+	Headers map[string]string
+	// Template renders the body of a record, it is given a webhookRecord
+	Template *template.Template
+	// Projection is a JMESPath expression whose result on the record is sent as JSON, used when Template is nil
+	Projection *jmespath.JMESPath
+	// BatchSize above 1 posts the bodies of up to BatchSize records as one JSON array, otherwise every record is posted alone
+	BatchSize int
+	// HMACSecret signs the body with HMAC-SHA256, sent hex encoded as sha256=<signature> in SignatureHeader
+	HMACSecret      string
+	SignatureHeader string
+	TenantId        string
+	TLS             *tls.Config
+	MaxRetries      int
+}
+
+// webhookRecord is the data of the body template
+type webhookRecord struct {
+	Tenant      string
+	ContentType string
+	ContentId   string
+	Record      map[string]interface{}
+}
+
+// webhookOutput posts records to an HTTP endpoint. 429 and 5xx responses are retried with backoff, the records of
+// requests that fail for good are failed, the dead letter queue of the router keeps them for a replay.
+type webhookOutput struct {
+	*outputBatcher
+	config webhookConfig
+	client http.Client
+}
+
+func newWebhookOutput(config webhookConfig) (*webhookOutput, error) {
+	if config.Method == "" {
+		config.Method = http.MethodPost
+	}
+	w := &webhookOutput{
+		config: config,
+		client: http.Client{Timeout: webhookTimeout, Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: config.TLS}},
+	}
+	batchSize := config.BatchSize
+	if batchSize <= 1 {
+		batchSize = webhookQueueSize
+	}
+	w.outputBatcher = newOutputBatcher(batchSize, webhookBatchWait, w.send)
+	return w, nil
+}
+
+// parseWebhookTemplate parses a body template, a value starting with @ names the file holding it
+func parseWebhookTemplate(value string) (*template.Template, error) {
+	if strings.HasPrefix(value, "@") {
+		content, err := ioutil.ReadFile(value[1:])
+		if err != nil {
+			return nil, err
+		}
+		value = string(content)
+	}
+	return template.New("webhook").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(value)
+}
+
+// write renders the body of the record and queues it
+func (w *webhookOutput) write(ctx context.Context, record auditRecord, line []byte, done func(error)) error {
+	body, err := w.render(record, line)
+	if err != nil {
+		return err
+	}
+	return w.add(ctx, body, done)
+}
+
+func (w *webhookOutput) render(record auditRecord, line []byte) ([]byte, error) {
+	var body []byte
+	switch {
+	case w.config.Template != nil:
+		var buf bytes.Buffer
+		err := w.config.Template.Execute(&buf, webhookRecord{
+			Tenant:      w.config.TenantId,
+			ContentType: record.contentType,
+			ContentId:   record.contentId,
+			Record:      record.content,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to render webhook body: %w", err)
+		}
+		body = buf.Bytes()
+	case w.config.Projection != nil:
+		result, err := w.config.Projection.Search(record.content)
+		if err != nil {
+			return nil, fmt.Errorf("unable to project webhook body: %w", err)
+		}
+		body, err = json.Marshal(result)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		body = line
+	}
+	if w.config.BatchSize > 1 && !json.Valid(body) {
+		return nil, fmt.Errorf("webhook body is not valid JSON, it cannot be sent in a batch")
+	}
+	return body, nil
+}
+
+func (w *webhookOutput) send(batch []batchItem) {
+	if w.config.BatchSize <= 1 {
+		for i := range batch {
+			w.deliver(batch[i:i+1], batch[i].payload)
+		}
+		return
+	}
+	var body []byte
+	body = append(body, '[')
+	for i, item := range batch {
+		if i > 0 {
+			body = append(body, ',')
+		}
+		body = append(body, item.payload...)
+	}
+	body = append(body, ']')
+	w.deliver(batch, body)
+}
+
+// deliver posts body for the records of batch and resolves them
+func (w *webhookOutput) deliver(batch []batchItem, body []byte) {
+	err := retryWithBackoff(w.quit, w.config.MaxRetries, "webhook", func() (bool, error) {
+		return w.post(body)
+	})
+	if err != nil {
+		sinkLog("webhook").Errorf("failing %d records: %v", len(batch), err)
+	}
+	resolveBatch(batch, err)
+}
+
+// post sends body, reporting whether a failure is worth retrying
+func (w *webhookOutput) post(body []byte) (bool, error) {
+	req, err := http.NewRequest(w.config.Method, w.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range w.config.Headers {
+		req.Header.Set(name, value)
+	}
+	if w.config.HMACSecret != "" {
+		mac := hmac.New(sha256.New, []byte(w.config.HMACSecret))
+		mac.Write(body)
+		req.Header.Set(w.config.SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		// the error quotes the URL, which ends up in the logs and dead letters
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			urlErr.URL = redactURL(urlErr.URL)
+		}
+		return true, err
+	}
+	defer resp.Body.Close()
+	resBody, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		retryable := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return retryable, fmt.Errorf("unexpected HTTP status code: %d, message: %s", resp.StatusCode, resBody)
+	}
+	return false, nil
+}